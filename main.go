@@ -1,12 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net/http"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/codeactual/ec2metaproxy/proxy"
 )
 
@@ -16,19 +15,28 @@ func main() {
 		log.Fatalf("Error reading configuration from flag/file: %+v", configErr)
 	}
 
-	logger := log.New(os.Stdout, "ec2metaproxy ", log.LstdFlags|log.LUTC)
+	logger := proxy.NewLogger(os.Stdout, config)
 
-	containerSvc, dockerErr := proxy.NewDockerContainerService(config, logger)
-	if dockerErr != nil {
-		log.Fatalf("Error creating Docker service: %+v", dockerErr)
+	containerSvc, containerErr := proxy.NewContainerService(config, logger)
+	if containerErr != nil {
+		log.Fatalf("Error creating container service: %+v", containerErr)
+	}
+	if watcher, ok := containerSvc.(proxy.ContainerWatcher); ok {
+		go watcher.Watch(context.Background())
 	}
 
-	p, initErr := proxy.New(config, &http.Transport{}, sts.New(session.New()), containerSvc, logger)
+	p, initErr := proxy.New(config, proxy.NewUpstreamTransport(config), proxy.NewPartitionSTS(session.New(), config), containerSvc, logger)
 	if initErr != nil {
 		log.Fatalf("Error creating proxy: %+v", initErr)
 	}
 
-	http.Handle("/", proxy.RequestID(p))
+	appliers := []proxy.ConfigApplier{logger}
+	if applier, ok := containerSvc.(proxy.ConfigApplier); ok {
+		appliers = append(appliers, applier)
+	}
+	go proxy.WatchConfig(context.Background(), config, logger, proxy.NotifyReload(), append(appliers, p)...)
 
-	logger.Fatal(p.Listen())
+	if listenErr := p.Listen(); listenErr != nil {
+		log.Fatalf("Error listening: %+v", listenErr)
+	}
 }
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminContainer describes a container IP mapping entry in admin API responses.
+type AdminContainer struct {
+	IP          string    `json:"ip"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Image       string    `json:"image"`
+	Platform    string    `json:"platform,omitempty"`
+	RoleAlias   string    `json:"roleAlias"`
+	RoleARN     string    `json:"roleArn"`
+	Policy      string    `json:"policy"`
+	RefreshTime time.Time `json:"refreshTime"`
+}
+
+// AdminCredentials describes cached credentials in admin API responses. Secret keys and
+// session tokens are never included.
+type AdminCredentials struct {
+	IP            string    `json:"ip"`
+	ContainerID   string    `json:"containerId"`
+	ContainerName string    `json:"containerName"`
+	RoleAlias     string    `json:"roleAlias"`
+	RoleARN       string    `json:"roleArn"`
+	PolicySHA256  string    `json:"policySha256"`
+	AccessKeyID   string    `json:"accessKeyId"`
+	GeneratedAt   time.Time `json:"generatedAt"`
+	Expiration    time.Time `json:"expiration"`
+}
+
+// AdminEviction is the response of a credentials eviction.
+type AdminEviction struct {
+	Evicted int `json:"evicted"`
+}
+
+// adminSelector selects containers by IP or by ID (or an ID prefix), from the "ip" or
+// "container" query parameter.
+type adminSelector struct {
+	ip          string
+	containerID string
+}
+
+func newAdminSelector(r *http.Request) (adminSelector, bool) {
+	s := adminSelector{ip: r.URL.Query().Get("ip"), containerID: r.URL.Query().Get("container")}
+	if s.ip != "" {
+		s.ip = normalizeIP(s.ip)
+	}
+	return s, (s.ip == "") != (s.containerID == "")
+}
+
+func (s adminSelector) matches(ip string, container ContainerInfo) bool {
+	if s.ip != "" {
+		return ip == s.ip
+	}
+	return strings.HasPrefix(container.ID, s.containerID)
+}
+
+// HandleAdminContainers lists the container IP mapping, if the ContainerService implements
+// ContainerInventory.
+func (p *Proxy) HandleAdminContainers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	inventory, ok := p.credsProvider.container.(ContainerInventory)
+	if !ok {
+		http.Error(w, "The container service cannot list containers", http.StatusNotImplemented)
+		return
+	}
+
+	p.writeAdminJSON(w, http.StatusOK, adminContainers(inventory.Containers(), func(string, ContainerInfo) bool { return true }))
+}
+
+// HandleAdminResync resyncs the container IP mapping entries of the container selected by
+// the "ip" or "container" query parameter, then lists them.
+//
+// If no entry has the IP, the whole mapping is resynced so that a new container can be found.
+func (p *Proxy) HandleAdminResync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	selector, ok := newAdminSelector(r)
+	if !ok {
+		http.Error(w, "Exactly one of the 'ip' or 'container' query parameters is required", http.StatusBadRequest)
+		return
+	}
+
+	inventory, ok := p.credsProvider.container.(ContainerInventory)
+	if !ok {
+		http.Error(w, "The container service cannot resync containers", http.StatusNotImplemented)
+		return
+	}
+
+	containerID := selector.containerID
+	for _, entry := range inventory.Containers() {
+		if selector.matches(entry.IP, entry.ContainerInfo) {
+			containerID = entry.ID
+			break
+		}
+	}
+
+	log := loggerFromContext(r.Context(), p.log)
+	log.Info("HandleAdminResync: resyncing containers", "ip", selector.ip, logKeyContainerID, containerID)
+
+	if err := inventory.Resync(r.Context(), containerID); err != nil {
+		log.Error("HandleAdminResync: Error resyncing containers", logKeyError, err)
+		http.Error(w, "An unexpected error resyncing containers", http.StatusInternalServerError)
+		return
+	}
+
+	p.writeAdminJSON(w, http.StatusOK, adminContainers(inventory.Containers(), selector.matches))
+}
+
+// HandleAdminCredentials lists cached credentials.
+func (p *Proxy) HandleAdminCredentials(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	cached := p.credsProvider.cachedCredentials()
+	list := make([]AdminCredentials, 0, len(cached))
+	for key, creds := range cached {
+		list = append(list, AdminCredentials{
+			IP:            credentialsKeyIP(key),
+			ContainerID:   creds.ContainerInfo.ID,
+			ContainerName: creds.ContainerInfo.Name,
+			RoleAlias:     creds.credentials.RoleAlias,
+			RoleARN:       creds.credentials.RoleArn.String(),
+			PolicySHA256:  policyHash(creds.credentials.Policy),
+			AccessKeyID:   creds.AccessKey,
+			GeneratedAt:   creds.GeneratedAt,
+			Expiration:    creds.Expiration,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+
+	p.writeAdminJSON(w, http.StatusOK, list)
+}
+
+// HandleAdminEvict removes the cached credentials of the container selected by the "ip" or
+// "container" query parameter. Its next request assumes the role again.
+func (p *Proxy) HandleAdminEvict(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	selector, ok := newAdminSelector(r)
+	if !ok {
+		http.Error(w, "Exactly one of the 'ip' or 'container' query parameters is required", http.StatusBadRequest)
+		return
+	}
+
+	evicted := p.credsProvider.evict(func(ip string, creds containerCredentials) bool {
+		return selector.matches(ip, creds.ContainerInfo)
+	})
+
+	loggerFromContext(r.Context(), p.log).Info("HandleAdminEvict: evicted credentials",
+		"ip", selector.ip,
+		logKeyContainerID, selector.containerID,
+		"evicted", evicted,
+	)
+
+	p.writeAdminJSON(w, http.StatusOK, AdminEviction{Evicted: evicted})
+}
+
+func adminContainers(entries []ContainerEntry, match func(string, ContainerInfo) bool) []AdminContainer {
+	list := make([]AdminContainer, 0, len(entries))
+	for _, entry := range entries {
+		if !match(entry.IP, entry.ContainerInfo) {
+			continue
+		}
+		list = append(list, AdminContainer{
+			IP:          entry.IP,
+			ID:          entry.ID,
+			Name:        entry.Name,
+			Image:       entry.Image,
+			Platform:    entry.Platform,
+			RoleAlias:   entry.RoleAlias,
+			RoleARN:     entry.IamRole.String(),
+			Policy:      entry.IamPolicy,
+			RefreshTime: entry.RefreshTime,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// allowMethod responds with 405 if the request does not use the method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
+// writeAdminJSON responds with the code and the value as JSON.
+func (p *Proxy) writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		p.log.Error("writeAdminJSON: Error marshaling response", logKeyError, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		p.log.Warn("writeAdminJSON: Error writing response", logKeyError, err)
+	}
+}
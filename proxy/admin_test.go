@@ -0,0 +1,139 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func newAdminTestProxy(t *testing.T, containerSvc proxy.ContainerService) *proxy.Proxy {
+	httpClient := roundTripperStub{
+		res: &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(defaultProxiedBody)),
+			StatusCode: 200,
+		},
+	}
+	p, err := proxy.New(defaultConfig(), httpClient, defaultStsSvcStub(), containerSvc, newLogger().logger)
+	fatalOnErr(t, err)
+	return p
+}
+
+func serveAdminRequest(p *proxy.Proxy, method, path string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(res, httptest.NewRequest(method, path, nil))
+	return res
+}
+
+func adminCredentials(t *testing.T, p *proxy.Proxy) []proxy.AdminCredentials {
+	res := serveAdminRequest(p, "GET", "/credentials")
+	responseCodeIs(t, res, 200)
+
+	var list []proxy.AdminCredentials
+	fatalOnErr(t, json.NewDecoder(res.Body).Decode(&list))
+	return list
+}
+
+func TestAdmin(t *testing.T) {
+	t.Run("should list containers", func(t *testing.T) {
+		p := newAdminTestProxy(t, defaultContainerSvcStub())
+
+		res := serveAdminRequest(p, "GET", "/containers")
+		responseCodeIs(t, res, 200)
+
+		var list []proxy.AdminContainer
+		fatalOnErr(t, json.NewDecoder(res.Body).Decode(&list))
+		if len(list) != len(defaultIPContainerInfo()) {
+			t.Fatalf("expected [%d] containers, got [%d]", len(defaultIPContainerInfo()), len(list))
+		}
+		for _, c := range list {
+			expected := defaultIPContainerInfo()[c.IP]
+			stringsEqual(t, [][2]string{
+				[2]string{expected.ID, c.ID},
+				[2]string{expected.IamRole.String(), c.RoleARN},
+				[2]string{expected.IamPolicy, c.Policy},
+			})
+		}
+	})
+
+	t.Run("should list cached credentials without secrets", func(t *testing.T) {
+		p := newAdminTestProxy(t, defaultContainerSvcStub())
+		responseCodeIs(t, serveRequest(proxy.RequestID(p), "GET", defaultPathReq, defaultIP, nil), 200)
+
+		res := serveAdminRequest(p, "GET", "/credentials")
+		responseCodeIs(t, res, 200)
+		body := bodyIsNonEmpty(t, res.Body)
+		if strings.Contains(body, "fakeSecretAccessKey") || strings.Contains(body, "fakeSessionToken") {
+			t.Fatalf("expected no secrets, got [%s]", body)
+		}
+
+		var list []proxy.AdminCredentials
+		fatalOnErr(t, json.Unmarshal([]byte(body), &list))
+		if len(list) != 1 {
+			t.Fatalf("expected 1 entry, got [%d]", len(list))
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{defaultIP, list[0].IP},
+			[2]string{defaultIPContainerInfo()[defaultIP].ID, list[0].ContainerID},
+			[2]string{"fakeAccessKeyId", list[0].AccessKeyID},
+		})
+		if list[0].Expiration.IsZero() {
+			t.Fatal("expected expiration")
+		}
+	})
+
+	t.Run("should evict credentials by IP or container ID prefix", func(t *testing.T) {
+		p := newAdminTestProxy(t, defaultContainerSvcStub())
+		h := proxy.RequestID(p)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil), 200)
+
+		responseCodeIs(t, serveAdminRequest(p, "POST", "/credentials/evict"), 400)
+		responseCodeIs(t, serveAdminRequest(p, "GET", "/credentials/evict?ip="+defaultIP), 405)
+
+		res := serveAdminRequest(p, "POST", "/credentials/evict?ip="+defaultIP)
+		responseCodeIs(t, res, 200)
+		var eviction proxy.AdminEviction
+		fatalOnErr(t, json.NewDecoder(res.Body).Decode(&eviction))
+		if eviction.Evicted != 1 {
+			t.Fatalf("expected 1 eviction, got [%d]", eviction.Evicted)
+		}
+		if list := adminCredentials(t, p); len(list) != 1 || list[0].IP != ipWithAllLabels {
+			t.Fatalf("expected only [%s] to remain cached, got [%+v]", ipWithAllLabels, list)
+		}
+
+		responseCodeIs(t, serveAdminRequest(p, "POST", "/credentials/evict?container=container_2_"), 200)
+		if list := adminCredentials(t, p); len(list) != 0 {
+			t.Fatalf("expected no cached credentials, got [%+v]", list)
+		}
+	})
+
+	t.Run("should resync container by IP", func(t *testing.T) {
+		containerSvc := defaultContainerSvcStub()
+		p := newAdminTestProxy(t, containerSvc)
+
+		res := serveAdminRequest(p, "POST", "/containers/resync?ip="+defaultIP)
+		responseCodeIs(t, res, 200)
+
+		var list []proxy.AdminContainer
+		fatalOnErr(t, json.NewDecoder(res.Body).Decode(&list))
+		if len(list) != 1 || list[0].IP != defaultIP {
+			t.Fatalf("expected the container at [%s], got [%+v]", defaultIP, list)
+		}
+
+		// Unknown IPs resync all containers.
+		responseCodeIs(t, serveAdminRequest(p, "POST", "/containers/resync?ip=10.9.9.9"), 200)
+
+		expected := []string{defaultIPContainerInfo()[defaultIP].ID, ""}
+		if len(containerSvc.resynced) != len(expected) {
+			t.Fatalf("expected resyncs %v, got %v", expected, containerSvc.resynced)
+		}
+		for i := range expected {
+			stringsEqual(t, [][2]string{[2]string{expected[i], containerSvc.resynced[i]}})
+		}
+	})
+}
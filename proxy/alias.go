@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDurationSeconds int64 = 3600
+	minDurationSeconds     int64 = 900
+	maxDurationSeconds     int64 = 43200
+
+	minExternalIDLen = 2
+	maxExternalIDLen = 1224
+
+	maxTemplateSessionNameLen = 64
+)
+
+// matches char that is not valid in a STS external ID
+var invalidExternalIDRegexp = regexp.MustCompile(`[^\w+=,.@:/-]`)
+
+// AliasOptions customizes AssumeRole calls for one alias. It is selected by the object form
+// of an `aliasToARN` value, ex. {"arn": "...", "externalId": "..."}, instead of the ARN string.
+type AliasOptions struct {
+	// ARN is the role ARN, which is also stored in Config.AliasToARN.
+	ARN string `json:"arn"`
+	// ExternalID is required by some cross-account roles.
+	ExternalID string `json:"externalId,omitempty"`
+	// DurationSeconds defaults to 3600. The role's maximum session duration must allow it.
+	DurationSeconds int64 `json:"durationSeconds,omitempty"`
+	// SessionNameTemplate is a text/template of the role session name, ex. "{{.Name}}".
+	// See sessionNameData for the available fields.
+	SessionNameTemplate string `json:"sessionNameTemplate,omitempty"`
+	// Policy replaces Config.DefaultPolicy for containers with this alias and no policy label.
+	Policy string `json:"policy,omitempty"`
+	// Via lists ARNs of intermediate roles, ex. a broker role trusted by ARN. The first is assumed
+	// with the instance profile, and each other with the credentials of the previous one.
+	// Chained sessions cannot exceed 3600 seconds.
+	Via []string `json:"via,omitempty"`
+}
+
+// validate checks the option values of the alias.
+func (o AliasOptions) validate(alias string) error {
+	if o.ExternalID != "" && (len(o.ExternalID) < minExternalIDLen || len(o.ExternalID) > maxExternalIDLen || invalidExternalIDRegexp.MatchString(o.ExternalID)) {
+		return errors.Errorf("Config file selected an invalid 'externalId' for alias [%s].", alias)
+	}
+	if o.DurationSeconds != 0 && (o.DurationSeconds < minDurationSeconds || o.DurationSeconds > maxDurationSeconds) {
+		return errors.Errorf("Config file selected a 'durationSeconds' [%d] for alias [%s] outside of [%d, %d].", o.DurationSeconds, alias, minDurationSeconds, maxDurationSeconds)
+	}
+	if len(o.Via) > 0 && o.duration() > maxChainedDurationSeconds {
+		return errors.Errorf("Config file selected a 'durationSeconds' [%d] for alias [%s] above the [%d] limit of chained roles.", o.DurationSeconds, alias, maxChainedDurationSeconds)
+	}
+	for _, arn := range o.Via {
+		if _, err := NewRoleARN(arn); err != nil {
+			return errors.Wrapf(err, "Config file selected an invalid 'via' role ARN for alias [%s]", alias)
+		}
+	}
+	if _, err := o.sessionNameTemplate(); err != nil {
+		return errors.Wrapf(err, "Config file selected an invalid 'sessionNameTemplate' for alias [%s]", alias)
+	}
+	return nil
+}
+
+// duration returns the selected duration or the default.
+func (o AliasOptions) duration() int64 {
+	if o.DurationSeconds == 0 {
+		return defaultDurationSeconds
+	}
+	return o.DurationSeconds
+}
+
+// sessionNameTemplate parses the template, or returns nil if none is selected.
+func (o AliasOptions) sessionNameTemplate() (*template.Template, error) {
+	if o.SessionNameTemplate == "" {
+		return nil, nil
+	}
+	return template.New("sessionName").Option("missingkey=zero").Parse(o.SessionNameTemplate)
+}
+
+// sessionNameData holds the fields available to session name templates.
+type sessionNameData struct {
+	// ID is the full container ID.
+	ID string
+	// Name is the container name.
+	Name string
+	// Image is the container image name.
+	Image string
+	// Labels holds container labels, ex. `{{index .Labels "com.example.team"}}`.
+	Labels map[string]string
+	// Platform is the container service type, ex. "docker".
+	Platform string
+}
+
+// renderSessionName executes the template with the container's metadata. Invalid characters
+// are replaced and the result is truncated to the STS limit. It returns an empty string if the
+// result is too short to use.
+func renderSessionName(tmpl *template.Template, platform string, container ContainerInfo) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, sessionNameData{
+		ID:       container.ID,
+		Name:     container.Name,
+		Image:    container.Image,
+		Labels:   container.Labels,
+		Platform: platform,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Error executing session name template")
+	}
+
+	sessionName := invalidSessionNameRegexp.ReplaceAllString(buf.String(), "_")
+	if len(sessionName) > maxTemplateSessionNameLen {
+		sessionName = sessionName[:maxTemplateSessionNameLen]
+	}
+	if len(sessionName) < 2 {
+		return "", nil
+	}
+
+	return sessionName, nil
+}
+
+// unmarshalAliasToARN accepts both the string and object form of each alias.
+func unmarshalAliasToARN(raw map[string]json.RawMessage) (map[string]string, map[string]AliasOptions, error) {
+	aliasToARN := make(map[string]string, len(raw))
+	var aliasOptions map[string]AliasOptions
+
+	for alias, value := range raw {
+		var arn string
+		if err := json.Unmarshal(value, &arn); err == nil {
+			aliasToARN[alias] = arn
+			continue
+		}
+
+		var options AliasOptions
+		if err := json.Unmarshal(value, &options); err != nil {
+			return nil, nil, errors.Wrapf(err, "Error parsing 'aliasToARN' value of alias [%s], expected an ARN string or options object", alias)
+		}
+		if aliasOptions == nil {
+			aliasOptions = make(map[string]AliasOptions)
+		}
+		aliasToARN[alias] = options.ARN
+		aliasOptions[alias] = options
+	}
+
+	return aliasToARN, aliasOptions, nil
+}
+
+// marshalAliasToARN selects the object form for aliases with options.
+func marshalAliasToARN(aliasToARN map[string]string, aliasOptions map[string]AliasOptions) map[string]interface{} {
+	out := make(map[string]interface{}, len(aliasToARN))
+	for alias, arn := range aliasToARN {
+		if options, found := aliasOptions[alias]; found {
+			options.ARN = arn
+			out[alias] = options
+		} else {
+			out[alias] = arn
+		}
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func TestAliasOptions(t *testing.T) {
+	t.Run("should accept string and object forms", func(t *testing.T) {
+		var config proxy.Config
+		fatalOnErr(t, json.Unmarshal([]byte(`{
+			"aliasToARN": {
+				"noperms": "arn:aws:iam::123456789012:role/NoPerms",
+				"vendor": {
+					"arn": "arn:aws:iam::210987654321:role/Vendor",
+					"externalId": "vendor-external-id",
+					"durationSeconds": 43200,
+					"sessionNameTemplate": "{{.Name}}",
+					"policy": "{}"
+				}
+			}
+		}`), &config))
+
+		options := config.AliasOptions["vendor"]
+		stringsEqual(t, [][2]string{
+			[2]string{"arn:aws:iam::123456789012:role/NoPerms", config.AliasToARN["noperms"]},
+			[2]string{"arn:aws:iam::210987654321:role/Vendor", config.AliasToARN["vendor"]},
+			[2]string{"vendor-external-id", options.ExternalID},
+			[2]string{"{{.Name}}", options.SessionNameTemplate},
+			[2]string{"{}", options.Policy},
+		})
+		if options.DurationSeconds != 43200 {
+			t.Fatalf("expected duration 43200, got %d", options.DurationSeconds)
+		}
+		if _, found := config.AliasOptions["noperms"]; found {
+			t.Fatal("expected no options for string form")
+		}
+	})
+
+	t.Run("should apply options to AssumeRole", func(t *testing.T) {
+		config := defaultConfig()
+		config.AliasOptions = map[string]proxy.AliasOptions{
+			"db": proxy.AliasOptions{
+				ExternalID:          "vendor-external-id",
+				DurationSeconds:     7200,
+				SessionNameTemplate: `{{.Name}}-{{index .Labels "com.example.team"}}`,
+			},
+		}
+		stsSvc := defaultStsSvcStub()
+
+		res, _, err := stubRequest(defaultPathSpec, defaultPathReqBase+"/"+dbRoleARNFriendlyName, config, stsSvc, defaultContainerSvcStub(), ipWithAllLabels)
+		fatalOnErr(t, err)
+
+		responseCodeIs(t, res, 200)
+		stringsEqual(t, [][2]string{
+			[2]string{"vendor-external-id", aws.StringValue(stsSvc.input.ExternalId)},
+			[2]string{"container_2_name-data,platform", aws.StringValue(stsSvc.input.RoleSessionName)},
+		})
+		if duration := aws.Int64Value(stsSvc.input.DurationSeconds); duration != 7200 {
+			t.Fatalf("expected duration 7200, got %d", duration)
+		}
+	})
+
+	t.Run("should apply alias policy to container without policy", func(t *testing.T) {
+		config := defaultConfig()
+		config.DefaultPolicy = defaultPolicy
+		config.AliasOptions = map[string]proxy.AliasOptions{
+			"noperms": proxy.AliasOptions{Policy: defaultCustomPolicy},
+		}
+		stsSvc := defaultStsSvcStub()
+
+		res, _, err := stubRequest(defaultPathSpec, defaultPathReq, config, stsSvc, defaultContainerSvcStub(), defaultIP)
+		fatalOnErr(t, err)
+
+		responseCodeIs(t, res, 200)
+		assumeRolePolicyIs(t, defaultCustomPolicy, stsSvc)
+		if duration := aws.Int64Value(stsSvc.input.DurationSeconds); duration != 3600 {
+			t.Fatalf("expected default duration 3600, got %d", duration)
+		}
+		if stsSvc.input.ExternalId != nil {
+			t.Fatalf("expected no external ID, got [%s]", *stsSvc.input.ExternalId)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditOutputStdout selects standard out as the audit log, ex. for collection by the container runtime.
+const AuditOutputStdout = "stdout"
+
+// Sources of vended credentials in audit records.
+const (
+	CredentialsSourceCache      = "cache"
+	CredentialsSourceAssumeRole = "assumeRole"
+)
+
+const (
+	defaultAuditMaxSizeMB  = 100
+	defaultAuditMaxBackups = 5
+	bytesPerMB             = 1024 * 1024
+)
+
+// openAuditFile opens audit files. It is replaced by tests to simulate failures.
+var openAuditFile = os.OpenFile
+
+// AuditConfig selects where credential vends are recorded.
+type AuditConfig struct {
+	// Output is AuditOutputStdout or the path of a file which records are appended to.
+	// Auditing is disabled if it is empty.
+	Output string `json:"output"`
+	// MaxSizeMB is the size at which the file is rotated. Defaults to 100.
+	MaxSizeMB int `json:"maxSizeMB"`
+	// MaxBackups is the number of rotated files, ex. "audit.log.1", that are kept. Defaults to 5.
+	MaxBackups int `json:"maxBackups"`
+}
+
+func (a *AuditConfig) validate() error {
+	if a.MaxSizeMB < 0 {
+		return errors.Errorf("Config file selected a negative 'audit.maxSizeMB' [%d].", a.MaxSizeMB)
+	}
+	if a.MaxBackups < 0 {
+		return errors.Errorf("Config file selected a negative 'audit.maxBackups' [%d].", a.MaxBackups)
+	}
+	if a.MaxSizeMB == 0 {
+		a.MaxSizeMB = defaultAuditMaxSizeMB
+	}
+	if a.MaxBackups == 0 {
+		a.MaxBackups = defaultAuditMaxBackups
+	}
+	return nil
+}
+
+// AuditRecord describes credentials vended to a container. It never includes the secret key
+// or session token.
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	ClientIP      string    `json:"client_ip"`
+	ContainerID   string    `json:"container_id"`
+	ContainerName string    `json:"container_name"`
+	Image         string    `json:"image"`
+	RoleAlias     string    `json:"role_alias"`
+	RoleARN       string    `json:"role_arn"`
+	// PolicySHA256 is the hex SHA-256 of the effective session policy, if any.
+	PolicySHA256 string    `json:"policy_sha256"`
+	AccessKeyID  string    `json:"access_key_id"`
+	Expiration   time.Time `json:"expiration"`
+	// Source is CredentialsSourceCache or CredentialsSourceAssumeRole.
+	Source string `json:"source"`
+}
+
+// auditLog writes one JSON line per AuditRecord. A nil auditLog discards records.
+type auditLog struct {
+	out  io.Writer
+	lock sync.Mutex
+}
+
+// newAuditLog opens the output selected by the config. It returns nil if auditing is disabled.
+func newAuditLog(config AuditConfig) (*auditLog, error) {
+	switch config.Output {
+	case "":
+		return nil, nil
+	case AuditOutputStdout:
+		return &auditLog{out: os.Stdout}, nil
+	}
+
+	f, err := newRotatingFile(config.Output, int64(config.MaxSizeMB)*bytesPerMB, config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{out: f}, nil
+}
+
+// Record appends the record as a JSON line.
+func (a *auditLog) Record(r AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrapf(err, "Error marshaling audit record of request [%s]", r.RequestID)
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, err := a.out.Write(line); err != nil {
+		return errors.Wrapf(err, "Error writing audit record of request [%s]", r.RequestID)
+	}
+	if f, ok := a.out.(*rotatingFile); ok {
+		if err := f.takeRotateErr(); err != nil {
+			return errors.Wrapf(err, "Error rotating audit file after record of request [%s]", r.RequestID)
+		}
+	}
+	return nil
+}
+
+// policyHash returns the hex SHA-256 of the policy, or an empty string if there is none.
+func policyHash(policy string) string {
+	if policy == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(policy))
+	return hex.EncodeToString(sum[:])
+}
+
+// rotatingFile appends to a file until it reaches maxSize, then renames it to "<path>.1",
+// shifting older backups, and starts a new file. The oldest backup beyond maxBackups is removed.
+//
+// If rotation fails, ex. because a backup cannot be renamed, records are still appended to the
+// current file and rotation is retried by the next Write. Write only reports errors of the
+// record itself; the rotation error is kept for takeRotateErr.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	// renamed is true if the open file was renamed to the first backup, but no new file could
+	// be opened yet. Rotation then only retries opening one.
+	renamed   bool
+	rotateErr error
+	lock      sync.Mutex
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := openAuditFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Error opening audit file [%s]", r.path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "Error during stat of audit file [%s]", r.path)
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		r.rotateErr = r.rotate()
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// takeRotateErr returns the error of the last rotation, if it failed, and clears it.
+func (r *rotatingFile) takeRotateErr() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.rotateErr
+	r.rotateErr = nil
+	return err
+}
+
+// rotate renames the open file and its backups, and then opens a new file. The current file
+// stays open until the new one is, so that a failure at any step leaves a file to write to.
+//
+// Only the backups below the first free backup path are shifted, so that retrying a rotation
+// that failed partway never overwrites a backup.
+func (r *rotatingFile) rotate() error {
+	if !r.renamed {
+		free := 1
+		for ; free < r.maxBackups; free++ {
+			if _, err := os.Lstat(backupPath(r.path, free)); os.IsNotExist(err) {
+				break
+			}
+		}
+		for i := free - 1; i > 0; i-- {
+			if err := os.Rename(backupPath(r.path, i), backupPath(r.path, i+1)); err != nil {
+				return errors.Wrapf(err, "Error renaming audit file backup [%s]", backupPath(r.path, i))
+			}
+		}
+		if err := os.Rename(r.path, backupPath(r.path, 1)); err != nil {
+			return errors.Wrapf(err, "Error renaming audit file [%s]", r.path)
+		}
+		r.renamed = true
+	}
+
+	// Until a new file is opened, records are appended to the renamed one.
+	current := r.file
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.renamed = false
+	if err := current.Close(); err != nil {
+		return errors.Wrapf(err, "Error closing audit file backup [%s]", backupPath(r.path, 1))
+	}
+	return nil
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// auditCredentials records credentials vended in response to the request.
+func (p *Proxy) auditCredentials(log *Logger, requestID, clientIP string, c credentials) {
+	err := p.audit.Record(AuditRecord{
+		Time:          time.Now().UTC(),
+		RequestID:     requestID,
+		ClientIP:      clientIP,
+		ContainerID:   c.Container.ID,
+		ContainerName: c.Container.Name,
+		Image:         c.Container.Image,
+		RoleAlias:     c.RoleAlias,
+		RoleARN:       c.RoleArn.String(),
+		PolicySHA256:  policyHash(c.Policy),
+		AccessKeyID:   c.AccessKey,
+		Expiration:    c.Expiration,
+		Source:        c.Source,
+	})
+	if err != nil {
+		log.Error("auditCredentials: Error recording credentials", logKeyError, err)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFileFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ec2metaproxy-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "audit.log")
+	f, err := newRotatingFile(name, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-empty directory cannot be replaced by the rename to the backup path.
+	if err := os.MkdirAll(filepath.Join(name+".1", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"record-1\n", "record-2\n", "record-3\n"} {
+		n, err := f.Write([]byte(line))
+		if err != nil || n != len(line) {
+			t.Fatalf("expected [%s] to be written, got [%d] bytes: %+v", strings.TrimSpace(line), n, err)
+		}
+		if rotateErr := f.takeRotateErr(); line != "record-1\n" && rotateErr == nil {
+			t.Fatalf("expected rotation error for [%s]", strings.TrimSpace(line))
+		}
+	}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "record-1\nrecord-2\nrecord-3\n" {
+		t.Fatalf("expected all records after failed rotations, got [%s]", content)
+	}
+
+	// Rotation is retried once the backup path is free.
+	if err := os.RemoveAll(name + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("record-4\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{name: "record-4\n", name + ".1": "record-1\nrecord-2\nrecord-3\n"} {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("expected [%s] to hold [%q], got [%q]", path, expected, content)
+		}
+	}
+}
+
+func TestRotatingFileOpenFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ec2metaproxy-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "audit.log")
+	f, err := newRotatingFile(name, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{name + ".1": "old-1\n", name + ".2": "old-2\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rename succeeds, but no new file can be opened.
+	openAuditFile = func(string, int, os.FileMode) (*os.File, error) {
+		return nil, os.ErrPermission
+	}
+	defer func() { openAuditFile = os.OpenFile }()
+
+	for _, line := range []string{"record-1\n", "record-2\n", "record-3\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		if rotateErr := f.takeRotateErr(); line != "record-1\n" && rotateErr == nil {
+			t.Fatalf("expected rotation error for [%s]", strings.TrimSpace(line))
+		}
+	}
+
+	openAuditFile = os.OpenFile
+	if _, err := f.Write([]byte("record-4\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.takeRotateErr(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Retried rotations must not shift the backups again.
+	expected := map[string]string{
+		name:        "record-4\n",
+		name + ".1": "record-1\nrecord-2\nrecord-3\n",
+		name + ".2": "old-1\n",
+		name + ".3": "old-2\n",
+	}
+	for path, content := range expected {
+		actual, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != content {
+			t.Fatalf("expected [%s] to hold [%q], got [%q]", path, content, actual)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func readAuditRecords(t *testing.T, name string) []proxy.AuditRecord {
+	f, err := os.Open(name)
+	fatalOnErr(t, err)
+	defer f.Close()
+
+	var records []proxy.AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "fakeSecretAccessKey") || strings.Contains(scanner.Text(), "fakeSessionToken") {
+			t.Fatalf("expected no secrets in audit record, got [%s]", scanner.Text())
+		}
+		var r proxy.AuditRecord
+		fatalOnErr(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	fatalOnErr(t, scanner.Err())
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ec2metaproxy-audit")
+	fatalOnErr(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("should record each credentials vend", func(t *testing.T) {
+		name := filepath.Join(dir, "vend.log")
+		config := defaultConfig()
+		config.Audit = proxy.AuditConfig{Output: name, MaxSizeMB: 1, MaxBackups: 1}
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/", ipWithAllLabels, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", "/v2/credentials/any-id", ipWithAllLabels, map[string]string{
+			"Authorization": defaultAuthorizationToken,
+		}), 200)
+
+		// The role name listing does not vend credentials.
+		records := readAuditRecords(t, name)
+		if len(records) != 2 {
+			t.Fatalf("expected 2 records, got [%d]", len(records))
+		}
+
+		container := defaultIPContainerInfo()[ipWithAllLabels]
+		for _, r := range records {
+			stringsEqual(t, [][2]string{
+				[2]string{ipWithAllLabels, r.ClientIP},
+				[2]string{container.ID, r.ContainerID},
+				[2]string{container.Name, r.ContainerName},
+				[2]string{container.Image, r.Image},
+				[2]string{"db", r.RoleAlias},
+				[2]string{config.AliasToARN["db"], r.RoleARN},
+				[2]string{"fakeAccessKeyId", r.AccessKeyID},
+			})
+			if r.RequestID == "" || r.PolicySHA256 == "" || r.Time.IsZero() || r.Expiration.IsZero() {
+				t.Fatalf("expected request ID, policy hash, time and expiration, got [%+v]", r)
+			}
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{proxy.CredentialsSourceCache, records[0].Source},
+			[2]string{proxy.CredentialsSourceCache, records[1].Source},
+		})
+	})
+
+	t.Run("should record credentials from AssumeRole", func(t *testing.T) {
+		name := filepath.Join(dir, "source.log")
+		config := defaultConfig()
+		config.Audit = proxy.AuditConfig{Output: name, MaxSizeMB: 1, MaxBackups: 1}
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+
+		records := readAuditRecords(t, name)
+		if len(records) != 2 {
+			t.Fatalf("expected 2 records, got [%d]", len(records))
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{proxy.CredentialsSourceAssumeRole, records[0].Source},
+			[2]string{proxy.CredentialsSourceCache, records[1].Source},
+			[2]string{"", records[0].PolicySHA256},
+		})
+	})
+
+	t.Run("should rotate the file at the maximum size", func(t *testing.T) {
+		name := filepath.Join(dir, "rotate.log")
+		config := defaultConfig()
+		config.Audit = proxy.AuditConfig{Output: name, MaxSizeMB: 1, MaxBackups: 1}
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		for {
+			responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+			if _, err := os.Stat(name + ".1"); err == nil {
+				break
+			}
+		}
+
+		info, err := os.Stat(name + ".1")
+		fatalOnErr(t, err)
+		if info.Size() > 1024*1024 {
+			t.Fatalf("expected rotated file of at most 1MB, got [%d] bytes", info.Size())
+		}
+		if len(readAuditRecords(t, name)) != 1 {
+			t.Fatalf("expected 1 record after rotation")
+		}
+	})
+}
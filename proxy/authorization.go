@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ComposeProjectLabelKey identifies the docker metadata string that holds the compose project name.
+const ComposeProjectLabelKey = "com.docker.compose.project"
+
+// AuthorizationRule restricts a role alias to matching containers. Every selected condition
+// must match. Otherwise, credentials requests for the alias are denied.
+type AuthorizationRule struct {
+	// Images holds path.Match patterns of image names, ex. "registry.example.com/team/*:*", or
+	// of image digests, ex. "registry.example.com/team/db@sha256:*" or "sha256:*". One must match.
+	//
+	// Name patterns are matched against the image reference that the container was created from,
+	// which any user of the docker daemon can point at another image with "docker tag". Digest
+	// patterns are matched against the ContainerInfo's ImageDigests instead.
+	Images []string `json:"images"`
+	// Labels holds required label values.
+	Labels map[string]string `json:"labels"`
+	// ComposeProjects holds compose project names. One must match.
+	ComposeProjects []string `json:"composeProjects"`
+	// NamePattern is a regular expression that one of the container's names must match.
+	NamePattern string `json:"namePattern"`
+}
+
+// validate checks the patterns of the alias' rule.
+func (r AuthorizationRule) validate(alias string) error {
+	for _, pattern := range r.Images {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "Config file selected an invalid image pattern [%s] for alias [%s]", pattern, alias)
+		}
+	}
+	if _, err := regexp.Compile(r.NamePattern); err != nil {
+		return errors.Wrapf(err, "Config file selected an invalid 'namePattern' for alias [%s]", alias)
+	}
+	return nil
+}
+
+// authorizationRule is a validated AuthorizationRule.
+type authorizationRule struct {
+	AuthorizationRule
+	name *regexp.Regexp
+}
+
+func newAuthorizationRules(config Config) (map[string]authorizationRule, error) {
+	rules := make(map[string]authorizationRule, len(config.Authorization))
+	for alias, rule := range config.Authorization {
+		compiled := authorizationRule{AuthorizationRule: rule}
+		if rule.NamePattern != "" {
+			name, err := regexp.Compile(rule.NamePattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error compiling name pattern of alias [%s]", alias)
+			}
+			compiled.name = name
+		}
+		rules[alias] = compiled
+	}
+	return rules, nil
+}
+
+// check returns an accessDeniedError if the container does not match the rule of the alias.
+func (r authorizationRule) check(alias string, container ContainerInfo) error {
+	deny := func(format string, args ...interface{}) error {
+		return errors.WithStack(accessDeniedError{
+			reason: fmt.Sprintf("Container [%s] is not authorized for alias [%s]: ", container.Name, alias) + fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(r.Images) > 0 && !matchesImage(r.Images, container) {
+		return deny("image [%s] does not match %v", container.Image, r.Images)
+	}
+
+	for key, value := range r.Labels {
+		if actual, found := container.Labels[key]; !found || actual != value {
+			return deny("label [%s] is not [%s]", key, value)
+		}
+	}
+
+	if len(r.ComposeProjects) > 0 {
+		project := container.Labels[ComposeProjectLabelKey]
+		found := false
+		for _, allowed := range r.ComposeProjects {
+			if project == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return deny("compose project [%s] is not in %v", project, r.ComposeProjects)
+		}
+	}
+
+	if r.name != nil {
+		found := false
+		for _, name := range strings.Split(container.Name, ",") {
+			if r.name.MatchString(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return deny("name does not match [%s]", r.NamePattern)
+		}
+	}
+
+	return nil
+}
+
+// matchesImage returns true if one of the patterns matches the container's image. Digest
+// patterns only match the image digests that the ContainerService resolved.
+func matchesImage(patterns []string, container ContainerInfo) bool {
+	for _, pattern := range patterns {
+		if !isImageDigestPattern(pattern) {
+			if matched, _ := path.Match(pattern, container.Image); matched {
+				return true
+			}
+			continue
+		}
+		for _, digest := range container.ImageDigests {
+			if matched, _ := path.Match(pattern, digest); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isImageDigestPattern returns true if the pattern selects an image digest, ex.
+// "registry.example.com/team/db@sha256:*", rather than an image name.
+func isImageDigestPattern(pattern string) bool {
+	return strings.Contains(pattern, "@") || strings.HasPrefix(pattern, "sha256:")
+}
+
+// containsString returns true if the value is one of the values.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func TestAuthorization(t *testing.T) {
+	dbPath := defaultPathReqBase + "/" + dbRoleARNFriendlyName
+
+	cases := []struct {
+		name string
+		rule proxy.AuthorizationRule
+		code int
+	}{
+		{"should allow matching image", proxy.AuthorizationRule{Images: []string{"other/*", "example/db:*"}}, 200},
+		{"should deny other image", proxy.AuthorizationRule{Images: []string{"other/db@sha256:*", "example/*:2.*"}}, 403},
+		{"should allow matching repo digest", proxy.AuthorizationRule{Images: []string{"example/db@sha256:9f3b"}}, 200},
+		{"should allow matching image ID", proxy.AuthorizationRule{Images: []string{"sha256:0e6a"}}, 200},
+		{"should deny other digest", proxy.AuthorizationRule{Images: []string{"example/db@sha256:0e6a", "sha256:9f3b"}}, 403},
+		{"should allow required labels", proxy.AuthorizationRule{Labels: map[string]string{"com.example.team": "data,platform"}}, 200},
+		{"should deny missing label", proxy.AuthorizationRule{Labels: map[string]string{"com.example.owner": "data"}}, 403},
+		{"should deny other compose project", proxy.AuthorizationRule{ComposeProjects: []string{"billing"}}, 403},
+		{"should allow matching name", proxy.AuthorizationRule{NamePattern: "^container_2_"}, 200},
+		{"should deny other name", proxy.AuthorizationRule{NamePattern: "^billing-"}, 403},
+		{"should require all conditions", proxy.AuthorizationRule{Images: []string{"example/db:*"}, NamePattern: "^billing-"}, 403},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.Authorization = map[string]proxy.AuthorizationRule{"db": c.rule}
+			stsSvc := defaultStsSvcStub()
+			h := newTestHandler(t, config, stsSvc)
+
+			responseCodeIs(t, serveRequest(h, "GET", dbPath, ipWithAllLabels, nil), c.code)
+			if c.code == 403 && stsSvc.input != nil {
+				t.Fatal("expected no AssumeRole call")
+			}
+
+			// Rules of other aliases do not apply.
+			responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+		})
+	}
+
+	t.Run("should apply default alias rule to unlabeled container", func(t *testing.T) {
+		config := defaultConfig()
+		config.Authorization = map[string]proxy.AuthorizationRule{
+			"noperms": proxy.AuthorizationRule{NamePattern: "^billing-"},
+		}
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, ipWithNoLabels, nil), 403)
+	})
+}
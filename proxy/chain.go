@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxChainedDurationSeconds is the STS limit of sessions created with role credentials.
+	maxChainedDurationSeconds int64 = 3600
+	// chainSessionName is the session name of intermediate roles, which are shared by containers.
+	chainSessionName = "ec2metaproxy-chain"
+)
+
+// chainLink holds the credentials of an intermediate role and a client that signs with them.
+type chainLink struct {
+	creds  credentials
+	client stsiface.STSAPI
+}
+
+// chainCall is an in-flight AssumeRole of an intermediate role whose result is shared.
+type chainCall struct {
+	done chan struct{}
+	link chainLink
+	err  error
+}
+
+// chainClient returns a client that signs with the credentials of the chain's last role. The
+// chain's roles are assumed in order, unless their cached credentials are valid until
+// freshUntil. It returns the provider's client if the chain is empty.
+func (c *credentialsProvider) chainClient(ctx context.Context, chain []string, freshUntil time.Time) (stsiface.STSAPI, error) {
+	if len(chain) == 0 {
+		return c.awsSts, nil
+	}
+
+	if _, ok := c.awsSts.(CredentialsSTSAPI); !ok {
+		return nil, errors.New("STS client does not support role chaining")
+	}
+
+	client := c.awsSts
+	for i := range chain {
+		link, err := c.sharedChainLink(ctx, client, chain[:i+1], freshUntil)
+		if err != nil {
+			return nil, err
+		}
+		client = link.client
+	}
+
+	return client, nil
+}
+
+// sharedChainLink returns the cached link of the chain's last role if it is valid until
+// freshUntil, or assumes the role with the client of the previous link. Links are cached per
+// chain prefix and reused by all aliases with the same prefix. If the role is already being
+// assumed, that result is awaited instead, unless the context is canceled first.
+func (c *credentialsProvider) sharedChainLink(ctx context.Context, client stsiface.STSAPI, chain []string, freshUntil time.Time) (chainLink, error) {
+	key := chainKey(chain)
+
+	c.lock.Lock()
+	if link, found := c.chainLinks[key]; found && !link.creds.ExpiredAt(freshUntil) {
+		c.lock.Unlock()
+		return link, nil
+	}
+	call, found := c.chainInflight[key]
+	if !found {
+		call = &chainCall{done: make(chan struct{})}
+		c.chainInflight[key] = call
+	}
+	c.lock.Unlock()
+
+	if found {
+		select {
+		case <-call.done:
+			return call.link, call.err
+		case <-ctx.Done():
+			return chainLink{}, errors.Wrapf(ctx.Err(), "Error waiting for intermediate role [%s]", chain[len(chain)-1])
+		}
+	}
+
+	call.link, call.err = c.assumeChainLink(client, chain[len(chain)-1])
+
+	c.lock.Lock()
+	delete(c.chainInflight, key)
+	if call.err == nil {
+		c.chainLinks[key] = call.link
+	}
+	c.lock.Unlock()
+
+	close(call.done)
+
+	return call.link, call.err
+}
+
+// refreshChainLinks renews the cached links of the current aliases' chains that expire within
+// refreshAhead plus a random jitter, so that container credentials do not wait on them. Links of
+// chains that no alias selects anymore are evicted.
+func (c *credentialsProvider) refreshChainLinks(ctx context.Context, now time.Time) {
+	chains := make(map[string][]string)
+	for _, options := range c.currentSettings().aliasOptions {
+		for i := range options.Via {
+			chains[chainKey(options.Via[:i+1])] = options.Via[:i+1]
+		}
+	}
+
+	var due [][]string
+	c.lock.Lock()
+	for key, link := range c.chainLinks {
+		chain, used := chains[key]
+		if !used {
+			delete(c.chainLinks, key)
+			continue
+		}
+		window := refreshAhead + time.Duration(rand.Int63n(int64(refreshJitter)))
+		if link.creds.ExpiredAt(now.Add(window)) {
+			due = append(due, chain)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, chain := range due {
+		// Prefixes that are also due are renewed along the way. On error, the request path will
+		// retry (and report the error) once the cached credentials expire.
+		_, _ = c.chainClient(ctx, chain, now.Add(refreshAhead+refreshJitter))
+	}
+}
+
+// chainKey identifies the link of the chain's last role.
+func chainKey(chain []string) string {
+	return strings.Join(chain, "\x00")
+}
+
+// assumeChainLink assumes an intermediate role with the client.
+func (c *credentialsProvider) assumeChainLink(client stsiface.STSAPI, arn string) (chainLink, error) {
+	resp, err := assumeRole(client, &sts.AssumeRoleInput{
+		DurationSeconds: aws.Int64(maxChainedDurationSeconds),
+		RoleArn:         aws.String(arn),
+		RoleSessionName: aws.String(chainSessionName),
+	}, sessionTags{})
+	if err != nil {
+		return chainLink{}, errors.Wrapf(err, "Error assuming intermediate role [%s]", arn)
+	}
+
+	creds := credentials{
+		AccessKey:   *resp.Credentials.AccessKeyId,
+		SecretKey:   *resp.Credentials.SecretAccessKey,
+		Token:       *resp.Credentials.SessionToken,
+		Expiration:  *resp.Credentials.Expiration,
+		GeneratedAt: time.Now(),
+	}
+
+	return chainLink{
+		creds:  creds,
+		client: c.awsSts.(CredentialsSTSAPI).WithCredentials(creds.AccessKey, creds.SecretKey, creds.Token),
+	}, nil
+}
@@ -0,0 +1,86 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+const brokerRoleARN = "arn:aws:iam::210987654321:role/Broker"
+
+// chainedCall records an AssumeRole call and the access key that signed it.
+type chainedCall struct {
+	signer   string
+	roleARN  string
+	duration int64
+}
+
+// chainingSTSStub records AssumeRole calls of itself and of the clients it creates for
+// other credentials. The access key of issued credentials is the role ARN.
+type chainingSTSStub struct {
+	stsiface.STSAPI
+	signer string
+	calls  *[]chainedCall
+}
+
+func (s chainingSTSStub) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	*s.calls = append(*s.calls, chainedCall{
+		signer:   s.signer,
+		roleARN:  *input.RoleArn,
+		duration: aws.Int64Value(input.DurationSeconds),
+	})
+
+	output := defaultAssumeRoleOutput()
+	output.Credentials.AccessKeyId = input.RoleArn
+	return output, nil
+}
+
+func (s chainingSTSStub) WithCredentials(accessKeyID, secretAccessKey, sessionToken string) stsiface.STSAPI {
+	return chainingSTSStub{signer: accessKeyID, calls: s.calls}
+}
+
+func TestRoleChaining(t *testing.T) {
+	t.Run("should assume container role with shared intermediate credentials", func(t *testing.T) {
+		var calls []chainedCall
+
+		config := defaultConfig()
+		config.AliasOptions = map[string]proxy.AliasOptions{
+			"noperms": proxy.AliasOptions{Via: []string{brokerRoleARN}},
+			"db":      proxy.AliasOptions{Via: []string{brokerRoleARN}},
+		}
+		h := newTestHandler(t, config, chainingSTSStub{calls: &calls})
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil), 200)
+
+		if len(calls) != 3 {
+			t.Fatalf("expected 3 AssumeRole calls, got %+v", calls)
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"", calls[0].signer},
+			[2]string{brokerRoleARN, calls[0].roleARN},
+			[2]string{brokerRoleARN, calls[1].signer},
+			[2]string{config.AliasToARN["noperms"], calls[1].roleARN},
+			[2]string{brokerRoleARN, calls[2].signer},
+			[2]string{config.AliasToARN["db"], calls[2].roleARN},
+		})
+		for _, call := range calls {
+			if call.duration > 3600 {
+				t.Fatalf("expected chained duration of at most 3600, got %+v", call)
+			}
+		}
+	})
+
+	t.Run("should fail if STS client cannot chain", func(t *testing.T) {
+		config := defaultConfig()
+		config.AliasOptions = map[string]proxy.AliasOptions{
+			"noperms": proxy.AliasOptions{Via: []string{brokerRoleARN}},
+		}
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 500)
+	})
+}
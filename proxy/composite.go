@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CompositeContainerService consults several ContainerServices in order, ex. docker and then
+// static, so that hosts which run several kinds of workloads are served. The first service
+// that finds a container for an IP wins.
+//
+// It implements ContainerResolver, ContainerInventory, ContainerPinger, ContainerWatcher and
+// ConfigApplier by delegating to the services that implement them.
+type CompositeContainerService struct {
+	services []ContainerService
+}
+
+// NewCompositeContainerService creates a ContainerService that consults the services in order.
+func NewCompositeContainerService(services ...ContainerService) *CompositeContainerService {
+	return &CompositeContainerService{services: services}
+}
+
+// TypeName implements a ContainerService method. It joins the types of the services, ex.
+// "docker+static". ContainerInfo from the composite has the type of the service that found it.
+func (c *CompositeContainerService) TypeName() string {
+	names := make([]string, 0, len(c.services))
+	for _, svc := range c.services {
+		names = append(names, svc.TypeName())
+	}
+	return strings.Join(names, "+")
+}
+
+// ContainerForIP implements a ContainerService method.
+func (c *CompositeContainerService) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	var errs []string
+	for _, svc := range c.services {
+		info, err := svc.ContainerForIP(ctx, containerIP)
+		if err == nil {
+			if info.Platform == "" {
+				info.Platform = svc.TypeName()
+			}
+			return info, nil
+		}
+		errs = append(errs, svc.TypeName()+": "+err.Error())
+	}
+
+	return ContainerInfo{}, errors.Errorf("No container found for IP [%s]: %s", containerIP, strings.Join(errs, "; "))
+}
+
+// ContainerForID implements a ContainerResolver method, with the services that implement it.
+func (c *CompositeContainerService) ContainerForID(ctx context.Context, containerID string) (ContainerInfo, error) {
+	var errs []string
+	for _, svc := range c.services {
+		if resolver, ok := svc.(ContainerResolver); ok {
+			info, err := resolver.ContainerForID(ctx, containerID)
+			if err == nil {
+				if info.Platform == "" {
+					info.Platform = svc.TypeName()
+				}
+				return info, nil
+			}
+			errs = append(errs, svc.TypeName()+": "+err.Error())
+		}
+	}
+
+	return ContainerInfo{}, errors.Errorf("No container found for ID [%s]: %s", containerID, strings.Join(errs, "; "))
+}
+
+// Containers implements a ContainerInventory method.
+func (c *CompositeContainerService) Containers() []ContainerEntry {
+	var entries []ContainerEntry
+	for _, svc := range c.services {
+		if inventory, ok := svc.(ContainerInventory); ok {
+			for _, entry := range inventory.Containers() {
+				if entry.Platform == "" {
+					entry.Platform = svc.TypeName()
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// Resync implements a ContainerInventory method. Each service is resynced, because container
+// IDs do not identify the service.
+func (c *CompositeContainerService) Resync(ctx context.Context, containerID string) error {
+	for _, svc := range c.services {
+		if inventory, ok := svc.(ContainerInventory); ok {
+			if err := inventory.Resync(ctx, containerID); err != nil {
+				return errors.Wrapf(err, "Error resyncing [%s] containers", svc.TypeName())
+			}
+		}
+	}
+	return nil
+}
+
+// Ping implements a ContainerPinger method. It fails if any service's ping fails.
+func (c *CompositeContainerService) Ping(ctx context.Context) error {
+	for _, svc := range c.services {
+		if pinger, ok := svc.(ContainerPinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				return errors.Wrapf(err, "Error pinging [%s]", svc.TypeName())
+			}
+		}
+	}
+	return nil
+}
+
+// Watch implements a ContainerWatcher method. It runs the Watch of each service until the
+// context is canceled.
+func (c *CompositeContainerService) Watch(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, svc := range c.services {
+		if watcher, ok := svc.(ContainerWatcher); ok {
+			wg.Add(1)
+			go func(watcher ContainerWatcher) {
+				defer wg.Done()
+				watcher.Watch(ctx)
+			}(watcher)
+		}
+	}
+	wg.Wait()
+}
+
+// ApplyConfig implements a ConfigApplier method. All services are applied, and the first
+// error is returned.
+func (c *CompositeContainerService) ApplyConfig(config Config) error {
+	var firstErr error
+	for _, svc := range c.services {
+		if applier, ok := svc.(ConfigApplier); ok {
+			if err := applier.ApplyConfig(config); err != nil && firstErr == nil {
+				firstErr = errors.Wrapf(err, "Error applying config to [%s]", svc.TypeName())
+			}
+		}
+	}
+	return firstErr
+}
@@ -13,21 +13,78 @@ import (
 // Config describes the JSON config file selected via `-config` flag.
 type Config struct {
 	// AliasToARN maps human-friendly names to IAM ARNs.
+	//
+	// In the JSON file, a value may also be an AliasOptions object, whose ARN is stored here.
 	AliasToARN map[string]string `json:"aliasToARN"`
+	// AliasOptions holds the options of aliases whose AliasToARN value is an object.
+	AliasOptions map[string]AliasOptions `json:"-"`
 	// DefaultAlias is a AliasToARN key to select the default role for containers whose
 	// metadata does not specify one.
 	DefaultAlias string `json:"defaultAlias"`
 	// DefaultPolicy restricts the effective role's permissions to the intersection of
 	// the role's policy and this JSON policy.
 	DefaultPolicy string `json:"defaultPolicy"`
+	// Authorization restricts role aliases to matching containers. Aliases without a rule
+	// are unrestricted.
+	Authorization map[string]AuthorizationRule `json:"authorization"`
+	// DenyUnlabeled rejects credentials requests from containers whose metadata does not
+	// specify a role, instead of applying DefaultAlias/DefaultPolicy.
+	DenyUnlabeled bool `json:"denyUnlabeled"`
+	// ContainerRuntime selects the ContainerService: "docker" (default), "containerd", "kubernetes"
+	// or "static".
+	ContainerRuntime string `json:"containerRuntime"`
+	// ContainerRuntimes selects several ContainerServices, instead of ContainerRuntime, which are
+	// consulted in order, ex. ["docker", "static"].
+	ContainerRuntimes []string `json:"containerRuntimes"`
 	// DockerHost is a valid DOCKER_HOST string.
 	DockerHost string `json:"dockerHost"`
+	// Containerd selects the containerd instance, if ContainerRuntime is "containerd".
+	Containerd ContainerdConfig `json:"containerd"`
+	// Kubernetes selects the API server and node, if ContainerRuntime is "kubernetes".
+	Kubernetes KubernetesConfig `json:"kubernetes"`
+	// Static selects the workloads file, if a ContainerRuntime is "static".
+	Static StaticConfig `json:"static"`
+	// HostNetwork selects whether containers that share the host's network namespace are identified.
+	HostNetwork HostNetworkConfig `json:"hostNetwork"`
+	// HostUsers maps the users and groups of processes that run directly on the host to role aliases.
+	HostUsers HostUsersConfig `json:"hostUsers"`
+	// HTTPTokens selects whether IMDSv2 session tokens are "optional" (default) or "required".
+	// If optional, requests without a token are accepted, including credentials requests. If
+	// required, they are rejected like on an instance with HttpTokens=required.
+	HTTPTokens string `json:"httpTokens"`
 	// ListenAddr is a TCP network address.
 	ListenAddr string `json:"listen"`
-	// Verbose enables request/response logging to standard out.
+	// LogLevel selects the minimum level of logged lines: "debug", "info" (default), "warn" or "error".
+	LogLevel string `json:"logLevel"`
+	// LogFormat selects "text" (default, logfmt) or "json" log lines.
+	LogFormat string `json:"logFormat"`
+	// Audit selects where credentials vended to containers are recorded.
+	Audit AuditConfig `json:"audit"`
+	// MetadataURL is the base URL of the upstream metadata service, ex. of a local IMDS emulator.
+	// Defaults to the MetadataURL constant.
+	MetadataURL string `json:"metadataURL"`
+	// Upstream selects timeouts, the connection pool size and retries of upstream requests.
+	Upstream UpstreamConfig `json:"upstream"`
+	// AdminListenAddr is an optional TCP network address for operational endpoints, ex. metrics.
+	// It must not be reachable by containers.
+	AdminListenAddr string `json:"adminListen"`
+	// STSRegions selects the STS region used to assume roles in each partition, ex. "aws-us-gov".
+	// "aws-cn" and "aws-us-gov" default to "cn-north-1" and "us-gov-west-1", and "aws" defaults
+	// to the global endpoint.
+	STSRegions map[string]string `json:"stsRegions"`
+	// SessionTags maps container metadata to STS session tags.
+	SessionTags SessionTagsConfig `json:"sessionTags"`
+	// ShutdownGraceSeconds is how long in-flight requests are drained after SIGTERM/SIGINT.
+	// Defaults to 10.
+	ShutdownGraceSeconds int `json:"shutdownGraceSeconds"`
+	// Verbose selects the "debug" LogLevel, ex. request/response logging, if LogLevel is empty.
 	Verbose bool
+
+	filename string
 }
 
+const defaultShutdownGraceSeconds = 10
+
 // NewConfigFromFlag constructs a new Config from the JSON file obtained via `-config` CLI flag.
 // It also validates the unmarshaled Config fields.
 func NewConfigFromFlag() (c Config, err error) {
@@ -40,6 +97,11 @@ func NewConfigFromFlag() (c Config, err error) {
 		return c, errors.New("'-c <file>' flag is required")
 	}
 
+	return NewConfigFromFile(configFile)
+}
+
+// NewConfigFromFile constructs a new Config from a JSON file and validates its fields.
+func NewConfigFromFile(configFile string) (c Config, err error) {
 	configBytes, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return c, errors.Wrapf(err, "Error reading config file [%s]", configFile)
@@ -49,27 +111,203 @@ func NewConfigFromFlag() (c Config, err error) {
 		return c, errors.Wrapf(err, "Error parsing config file JSON [%s]", configFile)
 	}
 
+	c.filename = configFile
+
+	if err = c.validate(); err != nil {
+		return c, errors.Wrapf(err, "Error validating config file [%s]", configFile)
+	}
+
+	return c, nil
+}
+
+// UnmarshalJSON accepts both the ARN string and the AliasOptions object form of `aliasToARN` values.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plainConfig Config
+	var raw struct {
+		plainConfig
+		AliasToARN map[string]json.RawMessage `json:"aliasToARN"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	aliasToARN, aliasOptions, err := unmarshalAliasToARN(raw.AliasToARN)
+	if err != nil {
+		return err
+	}
+
+	*c = Config(raw.plainConfig)
+	c.AliasToARN = aliasToARN
+	c.AliasOptions = aliasOptions
+
+	return nil
+}
+
+// MarshalJSON writes `aliasToARN` values with options in the object form.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plainConfig Config
+	return json.Marshal(struct {
+		plainConfig
+		AliasToARN map[string]interface{} `json:"aliasToARN"`
+	}{
+		plainConfig: plainConfig(c),
+		AliasToARN:  marshalAliasToARN(c.AliasToARN, c.AliasOptions),
+	})
+}
+
+// Filename returns the path of the JSON file the Config was read from, if any.
+func (c Config) Filename() string {
+	return c.filename
+}
+
+// validate checks fields and selects defaults for omitted optional fields.
+func (c *Config) validate() error {
 	if c.ListenAddr == "" {
-		return c, errors.New("Config file must select a server address ('listen', ex. ':18000').")
+		return errors.New("Config file must select a server address ('listen', ex. ':18000').")
+	}
+	if c.AdminListenAddr != "" && c.AdminListenAddr == c.ListenAddr {
+		return errors.New("Config file must select different server and admin addresses ('listen' and 'adminListen').")
 	}
 	if len(c.AliasToARN) == 0 {
-		return c, errors.New("Config file must include at least one 'aliasToARN' mapping.")
+		return errors.New("Config file must include at least one 'aliasToARN' mapping.")
 	}
 	if c.AliasToARN[c.DefaultAlias] == "" {
-		return c, errors.Errorf("Config file selected an default alias [%s] not mapped in `aliasToARN'.", c.DefaultAlias)
+		return errors.Errorf("Config file selected an default alias [%s] not mapped in `aliasToARN'.", c.DefaultAlias)
+	}
+	for alias, arn := range c.AliasToARN {
+		role, err := NewRoleARN(arn)
+		if err != nil {
+			return errors.Wrapf(err, "Config file mapped alias [%s] to an invalid role ARN", alias)
+		}
+		if _, found := stsRegion(*c, role.Partition()); !found {
+			return errors.Errorf("Config file mapped alias [%s] to a role in partition [%s] without an 'stsRegions' entry.", alias, role.Partition())
+		}
 	}
 
-	prefix := "unix://"
-	if strings.HasPrefix(c.DockerHost, prefix) {
-		name := c.DockerHost[7:]
-		fi, statErr := os.Stat(name)
-		if statErr != nil {
-			return c, errors.Wrapf(statErr, "Error during stat of DOCKER_HOST socket [%s]", name)
+	for alias, options := range c.AliasOptions {
+		if _, found := c.AliasToARN[alias]; !found {
+			return errors.Errorf("Config file selected options of alias [%s] not mapped in 'aliasToARN'.", alias)
 		}
-		if fi.Mode()&os.ModeSocket == 0 {
-			return c, errors.Errorf("DOCKER_HOST [%s] is not a socket", name)
+		if err := options.validate(alias); err != nil {
+			return err
 		}
 	}
 
-	return c, nil
+	for alias, rule := range c.Authorization {
+		if _, found := c.AliasToARN[alias]; !found {
+			return errors.Errorf("Config file selected an authorization rule of alias [%s] not mapped in 'aliasToARN'.", alias)
+		}
+		if err := rule.validate(alias); err != nil {
+			return err
+		}
+	}
+
+	if err := c.SessionTags.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Audit.validate(); err != nil {
+		return err
+	}
+
+	if c.MetadataURL == "" {
+		c.MetadataURL = MetadataURL
+	}
+	if err := validateMetadataURL(c.MetadataURL); err != nil {
+		return err
+	}
+	if err := c.Upstream.validate(); err != nil {
+		return err
+	}
+
+	if c.ShutdownGraceSeconds < 0 {
+		return errors.Errorf("Config file selected a negative 'shutdownGraceSeconds' [%d].", c.ShutdownGraceSeconds)
+	}
+	if c.ShutdownGraceSeconds == 0 {
+		c.ShutdownGraceSeconds = defaultShutdownGraceSeconds
+	}
+
+	if c.LogLevel != "" {
+		if _, err := ParseLevel(c.LogLevel); err != nil {
+			return errors.Errorf("Config file selected an invalid 'logLevel' value [%s], expected one of %v.", c.LogLevel, levelNames)
+		}
+	}
+	switch c.LogFormat {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return errors.Errorf("Config file selected an invalid 'logFormat' value [%s], expected [%s] or [%s].", c.LogFormat, LogFormatText, LogFormatJSON)
+	}
+
+	switch c.HTTPTokens {
+	case "":
+		c.HTTPTokens = HTTPTokensOptional
+	case HTTPTokensOptional, HTTPTokensRequired:
+	default:
+		return errors.Errorf("Config file selected an invalid 'httpTokens' value [%s], expected [%s] or [%s].", c.HTTPTokens, HTTPTokensOptional, HTTPTokensRequired)
+	}
+
+	if c.ContainerRuntime != "" && len(c.ContainerRuntimes) > 0 {
+		return errors.New("Config file must select either 'containerRuntime' or 'containerRuntimes'.")
+	}
+	if c.ContainerRuntime == "" && len(c.ContainerRuntimes) == 0 {
+		c.ContainerRuntime = ContainerRuntimeDocker
+	}
+
+	if err := c.HostNetwork.validate(); err != nil {
+		return err
+	}
+	if err := c.HostUsers.validate(c.AliasToARN); err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool)
+	for _, runtime := range c.containerRuntimes() {
+		if selected[runtime] {
+			return errors.Errorf("Config file selected the container runtime [%s] more than once.", runtime)
+		}
+		selected[runtime] = true
+
+		if err := c.validateContainerRuntime(runtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// containerRuntimes returns the selected ContainerService types in order.
+func (c Config) containerRuntimes() []string {
+	if len(c.ContainerRuntimes) > 0 {
+		return c.ContainerRuntimes
+	}
+	return []string{c.ContainerRuntime}
+}
+
+// validateContainerRuntime checks the settings of the ContainerService type.
+func (c *Config) validateContainerRuntime(runtime string) error {
+	switch runtime {
+	case ContainerRuntimeDocker:
+		prefix := "unix://"
+		if strings.HasPrefix(c.DockerHost, prefix) {
+			name := c.DockerHost[7:]
+			fi, statErr := os.Stat(name)
+			if statErr != nil {
+				return errors.Wrapf(statErr, "Error during stat of DOCKER_HOST socket [%s]", name)
+			}
+			if fi.Mode()&os.ModeSocket == 0 {
+				return errors.Errorf("DOCKER_HOST [%s] is not a socket", name)
+			}
+		}
+	case ContainerRuntimeContainerd:
+		return c.Containerd.validate()
+	case ContainerRuntimeKubernetes:
+		return c.Kubernetes.validate()
+	case ContainerRuntimeStatic:
+		return c.Static.validate()
+	default:
+		return errors.Errorf("Config file selected an invalid container runtime [%s], expected one of %v.", runtime,
+			[]string{ContainerRuntimeDocker, ContainerRuntimeContainerd, ContainerRuntimeKubernetes, ContainerRuntimeStatic})
+	}
+	return nil
 }
@@ -0,0 +1,327 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+	"github.com/pkg/errors"
+)
+
+const reloadedRoleARN = "arn:aws:iam::123456789012:role/Reloaded"
+
+// writeConfigFile writes the Config as JSON to a new temporary file and returns its path.
+func writeConfigFile(t *testing.T, config proxy.Config) string {
+	f, err := ioutil.TempFile("", "ec2metaproxy-config")
+	fatalOnErr(t, err)
+	defer f.Close()
+
+	fatalOnErr(t, json.NewEncoder(f).Encode(config))
+	return f.Name()
+}
+
+func rewriteConfigFile(t *testing.T, name string, config proxy.Config) {
+	configBytes, err := json.Marshal(config)
+	fatalOnErr(t, err)
+	fatalOnErr(t, ioutil.WriteFile(name, configBytes, 0600))
+}
+
+func fileConfig() proxy.Config {
+	config := defaultConfig()
+	config.DockerHost = ""
+	return config
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Run("should replace default role and evict cached credentials", func(t *testing.T) {
+		name := writeConfigFile(t, fileConfig())
+		defer os.Remove(name)
+
+		config, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+
+		stsSvc := defaultStsSvcStub()
+		p, err := proxy.New(config, roundTripperStub{res: &http.Response{Body: ioutil.NopCloser(strings.NewReader("")), StatusCode: 200}}, stsSvc, defaultContainerSvcStub(), nil)
+		fatalOnErr(t, err)
+		h := proxy.RequestID(p)
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/", ipWithNoLabels, nil), 200)
+		assumeRoleAliasIs(t, "noperms", config, stsSvc)
+
+		next := fileConfig()
+		next.AliasToARN["noperms"] = reloadedRoleARN
+		rewriteConfigFile(t, name, next)
+
+		_, err = proxy.ReloadConfig(config, newLogger().logger, p)
+		fatalOnErr(t, err)
+
+		res := serveRequest(h, "GET", defaultPathReqBase+"/", ipWithNoLabels, nil)
+		responseCodeIs(t, res, 200)
+		stringsEqual(t, [][2]string{
+			[2]string{reloadedRoleARN, *stsSvc.input.RoleArn},
+			[2]string{"Reloaded", bodyIsNonEmpty(t, res.Body)},
+		})
+	})
+
+	t.Run("should reject invalid config", func(t *testing.T) {
+		name := writeConfigFile(t, fileConfig())
+		defer os.Remove(name)
+
+		config, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+
+		stsSvc := defaultStsSvcStub()
+		p, err := proxy.New(config, roundTripperStub{res: &http.Response{Body: ioutil.NopCloser(strings.NewReader("")), StatusCode: 200}}, stsSvc, defaultContainerSvcStub(), nil)
+		fatalOnErr(t, err)
+		h := proxy.RequestID(p)
+
+		next := fileConfig()
+		next.AliasToARN["noperms"] = "invalid"
+		rewriteConfigFile(t, name, next)
+
+		current, err := proxy.ReloadConfig(config, newLogger().logger, p)
+		if err == nil {
+			t.Fatal("expected error for invalid role ARN")
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{config.AliasToARN["noperms"], current.AliasToARN["noperms"]},
+		})
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, ipWithNoLabels, nil), 200)
+		assumeRoleAliasIs(t, "noperms", config, stsSvc)
+	})
+
+	t.Run("should restore current config if an applier fails", func(t *testing.T) {
+		name := writeConfigFile(t, fileConfig())
+		defer os.Remove(name)
+
+		config, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+
+		next := fileConfig()
+		next.DefaultAlias = "db"
+		rewriteConfigFile(t, name, next)
+
+		first, failed, last := &configApplierStub{}, &configApplierStub{err: errors.New("resync failed")}, &configApplierStub{}
+		current, err := proxy.ReloadConfig(config, newLogger().logger, first, failed, last)
+		if err == nil {
+			t.Fatal("expected error from applier")
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{config.DefaultAlias, current.DefaultAlias},
+			[2]string{"db," + config.DefaultAlias, strings.Join(first.applied, ",")},
+			[2]string{"db," + config.DefaultAlias, strings.Join(failed.applied, ",")},
+			[2]string{"", strings.Join(last.applied, ",")},
+		})
+	})
+}
+
+// configApplierStub records the default alias of each applied Config, and fails if err is set.
+type configApplierStub struct {
+	applied []string
+	err     error
+}
+
+func (c *configApplierStub) ApplyConfig(config proxy.Config) error {
+	c.applied = append(c.applied, config.DefaultAlias)
+	if config.DefaultAlias == "db" {
+		return c.err
+	}
+	return nil
+}
+
+func TestConfigPartitions(t *testing.T) {
+	t.Run("should require region of non-default partition", func(t *testing.T) {
+		config := fileConfig()
+		config.AliasToARN["iso"] = "arn:aws-iso:iam::123456789012:role/Isolated"
+		name := writeConfigFile(t, config)
+		defer os.Remove(name)
+
+		if _, err := proxy.NewConfigFromFile(name); err == nil {
+			t.Fatal("expected error")
+		}
+
+		config.STSRegions = map[string]string{"aws-iso": "us-iso-east-1"}
+		rewriteConfigFile(t, name, config)
+
+		_, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+	})
+}
+
+func TestConfigSessionTags(t *testing.T) {
+	t.Run("should reject invalid tag source", func(t *testing.T) {
+		config := fileConfig()
+		config.SessionTags.Tags = map[string]string{"Team": "env:TEAM"}
+		name := writeConfigFile(t, config)
+		defer os.Remove(name)
+
+		if _, err := proxy.NewConfigFromFile(name); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("should reject transitive key without tag", func(t *testing.T) {
+		config := fileConfig()
+		config.SessionTags.Tags = map[string]string{"Team": "label:team"}
+		config.SessionTags.TransitiveTagKeys = []string{"Project"}
+		name := writeConfigFile(t, config)
+		defer os.Remove(name)
+
+		if _, err := proxy.NewConfigFromFile(name); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestConfigAliasOptions(t *testing.T) {
+	t.Run("should keep options when written and read", func(t *testing.T) {
+		config := fileConfig()
+		config.AliasOptions = map[string]proxy.AliasOptions{
+			"db": proxy.AliasOptions{ExternalID: "vendor-external-id"},
+		}
+		name := writeConfigFile(t, config)
+		defer os.Remove(name)
+
+		read, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{config.AliasToARN["db"], read.AliasToARN["db"]},
+			[2]string{"vendor-external-id", read.AliasOptions["db"].ExternalID},
+		})
+	})
+
+	t.Run("should reject invalid options", func(t *testing.T) {
+		for _, options := range []proxy.AliasOptions{
+			proxy.AliasOptions{DurationSeconds: 60},
+			proxy.AliasOptions{ExternalID: "invalid external id"},
+			proxy.AliasOptions{SessionNameTemplate: "{{.Name"},
+			proxy.AliasOptions{Via: []string{"arn:aws:iam::210987654321:role/Broker"}, DurationSeconds: 7200},
+			proxy.AliasOptions{Via: []string{"invalid"}},
+		} {
+			config := fileConfig()
+			config.AliasOptions = map[string]proxy.AliasOptions{"db": options}
+			name := writeConfigFile(t, config)
+			defer os.Remove(name)
+
+			if _, err := proxy.NewConfigFromFile(name); err == nil {
+				t.Fatalf("expected error for options %+v", options)
+			}
+		}
+	})
+}
+
+func TestConfigAuthorization(t *testing.T) {
+	for _, rules := range []map[string]proxy.AuthorizationRule{
+		{"db": proxy.AuthorizationRule{Images: []string{"example/[db"}}},
+		{"db": proxy.AuthorizationRule{NamePattern: "(billing"}},
+		{"unmapped": proxy.AuthorizationRule{NamePattern: "^billing-"}},
+	} {
+		config := fileConfig()
+		config.Authorization = rules
+		name := writeConfigFile(t, config)
+		defer os.Remove(name)
+
+		if _, err := proxy.NewConfigFromFile(name); err == nil {
+			t.Fatalf("expected error for rules %+v", rules)
+		}
+	}
+}
+
+func TestConfigUpstream(t *testing.T) {
+	t.Run("should select upstream defaults", func(t *testing.T) {
+		name := writeConfigFile(t, fileConfig())
+		defer os.Remove(name)
+
+		config, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+		if config.MetadataURL != proxy.MetadataURL || config.Upstream.MaxAttempts != 3 || config.Upstream.DialTimeoutMillis != 1000 {
+			t.Fatalf("expected upstream defaults, got [%s] [%+v]", config.MetadataURL, config.Upstream)
+		}
+	})
+
+	t.Run("should reject invalid upstream settings", func(t *testing.T) {
+		for _, mutate := range []func(*proxy.Config){
+			func(c *proxy.Config) { c.MetadataURL = "169.254.169.254" },
+			func(c *proxy.Config) { c.MetadataURL = "http://localhost:1338/latest" },
+			func(c *proxy.Config) { c.Upstream.ResponseTimeoutMillis = -1 },
+		} {
+			config := fileConfig()
+			mutate(&config)
+			name := writeConfigFile(t, config)
+			defer os.Remove(name)
+
+			if _, err := proxy.NewConfigFromFile(name); err == nil {
+				t.Fatalf("expected error for [%s] [%+v]", config.MetadataURL, config.Upstream)
+			}
+		}
+	})
+}
+
+func TestConfigContainerRuntime(t *testing.T) {
+	t.Run("should select containerd defaults", func(t *testing.T) {
+		containerd := newContainerdStub(t)
+		defer containerd.Close()
+
+		config := fileConfig()
+		config.ContainerRuntime = proxy.ContainerRuntimeContainerd
+		config.DockerHost = "unix:///nonexistent/docker.sock"
+		config.Containerd = proxy.ContainerdConfig{Address: filepath.Join(containerd.dir, "containerd.sock"), CtrPath: filepath.Join(containerd.dir, "ctr")}
+		name := writeConfigFile(t, config)
+		defer os.Remove(name)
+
+		config, err := proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{"default", config.Containerd.Namespace},
+			[2]string{"/var/lib/cni/networks", config.Containerd.CNINetworksDir},
+			[2]string{"5", strconv.Itoa(config.Containerd.SyncSeconds)},
+		})
+
+		// The ctr binary and the containerd socket are only checked when the service is created,
+		// not on each config reload.
+		config.Containerd = proxy.ContainerdConfig{Address: "/nonexistent/containerd.sock", CtrPath: "/nonexistent/ctr"}
+		rewriteConfigFile(t, name, config)
+		_, err = proxy.NewConfigFromFile(name)
+		fatalOnErr(t, err)
+	})
+
+	t.Run("should reject unknown runtime or invalid settings", func(t *testing.T) {
+		for _, mutate := range []func(*proxy.Config){
+			func(c *proxy.Config) { c.ContainerRuntime = "rkt" },
+			func(c *proxy.Config) {
+				c.ContainerRuntime = proxy.ContainerRuntimeKubernetes
+				c.Kubernetes = proxy.KubernetesConfig{APIServer: "kubernetes.default.svc", NodeName: "node-1"}
+			},
+			func(c *proxy.Config) { c.ContainerRuntimes = []string{proxy.ContainerRuntimeStatic} },
+			func(c *proxy.Config) {
+				c.ContainerRuntime = proxy.ContainerRuntimeDocker
+				c.ContainerRuntimes = []string{proxy.ContainerRuntimeDocker}
+			},
+			func(c *proxy.Config) {
+				c.ContainerRuntimes = []string{proxy.ContainerRuntimeDocker, proxy.ContainerRuntimeDocker}
+			},
+			func(c *proxy.Config) {
+				c.HostNetwork = proxy.HostNetworkConfig{Enabled: true, HostIPs: []string{"10.0.0.500"}}
+			},
+			func(c *proxy.Config) {
+				c.HostUsers = proxy.HostUsersConfig{Groups: map[string]string{"cron": "unmapped"}}
+			},
+		} {
+			config := fileConfig()
+			mutate(&config)
+			name := writeConfigFile(t, config)
+			defer os.Remove(name)
+
+			if _, err := proxy.NewConfigFromFile(name); err == nil {
+				t.Fatalf("expected error for [%s] %v", config.ContainerRuntime, config.ContainerRuntimes)
+			}
+		}
+	})
+}
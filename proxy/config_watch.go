@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// configPollInterval is the delay between checks for config file changes.
+var configPollInterval = 5 * time.Second
+
+// ConfigApplier implementations accept a replacement Config, ex. Proxy and DockerContainerService.
+type ConfigApplier interface {
+	ApplyConfig(Config) error
+}
+
+// NotifyReload relays SIGHUP to the returned channel, for WatchConfig. It is called before
+// WatchConfig is started, so that a SIGHUP received in between does not terminate the process.
+func NotifyReload() <-chan os.Signal {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	return hup
+}
+
+// WatchConfig reloads the config file on each signal from hup, ex. from NotifyReload, or when
+// its modification time or size changes, until the context is canceled. Each reloaded Config
+// is passed to the appliers in order.
+//
+// A config file which cannot be read, fails validation or is rejected by an applier is logged
+// and ignored, and the current Config stays in effect.
+func WatchConfig(ctx context.Context, config Config, logger *Logger, hup <-chan os.Signal, appliers ...ConfigApplier) {
+	filename := config.Filename()
+	if filename == "" {
+		logger.Warn("WatchConfig: config was not read from a file, reloading is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastInfo, _ := os.Stat(filename)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			// The reload covers any change made so far, which the ticker need not reload again.
+			lastInfo, _ = os.Stat(filename)
+			logger.Info("WatchConfig: received SIGHUP, reloading", "file", filename)
+		case <-ticker.C:
+			info, err := os.Stat(filename)
+			if err != nil || (lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) && info.Size() == lastInfo.Size()) {
+				continue
+			}
+			lastInfo = info
+			logger.Info("WatchConfig: config file changed, reloading", "file", filename)
+		}
+
+		next, err := ReloadConfig(config, logger, appliers...)
+		if err != nil {
+			logger.Error("WatchConfig: Rejected config file, keeping current config", "file", filename, logKeyError, err)
+			continue
+		}
+		config = next
+	}
+}
+
+// ReloadConfig reads and validates the file the current Config was read from, then passes
+// the result to the appliers in order. If an applier fails, the current Config is passed again
+// to it and the appliers before it. On error, the current Config is returned and should stay
+// in effect.
+//
+// Listen addresses, the container runtimes and their settings, host network identification,
+// the audit log, upstream transport settings and STS regions cannot change without a restart.
+// Their current values are retained and a warning is logged. Likewise, host user mappings can
+// change but cannot be added or removed entirely.
+func ReloadConfig(current Config, logger *Logger, appliers ...ConfigApplier) (Config, error) {
+	next, err := NewConfigFromFile(current.Filename())
+	if err != nil {
+		return current, err
+	}
+
+	if next.ListenAddr != current.ListenAddr || next.AdminListenAddr != current.AdminListenAddr || next.DockerHost != current.DockerHost {
+		logger.Warn("ReloadConfig: 'listen', 'adminListen' and 'dockerHost' changes require a restart and were ignored")
+		next.ListenAddr = current.ListenAddr
+		next.AdminListenAddr = current.AdminListenAddr
+		next.DockerHost = current.DockerHost
+	}
+
+	if next.ContainerRuntime != current.ContainerRuntime || !reflect.DeepEqual(next.ContainerRuntimes, current.ContainerRuntimes) ||
+		next.Containerd != current.Containerd || next.Kubernetes != current.Kubernetes || next.Static != current.Static {
+		logger.Warn("ReloadConfig: 'containerRuntime(s)', 'containerd', 'kubernetes' and 'static' changes require a restart and were ignored")
+		next.ContainerRuntime = current.ContainerRuntime
+		next.ContainerRuntimes = current.ContainerRuntimes
+		next.Containerd = current.Containerd
+		next.Kubernetes = current.Kubernetes
+		next.Static = current.Static
+	}
+
+	if !reflect.DeepEqual(next.HostNetwork, current.HostNetwork) {
+		logger.Warn("ReloadConfig: 'hostNetwork' changes require a restart and were ignored")
+		next.HostNetwork = current.HostNetwork
+	}
+
+	if next.HostUsers.enabled() != current.HostUsers.enabled() {
+		logger.Warn("ReloadConfig: 'hostUsers' changes between empty and non-empty mappings require a restart and were ignored")
+		next.HostUsers = current.HostUsers
+
+		// The current mappings may select aliases removed from the new config.
+		if err := next.validate(); err != nil {
+			return current, errors.Wrapf(err, "Error validating config file [%s] with current 'hostUsers'", current.Filename())
+		}
+	}
+
+	if next.Audit != current.Audit {
+		logger.Warn("ReloadConfig: 'audit' changes require a restart and were ignored")
+		next.Audit = current.Audit
+	}
+
+	if next.Upstream.DialTimeoutMillis != current.Upstream.DialTimeoutMillis ||
+		next.Upstream.ResponseTimeoutMillis != current.Upstream.ResponseTimeoutMillis ||
+		next.Upstream.MaxIdleConns != current.Upstream.MaxIdleConns {
+		logger.Warn("ReloadConfig: 'upstream' timeout and connection pool changes require a restart and were ignored")
+		next.Upstream.DialTimeoutMillis = current.Upstream.DialTimeoutMillis
+		next.Upstream.ResponseTimeoutMillis = current.Upstream.ResponseTimeoutMillis
+		next.Upstream.MaxIdleConns = current.Upstream.MaxIdleConns
+	}
+
+	if !reflect.DeepEqual(next.STSRegions, current.STSRegions) {
+		logger.Warn("ReloadConfig: 'stsRegions' changes require a restart and were ignored")
+		next.STSRegions = current.STSRegions
+
+		// Roles in the new config may depend on the ignored regions.
+		if err := next.validate(); err != nil {
+			return current, errors.Wrapf(err, "Error validating config file [%s] with current 'stsRegions'", current.Filename())
+		}
+	}
+
+	for i, applier := range appliers {
+		if err := applier.ApplyConfig(next); err != nil {
+			// Appliers may fail after a partial update, ex. a docker resync after replacing
+			// the alias-to-ARN mapping, so the failed one is rolled back too.
+			for _, applied := range appliers[:i+1] {
+				if rollbackErr := applied.ApplyConfig(current); rollbackErr != nil {
+					logger.Error("ReloadConfig: Error restoring current config", logKeyError, rollbackErr)
+				}
+			}
+			return current, errors.Wrapf(err, "Error applying config file [%s]", current.Filename())
+		}
+	}
+
+	logger.Info("ReloadConfig: applied config file", "file", current.Filename())
+
+	return next, nil
+}
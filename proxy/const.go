@@ -1,7 +1,7 @@
 package proxy
 
 const (
-	// MetadataURL is used if the JSON config file does not override it.
+	// MetadataURL is used if the JSON config file does not override it with 'metadataURL'.
 	MetadataURL = "http://169.254.169.254"
 	// RoleLabelKey identifies the docker metadata string that holds a role alias.
 	// The alias corresponds to the alias-to-ARN mapping in the JSON config file.
@@ -9,4 +9,19 @@ const (
 	// PolicyLabelKey identifies the docker metadata string that holds a JSON IAM
 	// policy used in the AssumeRole operation.
 	PolicyLabelKey = "ec2metaproxy.Policy"
+	// AuthorizationTokenLabelKey identifies the docker metadata string that holds the token
+	// which ECS container credentials requests must present in the Authorization header.
+	AuthorizationTokenLabelKey = "ec2metaproxy.AuthorizationToken"
+	// HTTPTokensOptional accepts both IMDSv1 requests and IMDSv2 requests with a valid token.
+	HTTPTokensOptional = "optional"
+	// HTTPTokensRequired rejects IMDSv1 requests, i.e. those without a session token.
+	HTTPTokensRequired = "required"
+	// ContainerRuntimeDocker selects DockerContainerService.
+	ContainerRuntimeDocker = "docker"
+	// ContainerRuntimeContainerd selects ContainerdContainerService.
+	ContainerRuntimeContainerd = "containerd"
+	// ContainerRuntimeKubernetes selects KubernetesContainerService.
+	ContainerRuntimeKubernetes = "kubernetes"
+	// ContainerRuntimeStatic selects StaticContainerService.
+	ContainerRuntimeStatic = "static"
 )
@@ -1,13 +1,33 @@
 package proxy
 
-import "context"
+import (
+	"context"
+	"strings"
+	"time"
+)
 
 // ContainerInfo can identify a specific container and its IAM role/policy.
 type ContainerInfo struct {
 	ID        string
 	Name      string
+	Image     string
+	Labels    map[string]string
+	RoleAlias string
 	IamRole   RoleARN
 	IamPolicy string
+	// ImageDigests holds the image ID and repo digests, ex. "sha256:..." and
+	// "registry.example.com/team/db@sha256:...", if the ContainerService resolves them.
+	ImageDigests []string
+	// AuthorizationToken, if not empty, must be presented by ECS container credentials requests.
+	AuthorizationToken string
+	// AllowedAliases, if not nil, restricts the effective role alias, ex. to the aliases
+	// permitted in a Kubernetes namespace.
+	AllowedAliases []string
+	// Platform is the type of the ContainerService that found the container, ex. "static", if it
+	// differs from the TypeName of the service given to the proxy, ex. a CompositeContainerService.
+	Platform string
+	// HostNetwork is true if the container shares the host's network namespace, and so its IP.
+	HostNetwork bool
 }
 
 // ContainerService implementations provide ContainerInfo.
@@ -15,3 +35,133 @@ type ContainerService interface {
 	ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error)
 	TypeName() string
 }
+
+// ContainerEntry is an entry of a ContainerService's IP mapping.
+type ContainerEntry struct {
+	ContainerInfo
+	IP string
+	// RefreshTime is when the entry is next checked against the container platform, if it is
+	// not kept current by events.
+	RefreshTime time.Time
+}
+
+// ContainerInventory is implemented by ContainerServices whose IP mapping can be listed
+// and resynced, ex. by the admin API.
+type ContainerInventory interface {
+	Containers() []ContainerEntry
+	// Resync replaces the container's mapping entries with ones based on its current state,
+	// or the whole mapping if the ID is empty.
+	Resync(ctx context.Context, containerID string) error
+}
+
+// ContainerPinger is implemented by ContainerServices that can check whether the container
+// platform is reachable, ex. for readiness checks.
+type ContainerPinger interface {
+	Ping(ctx context.Context) error
+}
+
+// ContainerResolver is implemented by ContainerServices that can find a container by ID, ex.
+// one that shares the host's network namespace and so has no IP of its own.
+type ContainerResolver interface {
+	ContainerForID(ctx context.Context, containerID string) (ContainerInfo, error)
+}
+
+// ContainerWatcher is implemented by ContainerServices that keep their IP mapping current
+// from the container platform's events until the context is canceled.
+type ContainerWatcher interface {
+	Watch(ctx context.Context)
+}
+
+// NewContainerService creates the ContainerService selected by the config's ContainerRuntime,
+// or a CompositeContainerService of those selected by its ContainerRuntimes. If HostNetwork is
+// enabled or HostUsers are mapped, it is wrapped by a HostNetworkContainerService.
+func NewContainerService(config Config, logger *Logger) (ContainerService, error) {
+	var services []ContainerService
+	for _, runtime := range config.containerRuntimes() {
+		svc, err := newContainerService(runtime, config, logger)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+
+	svc := services[0]
+	if len(services) > 1 {
+		svc = NewCompositeContainerService(services...)
+	}
+
+	if config.HostNetwork.Enabled || config.HostUsers.enabled() {
+		return NewHostNetworkContainerService(config, svc, logger)
+	}
+	return svc, nil
+}
+
+func newContainerService(runtime string, config Config, logger *Logger) (ContainerService, error) {
+	switch runtime {
+	case ContainerRuntimeContainerd:
+		containerd, err := NewContainerdContainerService(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return containerd, nil
+	case ContainerRuntimeKubernetes:
+		kubernetes, err := NewKubernetesContainerService(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return kubernetes, nil
+	case ContainerRuntimeStatic:
+		static, err := NewStaticContainerService(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return static, nil
+	}
+
+	docker, err := NewDockerContainerService(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	return docker, nil
+}
+
+// newContainerInfo resolves the role/policy selected in container labels. It returns false
+// if the container should not be indexed.
+//
+// Containers without a role label are indexed with an empty IamRole so that the default
+// role/policy can apply (or access can be denied, if configured) by the credentials provider.
+func newContainerInfo(log *Logger, aliasToARN map[string]string, id string, names []string, image string, labels map[string]string) (ContainerInfo, bool) {
+	alias, ok := labels[RoleLabelKey]
+	if !ok {
+		return ContainerInfo{
+			ID:                 id,
+			Name:               strings.Join(names, ","),
+			Image:              image,
+			Labels:             labels,
+			IamPolicy:          labels[PolicyLabelKey],
+			AuthorizationToken: labels[AuthorizationTokenLabelKey],
+		}, true
+	}
+
+	roleName, ok := aliasToARN[alias]
+	if !ok {
+		log.Warn("newContainerInfo: container has an unmapped role alias", logKeyContainerID, id, "names", names, "role_alias", alias)
+		return ContainerInfo{}, false
+	}
+	role, roleErr := NewRoleARN(roleName)
+	if roleErr != nil {
+		log.Error("newContainerInfo: Error creating new role ARN with invalid name", logKeyRoleARN, roleName, logKeyError, roleErr)
+		return ContainerInfo{}, false
+	}
+
+	return ContainerInfo{
+		ID:                 id,
+		Name:               strings.Join(names, ","),
+		Image:              image,
+		Labels:             labels,
+		RoleAlias:          alias,
+		IamRole:            role,
+		IamPolicy:          labels[PolicyLabelKey],
+		AuthorizationToken: labels[AuthorizationTokenLabelKey],
+	}, true
+}
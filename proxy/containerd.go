@@ -0,0 +1,466 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	defaultContainerdNS      = "default"
+	defaultCNINetworksDir    = "/var/lib/cni/networks"
+	defaultCtrPath           = "ctr"
+	defaultContainerdSync    = 5
+
+	// containerdRunningStatus is the `ctr tasks ls` status of running tasks.
+	containerdRunningStatus = "RUNNING"
+	// nerdctlNameLabelKey holds the name of containers created by nerdctl.
+	nerdctlNameLabelKey = "nerdctl/name"
+)
+
+// ContainerdConfig selects the containerd instance of a ContainerdContainerService.
+type ContainerdConfig struct {
+	// Address is the containerd socket. Defaults to "/run/containerd/containerd.sock".
+	Address string `json:"address"`
+	// Namespace holds the containers, ex. "k8s.io". Defaults to "default", which nerdctl uses.
+	Namespace string `json:"namespace"`
+	// CNINetworksDir holds the address reservations of the CNI host-local IPAM plugin, one
+	// directory per network. Defaults to "/var/lib/cni/networks". Only networks that use this
+	// plugin are supported.
+	CNINetworksDir string `json:"cniNetworksDir"`
+	// CtrPath is the path of the `ctr` binary. Defaults to "ctr" in PATH.
+	CtrPath string `json:"ctrPath"`
+	// SyncSeconds is the interval at which Watch resyncs the mapping. Defaults to 5.
+	SyncSeconds int `json:"syncSeconds"`
+}
+
+func (c *ContainerdConfig) validate() error {
+	if c.Address == "" {
+		c.Address = defaultContainerdAddress
+	}
+	if c.Namespace == "" {
+		c.Namespace = defaultContainerdNS
+	}
+	if c.CNINetworksDir == "" {
+		c.CNINetworksDir = defaultCNINetworksDir
+	}
+	if c.CtrPath == "" {
+		c.CtrPath = defaultCtrPath
+	}
+	if c.SyncSeconds <= 0 {
+		c.SyncSeconds = defaultContainerdSync
+	}
+	return nil
+}
+
+// check verifies that the ctr binary and the containerd socket exist. It runs when the service
+// is created rather than on each config reload, because the settings require a restart.
+func (c ContainerdConfig) check() error {
+	if _, err := exec.LookPath(c.CtrPath); err != nil {
+		return errors.Wrapf(err, "Error finding ctr binary [%s]", c.CtrPath)
+	}
+	fi, err := os.Stat(c.Address)
+	if err != nil {
+		return errors.Wrapf(err, "Error during stat of containerd socket [%s]", c.Address)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("containerd address [%s] is not a socket", c.Address)
+	}
+	return nil
+}
+
+type containerdContainerInfo struct {
+	ContainerInfo
+	RefreshTime time.Time
+}
+
+// containerdContainer holds the `ctr containers info` fields used by ContainerdContainerService.
+type containerdContainer struct {
+	ID     string            `json:"ID"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// ContainerdContainerService queries containerd and maintains a mapping of IPs to container
+// details, like DockerContainerService does without an event stream.
+//
+// containerd does not record the IPs of tasks, so they are read from the reservations of the
+// CNI host-local IPAM plugin, which are named by IP and contain the container ID. Containers are
+// queried with the `ctr` CLI. Containers on networks with other IPAM plugins, ex. dhcp, or
+// those of Calico, Cilium or the Amazon VPC CNI, leave no reservations and are not found.
+//
+// While Watch runs, the mapping is resynced on a timer and lookups are served from it without
+// running `ctr`, except for unknown IPs, which resync the mapping at most once per second.
+type ContainerdContainerService struct {
+	containerIPMap map[string]containerdContainerInfo
+	aliasToARN     map[string]string
+	config         ContainerdConfig
+	log            *Logger
+	watching       bool
+	syncTime       time.Time
+	lock           sync.RWMutex
+
+	// containers caches the `ctr containers info` of running containers by ID.
+	containers map[string]containerdContainer
+	// syncLock serializes syncContainers, so that an older listing cannot replace a newer one.
+	syncLock sync.Mutex
+}
+
+// NewContainerdContainerService creates a containerd specific ContainerService implementation.
+func NewContainerdContainerService(config Config, logger *Logger) (*ContainerdContainerService, error) {
+	containerdConfig := config.Containerd
+	if err := containerdConfig.validate(); err != nil {
+		return nil, err
+	}
+	if err := containerdConfig.check(); err != nil {
+		return nil, err
+	}
+
+	logger.Info("NewContainerdContainerService: using containerd", "address", containerdConfig.Address, "namespace", containerdConfig.Namespace)
+
+	return &ContainerdContainerService{
+		containerIPMap: make(map[string]containerdContainerInfo),
+		containers:     make(map[string]containerdContainer),
+		aliasToARN:     config.AliasToARN,
+		config:         containerdConfig,
+		log:            logger,
+	}, nil
+}
+
+// TypeName implements a ContainerService method.
+func (c *ContainerdContainerService) TypeName() string {
+	return ContainerRuntimeContainerd
+}
+
+// ApplyConfig replaces the alias-to-ARN mapping, ex. after the config file changes, and
+// resyncs all containers so their roles reflect it.
+func (c *ContainerdContainerService) ApplyConfig(config Config) error {
+	c.lock.Lock()
+	c.aliasToARN = config.AliasToARN
+	c.lock.Unlock()
+
+	return c.syncContainers(context.Background(), time.Now())
+}
+
+// ContainerForIP implements a ContainerService method.
+//
+// If ContainerInfo exists in the cache, keyed by the container IP, then it is returned. Unless
+// Watch keeps the cache current, it is first checked against containerd if its refresh time
+// passed. Otherwise the mapping is resynced from containerd and the CNI reservations, unless
+// that was done within the last second.
+func (c *ContainerdContainerService) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	c.lock.RLock()
+	info, found := c.containerIPMap[containerIP]
+	watching := c.watching
+	syncTime := c.syncTime
+	c.lock.RUnlock()
+
+	now := time.Now()
+
+	if !found {
+		if now.After(refreshTime(syncTime)) {
+			if err := c.syncContainers(ctx, now); err == nil {
+				c.lock.RLock()
+				info, found = c.containerIPMap[containerIP]
+				c.lock.RUnlock()
+			}
+		}
+	} else if !watching && now.After(info.RefreshTime) {
+		info, found = c.syncContainer(ctx, containerIP, info, now)
+	}
+
+	if !found {
+		return ContainerInfo{}, errors.Errorf("No container found for IP [%s]", containerIP)
+	}
+
+	return info.ContainerInfo, nil
+}
+
+// Containers implements a ContainerInventory method.
+func (c *ContainerdContainerService) Containers() []ContainerEntry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	entries := make([]ContainerEntry, 0, len(c.containerIPMap))
+	for ip, info := range c.containerIPMap {
+		entries = append(entries, ContainerEntry{ContainerInfo: info.ContainerInfo, IP: ip, RefreshTime: info.RefreshTime})
+	}
+	return entries
+}
+
+// Resync implements a ContainerInventory method. The whole mapping is resynced, because
+// a container's IPs can only be found by reading all CNI reservations, and the container, or all
+// containers if the ID is empty, are inspected again.
+func (c *ContainerdContainerService) Resync(ctx context.Context, containerID string) error {
+	c.syncLock.Lock()
+	if containerID == "" {
+		c.containers = make(map[string]containerdContainer)
+	} else {
+		delete(c.containers, containerID)
+	}
+	c.syncLock.Unlock()
+
+	return c.syncContainers(ctx, time.Now())
+}
+
+// Watch implements a ContainerWatcher method. containerd's event stream is not consumed, so the
+// mapping is resynced every SyncSeconds instead until the context is canceled. If a resync
+// fails, lookups check cached entries against containerd until one succeeds.
+func (c *ContainerdContainerService) Watch(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(c.config.SyncSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		err := c.syncContainers(ctx, time.Now())
+		c.setWatching(err == nil)
+
+		select {
+		case <-ctx.Done():
+			c.setWatching(false)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *ContainerdContainerService) setWatching(watching bool) {
+	c.lock.Lock()
+	c.watching = watching
+	c.lock.Unlock()
+}
+
+// Ping implements a ContainerPinger method.
+func (c *ContainerdContainerService) Ping(ctx context.Context) error {
+	_, err := c.ctr(ctx, "version", "version")
+	return errors.Wrap(err, "Error pinging containerd")
+}
+
+// syncContainer extends the refresh time of the entry if its task is still running and
+// still holds the IP. Otherwise the mapping is resynced.
+func (c *ContainerdContainerService) syncContainer(ctx context.Context, containerIP string, oldInfo containerdContainerInfo, now time.Time) (containerdContainerInfo, bool) {
+	log := loggerFromContext(ctx, c.log)
+
+	running, err := c.runningTasks(ctx)
+	if err == nil {
+		var ipToID map[string]string
+		ipToID, err = c.cniReservations()
+		if err == nil && running[oldInfo.ID] && ipToID[containerIP] == oldInfo.ID {
+			oldInfo.RefreshTime = refreshTime(now)
+
+			c.lock.Lock()
+			c.containerIPMap[containerIP] = oldInfo
+			c.lock.Unlock()
+
+			return oldInfo, true
+		}
+	}
+
+	if err != nil {
+		log.Warn("syncContainer: Error checking container, refreshing container info", logKeyContainerID, oldInfo.ID, logKeyError, err)
+	} else {
+		log.Info("syncContainer: container stopped or moved, refreshing container info", logKeyContainerID, oldInfo.ID)
+	}
+
+	if syncErr := c.syncContainers(ctx, now); syncErr != nil {
+		return containerdContainerInfo{}, false
+	}
+
+	c.lock.RLock()
+	info, found := c.containerIPMap[containerIP]
+	c.lock.RUnlock()
+	return info, found
+}
+
+// syncContainers replaces the mapping with the running tasks that hold CNI reservations.
+// Containers are only inspected the first time they are seen running.
+func (c *ContainerdContainerService) syncContainers(ctx context.Context, now time.Time) error {
+	log := loggerFromContext(ctx, c.log)
+
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+
+	running, err := c.runningTasks(ctx)
+	if err != nil {
+		log.Error("syncContainers: Error listing running tasks", logKeyError, err)
+		return err
+	}
+
+	ipToID, err := c.cniReservations()
+	if err != nil {
+		log.Error("syncContainers: Error reading CNI reservations", logKeyError, err)
+		return err
+	}
+
+	c.lock.RLock()
+	aliasToARN := c.aliasToARN
+	c.lock.RUnlock()
+
+	refreshAt := refreshTime(now)
+	containerIPMap := make(map[string]containerdContainerInfo)
+	infos := make(map[string]*ContainerInfo)
+	containers := make(map[string]containerdContainer)
+
+	for ipAddress, id := range ipToID {
+		if !running[id] {
+			continue
+		}
+
+		info, found := infos[id]
+		if !found {
+			container, cached := c.containers[id]
+			if !cached {
+				var infoErr error
+				container, infoErr = c.containerInfo(ctx, id)
+				if infoErr != nil {
+					log.Warn("syncContainers: Error inspecting container", logKeyContainerID, id, logKeyError, infoErr)
+					continue
+				}
+			}
+			containers[id] = container
+
+			name := container.Labels[nerdctlNameLabelKey]
+			if name == "" {
+				name = id
+			}
+
+			if newInfo, ok := newContainerInfo(log, aliasToARN, id, []string{name}, container.Image, container.Labels); ok {
+				info = &newInfo
+			}
+			infos[id] = info
+		}
+		if info == nil {
+			continue
+		}
+
+		log.Debug("syncContainers: indexed container",
+			logKeyContainerID, shortContainerID(id),
+			"ip", ipAddress,
+			"image", info.Image,
+			logKeyRoleARN, info.IamRole,
+		)
+		containerIPMap[ipAddress] = containerdContainerInfo{ContainerInfo: *info, RefreshTime: refreshAt}
+	}
+
+	c.containers = containers
+
+	c.lock.Lock()
+	c.containerIPMap = containerIPMap
+	c.syncTime = now
+	c.lock.Unlock()
+
+	return nil
+}
+
+// runningTasks returns the IDs of containers with running tasks.
+func (c *ContainerdContainerService) runningTasks(ctx context.Context) (map[string]bool, error) {
+	out, err := c.ctr(ctx, "tasks", "tasks", "ls")
+	if err != nil {
+		return nil, err
+	}
+
+	// Output is a table with a header, ex. "TASK  PID  STATUS".
+	running := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for header := true; scanner.Scan(); header = false {
+		fields := strings.Fields(scanner.Text())
+		if header || len(fields) < 3 {
+			continue
+		}
+		if fields[len(fields)-1] == containerdRunningStatus {
+			running[fields[0]] = true
+		}
+	}
+
+	return running, errors.Wrap(scanner.Err(), "Error reading task list")
+}
+
+// containerInfo returns the container's image and labels.
+func (c *ContainerdContainerService) containerInfo(ctx context.Context, id string) (containerdContainer, error) {
+	var container containerdContainer
+
+	out, err := c.ctr(ctx, "info", "containers", "info", id)
+	if err != nil {
+		return container, err
+	}
+
+	err = json.Unmarshal(out, &container)
+	return container, errors.Wrapf(err, "Error parsing info of container [%s]", id)
+}
+
+// cniReservations maps IPs to container IDs. The host-local IPAM plugin reserves an address
+// by creating a file, named by the IP, that contains the container ID and, in newer versions,
+// the interface name on the next line.
+func (c *ContainerdContainerService) cniReservations() (map[string]string, error) {
+	networks, err := ioutil.ReadDir(c.config.CNINetworksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, errors.Wrapf(err, "Error listing CNI networks dir [%s]", c.config.CNINetworksDir)
+	}
+
+	ipToID := make(map[string]string)
+	for _, network := range networks {
+		if !network.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(c.config.CNINetworksDir, network.Name())
+		reservations, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error listing CNI network dir [%s]", dir)
+		}
+
+		for _, reservation := range reservations {
+			// Other files, ex. "lock" and "last_reserved_ip.0", are not named by an IP.
+			if reservation.IsDir() || net.ParseIP(reservation.Name()) == nil {
+				continue
+			}
+
+			content, err := ioutil.ReadFile(filepath.Join(dir, reservation.Name()))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Released since the dir was listed.
+					continue
+				}
+				return nil, errors.Wrapf(err, "Error reading CNI reservation [%s]", reservation.Name())
+			}
+
+			id := strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+			if id != "" {
+				ipToID[normalizeIP(reservation.Name())] = id
+			}
+		}
+	}
+
+	return ipToID, nil
+}
+
+// ctr runs the ctr CLI against the configured containerd instance and records metrics.
+func (c *ContainerdContainerService) ctr(ctx context.Context, operation string, args ...string) ([]byte, error) {
+	cmdArgs := append([]string{"--address", c.config.Address, "--namespace", c.config.Namespace}, args...)
+	cmd := exec.CommandContext(ctx, c.config.CtrPath, cmdArgs...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	containerdCallsTotal.Inc(operation, callResult(err))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error running ctr %v: %s", args, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
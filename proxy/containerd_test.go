@@ -0,0 +1,234 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+// ctrStubScript serves `ctr` commands from files in a state dir: "tasks" holds the task
+// table, and "<id>.json" holds the info of each container. Commands are logged to "calls".
+const ctrStubScript = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--address|--namespace) shift 2 ;;
+	*) break ;;
+	esac
+done
+echo "$1" >> "%[1]s/calls"
+case "$1" in
+tasks) cat "%[1]s/tasks" ;;
+containers) cat "%[1]s/$3.json" 2>/dev/null || { echo "container \"$3\" not found" >&2; exit 1; } ;;
+version) echo "Server: v1.7.0" ;;
+*) exit 1 ;;
+esac
+`
+
+// containerdStub writes the state read by the ctr stub and the CNI host-local reservations.
+type containerdStub struct {
+	t        *testing.T
+	dir      string
+	tasks    map[string]string
+	networks string
+	socket   net.Listener
+}
+
+func newContainerdStub(t *testing.T) *containerdStub {
+	dir, err := ioutil.TempDir("", "ec2metaproxy-containerd")
+	fatalOnErr(t, err)
+
+	c := &containerdStub{t: t, dir: dir, tasks: make(map[string]string), networks: filepath.Join(dir, "networks")}
+	c.socket, err = net.Listen("unix", filepath.Join(dir, "containerd.sock"))
+	fatalOnErr(t, err)
+	fatalOnErr(t, ioutil.WriteFile(filepath.Join(dir, "ctr"), []byte(fmt.Sprintf(ctrStubScript, dir)), 0700))
+	fatalOnErr(t, os.MkdirAll(filepath.Join(c.networks, "bridge"), 0700))
+	fatalOnErr(t, ioutil.WriteFile(filepath.Join(c.networks, "bridge", "lock"), nil, 0600))
+	fatalOnErr(t, ioutil.WriteFile(filepath.Join(c.networks, "bridge", "last_reserved_ip.0"), []byte("10.4.0.9"), 0600))
+	c.writeTasks()
+	return c
+}
+
+func (c *containerdStub) Close() {
+	_ = c.socket.Close()
+	_ = os.RemoveAll(c.dir)
+}
+
+// SetContainer creates a task in the status, with the IP reserved, and the container info.
+func (c *containerdStub) SetContainer(id, status, ip string, labels map[string]string) {
+	info, err := json.Marshal(map[string]interface{}{"ID": id, "Image": "docker.io/library/" + id + ":latest", "Labels": labels})
+	fatalOnErr(c.t, err)
+	fatalOnErr(c.t, ioutil.WriteFile(filepath.Join(c.dir, id+".json"), info, 0600))
+	fatalOnErr(c.t, ioutil.WriteFile(filepath.Join(c.networks, "bridge", ip), []byte(id+"\r\neth0"), 0600))
+
+	c.tasks[id] = status
+	c.writeTasks()
+}
+
+// Calls returns the number of times the ctr command, ex. "tasks", ran.
+func (c *containerdStub) Calls(command string) int {
+	content, err := ioutil.ReadFile(filepath.Join(c.dir, "calls"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	fatalOnErr(c.t, err)
+
+	calls := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == command {
+			calls++
+		}
+	}
+	return calls
+}
+
+func (c *containerdStub) writeTasks() {
+	table := []string{"TASK    PID     STATUS"}
+	for id, status := range c.tasks {
+		table = append(table, fmt.Sprintf("%s    %d    %s", id, 1000+len(table), status))
+	}
+	fatalOnErr(c.t, ioutil.WriteFile(filepath.Join(c.dir, "tasks"), []byte(strings.Join(table, "\n")+"\n"), 0600))
+}
+
+func (c *containerdStub) Service() *proxy.ContainerdContainerService {
+	config := defaultConfig()
+	config.ContainerRuntime = proxy.ContainerRuntimeContainerd
+	config.Containerd = proxy.ContainerdConfig{
+		Address:        filepath.Join(c.dir, "containerd.sock"),
+		CtrPath:        filepath.Join(c.dir, "ctr"),
+		CNINetworksDir: c.networks,
+	}
+
+	svc, err := proxy.NewContainerdContainerService(config, newLogger().logger)
+	fatalOnErr(c.t, err)
+	return svc
+}
+
+func TestContainerdContainerService(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should resolve roles of running tasks from labels", func(t *testing.T) {
+		containerd := newContainerdStub(t)
+		defer containerd.Close()
+		containerd.SetContainer("c1", "RUNNING", "10.4.0.2", map[string]string{
+			proxy.RoleLabelKey:   "db",
+			proxy.PolicyLabelKey: defaultPolicy,
+			"nerdctl/name":       "web",
+		})
+		containerd.SetContainer("c2", "RUNNING", "10.4.0.3", nil)
+		containerd.SetContainer("c3", "STOPPED", "10.4.0.4", map[string]string{proxy.RoleLabelKey: "db"})
+		containerd.SetContainer("c4", "RUNNING", "10.4.0.5", map[string]string{proxy.RoleLabelKey: "unmapped"})
+
+		svc := containerd.Service()
+
+		info, err := svc.ContainerForIP(ctx, "10.4.0.2")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{"c1", info.ID},
+			[2]string{"web", info.Name},
+			[2]string{"docker.io/library/c1:latest", info.Image},
+			[2]string{dbRoleARNFriendlyName, info.IamRole.RoleName()},
+			[2]string{defaultPolicy, info.IamPolicy},
+		})
+
+		info, err = svc.ContainerForIP(ctx, "10.4.0.3")
+		fatalOnErr(t, err)
+		if !info.IamRole.Empty() {
+			t.Fatalf("expected empty role, got [%s]", info.IamRole)
+		}
+		stringsEqual(t, [][2]string{[2]string{"c2", info.Name}})
+
+		for _, ip := range []string{"10.4.0.4", "10.4.0.5", "10.4.0.9"} {
+			if _, err := svc.ContainerForIP(ctx, ip); err == nil {
+				t.Fatalf("expected no container for IP [%s]", ip)
+			}
+		}
+
+		if len(svc.Containers()) != 2 {
+			t.Fatalf("expected 2 entries, got [%+v]", svc.Containers())
+		}
+	})
+
+	t.Run("should remove stopped tasks on resync", func(t *testing.T) {
+		containerd := newContainerdStub(t)
+		defer containerd.Close()
+		containerd.SetContainer("c1", "RUNNING", "10.4.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := containerd.Service()
+		_, err := svc.ContainerForIP(ctx, "10.4.0.2")
+		fatalOnErr(t, err)
+
+		containerd.SetContainer("c1", "STOPPED", "10.4.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		fatalOnErr(t, svc.Resync(ctx, "c1"))
+
+		if len(svc.Containers()) != 0 {
+			t.Fatalf("expected no entries, got [%+v]", svc.Containers())
+		}
+	})
+
+	t.Run("should serve cached entries while watching", func(t *testing.T) {
+		containerd := newContainerdStub(t)
+		defer containerd.Close()
+		containerd.SetContainer("c1", "RUNNING", "10.4.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := containerd.Service()
+
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go svc.Watch(watchCtx)
+		waitFor(t, func() bool { return len(svc.Containers()) == 1 })
+
+		// Past the refresh time of the entry.
+		time.Sleep(1100 * time.Millisecond)
+
+		taskCalls := containerd.Calls("tasks")
+		for i := 0; i < 3; i++ {
+			info, err := svc.ContainerForIP(ctx, "10.4.0.2")
+			fatalOnErr(t, err)
+			stringsEqual(t, [][2]string{[2]string{"c1", info.ID}})
+		}
+		if calls := containerd.Calls("tasks") - taskCalls; calls != 0 {
+			t.Fatalf("expected no task list calls, got [%d]", calls)
+		}
+
+		// A resync does not inspect containers again.
+		fatalOnErr(t, svc.ApplyConfig(defaultConfig()))
+		if calls := containerd.Calls("containers"); calls != 1 {
+			t.Fatalf("expected 1 container info call, got [%d]", calls)
+		}
+	})
+
+	t.Run("should ping containerd", func(t *testing.T) {
+		containerd := newContainerdStub(t)
+		defer containerd.Close()
+
+		fatalOnErr(t, containerd.Service().Ping(ctx))
+	})
+
+	t.Run("should require the ctr binary and the containerd socket", func(t *testing.T) {
+		containerd := newContainerdStub(t)
+		defer containerd.Close()
+
+		for _, mutate := range []func(*proxy.ContainerdConfig){
+			func(c *proxy.ContainerdConfig) { c.CtrPath = "/nonexistent/ctr" },
+			func(c *proxy.ContainerdConfig) { c.Address = "/nonexistent/containerd.sock" },
+			func(c *proxy.ContainerdConfig) { c.Address = c.CtrPath },
+		} {
+			config := defaultConfig()
+			config.Containerd = proxy.ContainerdConfig{Address: filepath.Join(containerd.dir, "containerd.sock"), CtrPath: filepath.Join(containerd.dir, "ctr")}
+			mutate(&config.Containerd)
+
+			if _, err := proxy.NewContainerdContainerService(config, newLogger().logger); err == nil {
+				t.Fatalf("expected error for [%+v]", config.Containerd)
+			}
+		}
+	})
+}
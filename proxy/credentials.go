@@ -3,8 +3,12 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"reflect"
 	"regexp"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -22,15 +26,31 @@ var (
 	invalidSessionNameRegexp = regexp.MustCompile(`[^\w+=,.@-]`)
 
 	sessionExpiration = 5 * time.Minute
+
+	// refreshInterval is the delay between background scans for credentials to renew.
+	refreshInterval = 30 * time.Second
+	// refreshAhead is the minimum time before expiration at which credentials are renewed
+	// in the background. It exceeds sessionExpiration so requests rarely renew them.
+	refreshAhead = 10 * time.Minute
+	// refreshJitter is the maximum random addition to refreshAhead.
+	refreshJitter = 2 * time.Minute
+	// refreshConcurrency limits the number of concurrent background AssumeRole calls.
+	refreshConcurrency = 4
 )
 
 type credentials struct {
 	AccessKey   string
 	Expiration  time.Time
 	GeneratedAt time.Time
+	Policy      string
+	RoleAlias   string
 	RoleArn     RoleARN
 	SecretKey   string
 	Token       string
+
+	// Container and Source describe the request the credentials are returned for, by CredentialsForIP.
+	Container ContainerInfo
+	Source    string
 }
 
 func (c credentials) ExpiredNow() bool {
@@ -45,9 +65,33 @@ func (c credentials) ExpiresIn(d time.Duration) bool {
 	return c.ExpiredAt(time.Now().Add(d))
 }
 
+// accessDeniedError indicates that a container is not permitted to receive any credentials.
+type accessDeniedError struct {
+	reason string
+}
+
+func (e accessDeniedError) Error() string {
+	return e.reason
+}
+
+// isAccessDenied returns true if the (possibly wrapped) error is an accessDeniedError.
+func isAccessDenied(err error) bool {
+	_, ok := errors.Cause(err).(accessDeniedError)
+	return ok
+}
+
 type containerCredentials struct {
 	ContainerInfo
 	credentials
+
+	// lastUsed is when the credentials of the entry were last returned to the container.
+	lastUsed time.Time
+}
+
+// usedSince returns true if the entry was used within the lifetime of its credentials, so that
+// a container that still requests credentials will request the renewed ones.
+func (c containerCredentials) usedSince(now time.Time) bool {
+	return !c.lastUsed.Before(now.Add(-c.Expiration.Sub(c.GeneratedAt)))
 }
 
 func (c containerCredentials) IsValid(container ContainerInfo) bool {
@@ -56,79 +100,487 @@ func (c containerCredentials) IsValid(container ContainerInfo) bool {
 		!c.credentials.ExpiresIn(sessionExpiration)
 }
 
+// assumeRoleCall is an in-flight AssumeRole whose result is shared by concurrent requests.
+type assumeRoleCall struct {
+	done  chan struct{}
+	creds containerCredentials
+	err   error
+}
+
+// credentialsProvider caches credentials per container IP.
+//
+// Its lock only guards the cache, in-flight calls and settings. Container lookups and AssumeRole
+// calls run outside of it, so one slow STS response does not delay requests from other containers.
 type credentialsProvider struct {
 	container            ContainerService
 	awsSts               stsiface.STSAPI
-	defaultIamRoleArn    RoleARN
-	defaultIamPolicy     string
+	settings             credentialsSettings
 	containerCredentials map[string]containerCredentials
+	inflight             map[string]*assumeRoleCall
+	chainLinks           map[string]chainLink
+	chainInflight        map[string]*chainCall
+	instanceID           func(context.Context) (string, error)
 	lock                 sync.Mutex
 }
 
-func newCredentialsProvider(stsSvc stsiface.STSAPI, container ContainerService, defaultIamRoleArn RoleARN, defaultIamPolicy string) *credentialsProvider {
+// credentialsSettings holds the Config-derived fields that ApplyConfig can replace.
+type credentialsSettings struct {
+	aliasToARN        map[string]string
+	defaultAlias      string
+	defaultIamRoleArn RoleARN
+	defaultIamPolicy  string
+	denyUnlabeled     bool
+	sessionTags       SessionTagsConfig
+	aliasOptions      map[string]AliasOptions
+	sessionNames      map[string]*template.Template
+	authorization     map[string]authorizationRule
+}
+
+func newCredentialsSettings(config Config) (credentialsSettings, error) {
+	var defaultIamRole RoleARN
+	var err error
+
+	if config.DefaultAlias != "" {
+		defaultIamRole, err = NewRoleARN(config.AliasToARN[config.DefaultAlias])
+		if err != nil {
+			return credentialsSettings{}, errors.Wrapf(err, "Error parsing ARN of default alias [%s]", config.DefaultAlias)
+		}
+	}
+
+	sessionNames := make(map[string]*template.Template)
+	for alias, options := range config.AliasOptions {
+		tmpl, err := options.sessionNameTemplate()
+		if err != nil {
+			return credentialsSettings{}, errors.Wrapf(err, "Error parsing session name template of alias [%s]", alias)
+		}
+		if tmpl != nil {
+			sessionNames[alias] = tmpl
+		}
+	}
+
+	authorization, err := newAuthorizationRules(config)
+	if err != nil {
+		return credentialsSettings{}, err
+	}
+
+	return credentialsSettings{
+		aliasToARN:        config.AliasToARN,
+		defaultAlias:      config.DefaultAlias,
+		defaultIamRoleArn: defaultIamRole,
+		defaultIamPolicy:  config.DefaultPolicy,
+		denyUnlabeled:     config.DenyUnlabeled,
+		sessionTags:       config.SessionTags,
+		aliasOptions:      config.AliasOptions,
+		sessionNames:      sessionNames,
+		authorization:     authorization,
+	}, nil
+}
+
+// authorize returns an accessDeniedError if the container may not receive credentials of its
+// effective alias.
+func (s credentialsSettings) authorize(container ContainerInfo) error {
+	if container.IamRole.Empty() && s.denyUnlabeled {
+		return errors.WithStack(accessDeniedError{
+			reason: fmt.Sprintf("Container [%s] does not specify a role", container.Name),
+		})
+	}
+
+	alias, _, _ := s.effectiveRole(container)
+	if container.AllowedAliases != nil && !containsString(container.AllowedAliases, alias) {
+		return errors.WithStack(accessDeniedError{
+			reason: fmt.Sprintf("Container [%s] is not allowed alias [%s], expected one of %v", container.Name, alias, container.AllowedAliases),
+		})
+	}
+	if rule, found := s.authorization[alias]; found {
+		return rule.check(alias, container)
+	}
+
+	return nil
+}
+
+// effectiveRole returns the alias, ARN and policy that apply to the container.
+//
+// The policy label takes precedence over the alias policy, which takes precedence over the default policy.
+func (s credentialsSettings) effectiveRole(container ContainerInfo) (string, RoleARN, string) {
+	alias := container.RoleAlias
+	arn := container.IamRole
+	iamPolicy := container.IamPolicy
+
+	if arn.Empty() {
+		alias = s.defaultAlias
+		arn = s.defaultIamRoleArn
+	}
+
+	if len(iamPolicy) == 0 {
+		iamPolicy = s.aliasOptions[alias].Policy
+	}
+	if len(iamPolicy) == 0 {
+		iamPolicy = s.defaultIamPolicy
+	}
+
+	return alias, arn, iamPolicy
+}
+
+// newCredentialsProvider creates a provider whose instanceID function supplies the host's EC2
+// instance ID to session tags.
+func newCredentialsProvider(stsSvc stsiface.STSAPI, container ContainerService, config Config, instanceID func(context.Context) (string, error)) (*credentialsProvider, error) {
+	settings, err := newCredentialsSettings(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &credentialsProvider{
 		container:            container,
 		awsSts:               stsSvc,
-		defaultIamRoleArn:    defaultIamRoleArn,
-		defaultIamPolicy:     defaultIamPolicy,
+		settings:             settings,
 		containerCredentials: make(map[string]containerCredentials),
+		inflight:             make(map[string]*assumeRoleCall),
+		chainLinks:           make(map[string]chainLink),
+		chainInflight:        make(map[string]*chainCall),
+		instanceID:           instanceID,
+	}, nil
+}
+
+func (c *credentialsProvider) currentSettings() credentialsSettings {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.settings
+}
+
+// ApplyConfig replaces the settings and evicts cached credentials whose role or policy
+// would differ under the new settings, ex. because an alias now maps to another ARN.
+// Credentials of aliases whose options changed are also evicted, and all cached credentials
+// are evicted if the session tags config changed.
+func (c *credentialsProvider) ApplyConfig(config Config) error {
+	settings, err := newCredentialsSettings(config)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	oldSettings := c.settings
+	tagsChanged := !reflect.DeepEqual(oldSettings.sessionTags, settings.sessionTags)
+	c.settings = settings
+
+	for key, creds := range c.containerCredentials {
+		if tagsChanged || !reflect.DeepEqual(oldSettings.aliasOptions[creds.credentials.RoleAlias], settings.aliasOptions[creds.credentials.RoleAlias]) {
+			delete(c.containerCredentials, key)
+			continue
+		}
+
+		container := creds.ContainerInfo
+		if container.RoleAlias != "" && settings.aliasToARN[container.RoleAlias] != container.IamRole.String() {
+			delete(c.containerCredentials, key)
+			continue
+		}
+
+		_, arn, iamPolicy := settings.effectiveRole(container)
+		if !arn.Equals(creds.RoleArn) || iamPolicy != creds.Policy {
+			delete(c.containerCredentials, key)
+		}
+	}
+
+	return nil
+}
+
+// credentialsKey returns the cache key of the container's credentials: its IP, or the IP and
+// container ID if it shares the host's IP with other containers.
+func credentialsKey(containerIP string, container ContainerInfo) string {
+	if container.HostNetwork {
+		return containerIP + "/" + container.ID
+	}
+	return containerIP
+}
+
+// credentialsKeyIP returns the container IP of a credentialsKey.
+func credentialsKeyIP(key string) string {
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// cachedCredentials returns a copy of the cache, keyed by credentialsKey.
+func (c *credentialsProvider) cachedCredentials() map[string]containerCredentials {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cached := make(map[string]containerCredentials, len(c.containerCredentials))
+	for ip, creds := range c.containerCredentials {
+		cached[ip] = creds
+	}
+	return cached
+}
+
+// evict removes the cached credentials that match, so that the next request assumes the role
+// again, and returns how many were removed.
+func (c *credentialsProvider) evict(match func(containerIP string, creds containerCredentials) bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	evicted := 0
+	for key, creds := range c.containerCredentials {
+		if match(credentialsKeyIP(key), creds) {
+			delete(c.containerCredentials, key)
+			evicted++
+		}
 	}
+	return evicted
 }
 
 // CredentialsForIP resolves the IP to a specific container, then attempts to assume the role
 // specified in the container's metadata. Role specific credentials are returned.
 //
 // If the cache contains no fresh and valid role credentials, a fresh set is requested from
-// AWS and cached.
+// AWS and cached. Concurrent requests for the same container and role share one request.
+//
+// Containers without a role receive the default role, or an accessDeniedError if denyUnlabeled is set.
+// Containers that do not match the authorization rule of their alias also receive an accessDeniedError.
 func (c *credentialsProvider) CredentialsForIP(ctx context.Context, containerIP string) (credentials, error) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
 	container, err := c.container.ContainerForIP(ctx, containerIP)
 	if err != nil {
 		return credentials{}, errors.Wrapf(err, "Error finding container with IP [%s]", containerIP)
 	}
 
-	oldCredentials, found := c.containerCredentials[containerIP]
+	return c.CredentialsForContainer(ctx, containerIP, container)
+}
+
+// CredentialsForContainer is CredentialsForIP for a container already found at the IP.
+func (c *credentialsProvider) CredentialsForContainer(ctx context.Context, containerIP string, container ContainerInfo) (credentials, error) {
+	if err := c.currentSettings().authorize(container); err != nil {
+		return credentials{}, errors.Wrapf(err, "Denied container at IP [%s]", containerIP)
+	}
+
+	key := credentialsKey(containerIP, container)
+
+	c.lock.Lock()
+	oldCredentials, found := c.containerCredentials[key]
+	c.lock.Unlock()
+
+	source := CredentialsSourceCache
+	if found && oldCredentials.IsValid(container) {
+		credentialsCacheTotal.Inc(resultHit)
+	} else {
+		credentialsCacheTotal.Inc(resultMiss)
+		source = CredentialsSourceAssumeRole
+		var err error
+		oldCredentials, err = c.assumeSharedContainerRole(ctx, container, containerIP)
+		if err != nil {
+			return credentials{}, err
+		}
+	}
+	c.markUsed(key, time.Now())
+
+	creds := oldCredentials.credentials
+	creds.Container = container
+	creds.Source = source
+	return creds, nil
+}
+
+// markUsed records that the cached credentials of the key were returned to the container.
+func (c *credentialsProvider) markUsed(key string, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cached, found := c.containerCredentials[key]; found {
+		cached.lastUsed = now
+		c.containerCredentials[key] = cached
+	}
+}
+
+// assumeSharedContainerRole caches the result of assumeContainerRole. If an identical call
+// for the same container, role and policy is in flight, its result is awaited instead.
+func (c *credentialsProvider) assumeSharedContainerRole(ctx context.Context, container ContainerInfo, containerIP string) (containerCredentials, error) {
+	key := container.ID + "\x00" + container.IamRole.String() + "\x00" + container.IamPolicy
 
-	if !found || !oldCredentials.IsValid(container) {
-		arn := container.IamRole
-		iamPolicy := container.IamPolicy
+	c.lock.Lock()
+	call, found := c.inflight[key]
+	if !found {
+		call = &assumeRoleCall{done: make(chan struct{})}
+		c.inflight[key] = call
+	}
+	c.lock.Unlock()
 
-		if arn.Empty() {
-			arn = c.defaultIamRoleArn
+	if found {
+		select {
+		case <-call.done:
+			return call.creds, call.err
+		case <-ctx.Done():
+			return containerCredentials{}, errors.Wrapf(ctx.Err(), "Error waiting for role of container [%s] at IP [%s]", container.Name, containerIP)
 		}
+	}
+
+	call.creds, call.err = c.assumeContainerRole(ctx, container, containerIP)
 
-		if len(iamPolicy) == 0 {
-			iamPolicy = c.defaultIamPolicy
+	c.lock.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		creds := call.creds
+		if cached, found := c.containerCredentials[credentialsKey(containerIP, container)]; found {
+			creds.lastUsed = cached.lastUsed
 		}
+		c.containerCredentials[credentialsKey(containerIP, container)] = creds
+	}
+	c.lock.Unlock()
+
+	close(call.done)
+
+	return call.creds, call.err
+}
 
-		role, err := c.AssumeRole(arn, iamPolicy, generateSessionName(c.container.TypeName(), container.ID))
+// assumeContainerRole requests fresh credentials for the container's role/policy, or the
+// defaults if the container does not specify them, with the alias options and configured session tags.
+func (c *credentialsProvider) assumeContainerRole(ctx context.Context, container ContainerInfo, containerIP string) (containerCredentials, error) {
+	settings := c.currentSettings()
+	alias, arn, iamPolicy := settings.effectiveRole(container)
 
+	platform := container.Platform
+	if platform == "" {
+		platform = c.container.TypeName()
+	}
+
+	sessionName := generateSessionName(platform, container.ID)
+	if tmpl := settings.sessionNames[alias]; tmpl != nil {
+		name, err := renderSessionName(tmpl, platform, container)
 		if err != nil {
-			return credentials{}, errors.Wrapf(err, "Error assuming role [%s] for container [%s] at IP {%s]", arn, container.Name, containerIP)
+			return containerCredentials{}, errors.Wrapf(err, "Error selecting session name for container [%s] at IP [%s]", container.Name, containerIP)
+		}
+		if name != "" {
+			sessionName = name
+		}
+	}
+
+	tags, err := settings.sessionTags.resolve(ctx, container, c.instanceID)
+	if err != nil {
+		return containerCredentials{}, errors.Wrapf(err, "Error selecting session tags for container [%s] at IP [%s]", container.Name, containerIP)
+	}
+
+	role, err := c.AssumeRole(ctx, arn, iamPolicy, sessionName, settings.aliasOptions[alias], tags)
+
+	if err != nil {
+		return containerCredentials{}, errors.Wrapf(err, "Error assuming role [%s] for container [%s] at IP {%s]", arn, container.Name, containerIP)
+	}
+	role.RoleAlias = alias
+
+	return containerCredentials{ContainerInfo: container, credentials: role}, nil
+}
+
+// Refresh renews cached credentials in the background, before they expire, until the context
+// is canceled. Requests are then normally served from the cache instead of waiting on STS.
+//
+// Each scan renews credentials that expire within refreshAhead plus a random jitter, so that
+// credentials cached at the same time are not all renewed at once. At most refreshConcurrency
+// renewals run at a time. Intermediate roles of chains are renewed first, in the same way.
+//
+// Entries that were not used within the lifetime of their credentials are evicted instead, so
+// that containers which stopped requesting credentials do not keep them renewed.
+func (c *credentialsProvider) Refresh(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refreshExpiring(ctx, time.Now())
+		}
+	}
+}
+
+func (c *credentialsProvider) refreshExpiring(ctx context.Context, now time.Time) {
+	c.refreshChainLinks(ctx, now)
+
+	due := make(map[string]ContainerInfo)
+
+	c.lock.Lock()
+	for key, creds := range c.containerCredentials {
+		window := refreshAhead + time.Duration(rand.Int63n(int64(refreshJitter)))
+		if !creds.ExpiredAt(now.Add(window)) {
+			continue
+		}
+		if !creds.usedSince(now) {
+			delete(c.containerCredentials, key)
+			continue
 		}
+		due[key] = creds.ContainerInfo
+	}
+	c.lock.Unlock()
+
+	sem := make(chan struct{}, refreshConcurrency)
+	var wg sync.WaitGroup
+
+	for key, cached := range due {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(key string, cached ContainerInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			c.refreshContainer(ctx, key, cached)
+		}(key, cached)
+	}
 
-		oldCredentials = containerCredentials{container, role}
-		c.containerCredentials[containerIP] = oldCredentials
+	wg.Wait()
+}
+
+// refreshContainer renews the cached credentials of the entry. Entries of containers that no
+// longer exist are evicted.
+//
+// Containers that share the host's network namespace are found by ID, because their IP does
+// not identify them without a request.
+func (c *credentialsProvider) refreshContainer(ctx context.Context, key string, cached ContainerInfo) {
+	containerIP := credentialsKeyIP(key)
+
+	var container ContainerInfo
+	var err error
+	if resolver, ok := c.container.(ContainerResolver); ok && cached.HostNetwork {
+		container, err = resolver.ContainerForID(ctx, cached.ID)
+	} else {
+		container, err = c.container.ContainerForIP(ctx, containerIP)
+	}
+	if err != nil || credentialsKey(containerIP, container) != key {
+		c.lock.Lock()
+		delete(c.containerCredentials, key)
+		c.lock.Unlock()
+		return
 	}
 
-	return oldCredentials.credentials, nil
+	// On error, the request path will retry (and report the error) once the cached credentials expire.
+	_, _ = c.assumeSharedContainerRole(ctx, container, containerIP)
 }
 
-func (c *credentialsProvider) AssumeRole(role RoleARN, iamPolicy, sessionName string) (credentials, error) {
+// AssumeRole requests credentials of the role. If the options select a chain, the chain's
+// roles are assumed first, or their cached credentials reused.
+func (c *credentialsProvider) AssumeRole(ctx context.Context, role RoleARN, iamPolicy, sessionName string, options AliasOptions, tags sessionTags) (credentials, error) {
 	var policy *string
+	var externalID *string
+
+	client, err := c.chainClient(ctx, options.Via, time.Now().Add(sessionExpiration))
+	if err != nil {
+		return credentials{}, errors.Wrapf(err, "Error assuming chain of role [%s]", role)
+	}
 
 	if len(iamPolicy) > 0 {
 		policy = aws.String(iamPolicy)
 	}
+	if len(options.ExternalID) > 0 {
+		externalID = aws.String(options.ExternalID)
+	}
 
-	resp, err := c.awsSts.AssumeRole(&sts.AssumeRoleInput{
-		DurationSeconds: aws.Int64(3600), // Max is 1 hour
+	resp, err := assumeRole(client, &sts.AssumeRoleInput{
+		DurationSeconds: aws.Int64(options.duration()),
+		ExternalId:      externalID,
 		Policy:          policy,
 		RoleArn:         aws.String(role.String()),
 		RoleSessionName: aws.String(sessionName),
-	})
+	}, tags)
 
 	if err != nil {
 		return credentials{}, errors.Wrapf(err, "Error assuming role [%s] with policy [%s] and session name [%s]]", role, iamPolicy, sessionName)
@@ -140,11 +592,35 @@ func (c *credentialsProvider) AssumeRole(role RoleARN, iamPolicy, sessionName st
 		Token:       *resp.Credentials.SessionToken,
 		Expiration:  *resp.Credentials.Expiration,
 		GeneratedAt: time.Now(),
+		Policy:      iamPolicy,
 		RoleArn:     role,
 	}, nil
 }
 
+// assumeRole calls AssumeRole with the tags, if any, and records metrics.
+func assumeRole(client stsiface.STSAPI, input *sts.AssumeRoleInput, tags sessionTags) (*sts.AssumeRoleOutput, error) {
+	start := time.Now()
+	defer assumeRoleDuration.ObserveSince(start)
+
+	var resp *sts.AssumeRoleOutput
+	var err error
+	if tags.Empty() {
+		resp, err = client.AssumeRole(input)
+	} else {
+		req, out := client.AssumeRoleRequest(input)
+		req.Handlers.Build.PushBack(tags.addToRequest)
+		resp, err = out, req.Send()
+	}
+	assumeRoleTotal.Inc(callResult(err))
+
+	return resp, err
+}
+
 func generateSessionName(platform, containerID string) string {
-	sessionName := fmt.Sprintf("%s-%s", platform, containerID)
-	return invalidSessionNameRegexp.ReplaceAllString(sessionName, "_")[0:maxSessionNameLen]
+	sessionName := invalidSessionNameRegexp.ReplaceAllString(fmt.Sprintf("%s-%s", platform, containerID), "_")
+	// Pod UIDs and some container IDs are shorter than docker's.
+	if len(sessionName) > maxSessionNameLen {
+		sessionName = sessionName[0:maxSessionNameLen]
+	}
+	return sessionName
 }
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/pkg/errors"
+)
+
+// refreshSTSStub counts AssumeRole calls per session name, and the most that ran at once.
+type refreshSTSStub struct {
+	stsiface.STSAPI
+	calls         map[string]int
+	running       int
+	maxConcurrent int
+	lock          sync.Mutex
+}
+
+func (s *refreshSTSStub) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	s.lock.Lock()
+	s.calls[*input.RoleSessionName]++
+	s.running++
+	if s.running > s.maxConcurrent {
+		s.maxConcurrent = s.running
+	}
+	s.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond) // let other renewals overlap
+
+	s.lock.Lock()
+	s.running--
+	s.lock.Unlock()
+
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("renewed"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+// refreshContainerStub finds containers by IP, and host network containers by ID.
+type refreshContainerStub struct {
+	byIP map[string]ContainerInfo
+	byID map[string]ContainerInfo
+}
+
+func (s refreshContainerStub) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	if info, found := s.byIP[containerIP]; found {
+		return info, nil
+	}
+	return ContainerInfo{}, errors.Errorf("No container at IP [%s]", containerIP)
+}
+
+func (s refreshContainerStub) ContainerForID(ctx context.Context, containerID string) (ContainerInfo, error) {
+	if info, found := s.byID[containerID]; found {
+		return info, nil
+	}
+	return ContainerInfo{}, errors.Errorf("No container with ID [%s]", containerID)
+}
+
+func (s refreshContainerStub) TypeName() string {
+	return ContainerRuntimeDocker
+}
+
+func TestRefreshExpiring(t *testing.T) {
+	config := Config{
+		AliasToARN:   map[string]string{"db": "arn:aws:iam::123456789012:role/SomethingDB"},
+		DefaultAlias: "db",
+	}
+	role, err := NewRoleARN(config.AliasToARN["db"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	containers := refreshContainerStub{byIP: make(map[string]ContainerInfo), byID: make(map[string]ContainerInfo)}
+	cached := make(map[string]containerCredentials)
+
+	// addEntry caches credentials of a container that expire after the duration. Unless the
+	// container is gone, it is also known to the container service.
+	addEntry := func(key string, info ContainerInfo, expiresIn time.Duration, gone bool) {
+		info.IamRole = role
+		info.RoleAlias = "db"
+		if !gone {
+			if info.HostNetwork {
+				containers.byID[info.ID] = info
+			} else {
+				containers.byIP[key] = info
+			}
+		}
+		creds := credentials{
+			AccessKey:   "cached",
+			Expiration:  now.Add(expiresIn),
+			GeneratedAt: now.Add(expiresIn - time.Hour),
+			RoleArn:     role,
+		}
+		cached[key] = containerCredentials{info, creds, now.Add(-time.Minute)}
+	}
+
+	// Renewed regardless of jitter: within refreshAhead.
+	addEntry("10.0.0.1", ContainerInfo{ID: "due"}, refreshAhead-time.Second, false)
+	// Never renewed: beyond refreshAhead plus the maximum jitter.
+	addEntry("10.0.0.2", ContainerInfo{ID: "fresh"}, refreshAhead+refreshJitter+time.Second, false)
+	// Evicted: the container no longer exists.
+	addEntry("10.0.0.3", ContainerInfo{ID: "gone"}, time.Minute, true)
+	// Evicted: not used within the lifetime of its credentials.
+	addEntry("10.0.0.4", ContainerInfo{ID: "idle"}, time.Minute, false)
+	idle := cached["10.0.0.4"]
+	idle.lastUsed = now.Add(-2 * time.Hour)
+	cached["10.0.0.4"] = idle
+	// Host network containers are found by ID.
+	addEntry("10.0.0.10/hostnet", ContainerInfo{ID: "hostnet", HostNetwork: true}, time.Minute, false)
+	addEntry("10.0.0.10/hostnet-gone", ContainerInfo{ID: "hostnet-gone", HostNetwork: true}, time.Minute, true)
+	// Enough due entries to exceed refreshConcurrency.
+	for i := 0; i < 3*refreshConcurrency; i++ {
+		addEntry(fmt.Sprintf("10.0.1.%d", i), ContainerInfo{ID: fmt.Sprintf("busy-%d", i)}, time.Minute, false)
+	}
+
+	stsSvc := &refreshSTSStub{calls: make(map[string]int)}
+	c, err := newCredentialsProvider(stsSvc, containers, config, func(context.Context) (string, error) { return "", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.containerCredentials = cached
+
+	c.refreshExpiring(context.Background(), now)
+
+	for key, expected := range map[string]string{
+		"10.0.0.1":          "renewed",
+		"10.0.0.2":          "cached",
+		"10.0.0.10/hostnet": "renewed",
+		"10.0.1.0":          "renewed",
+	} {
+		creds, found := c.containerCredentials[key]
+		if !found {
+			t.Fatalf("expected entry [%s] to be kept", key)
+		}
+		if creds.AccessKey != expected {
+			t.Fatalf("expected entry [%s] to have key [%s], got [%s]", key, expected, creds.AccessKey)
+		}
+		if !creds.lastUsed.Equal(now.Add(-time.Minute)) {
+			t.Fatalf("expected entry [%s] to keep its last use, got [%s]", key, creds.lastUsed)
+		}
+	}
+
+	for _, key := range []string{"10.0.0.3", "10.0.0.4", "10.0.0.10/hostnet-gone"} {
+		if _, found := c.containerCredentials[key]; found {
+			t.Fatalf("expected entry [%s] to be evicted", key)
+		}
+	}
+
+	for _, id := range []string{"fresh", "idle"} {
+		if calls := stsSvc.calls[generateSessionName(ContainerRuntimeDocker, id)]; calls != 0 {
+			t.Fatalf("expected [%s] entry not to be renewed, got [%d] calls", id, calls)
+		}
+	}
+	if stsSvc.maxConcurrent > refreshConcurrency {
+		t.Fatalf("expected at most [%d] concurrent renewals, got [%d]", refreshConcurrency, stsSvc.maxConcurrent)
+	}
+	if stsSvc.maxConcurrent < 2 {
+		t.Fatalf("expected concurrent renewals, got [%d]", stsSvc.maxConcurrent)
+	}
+
+	// Requests served from the cache record their use.
+	if _, err := c.CredentialsForIP(context.Background(), "10.0.0.2"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if creds := c.containerCredentials["10.0.0.2"]; creds.AccessKey != "cached" || !creds.lastUsed.After(now) {
+		t.Fatalf("expected cached entry to record its use, got [%s] at [%s]", creds.AccessKey, creds.lastUsed)
+	}
+}
+
+// chainRefreshSTSStub records the roles it assumes, including with clients it creates for other
+// credentials.
+type chainRefreshSTSStub struct {
+	stsiface.STSAPI
+	calls *[]string
+}
+
+func (s chainRefreshSTSStub) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	*s.calls = append(*s.calls, *input.RoleArn)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("renewed"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func (s chainRefreshSTSStub) WithCredentials(accessKeyID, secretAccessKey, sessionToken string) stsiface.STSAPI {
+	return s
+}
+
+func TestRefreshChainLinks(t *testing.T) {
+	const (
+		broker  = "arn:aws:iam::210987654321:role/Broker"
+		fresh   = "arn:aws:iam::210987654321:role/Fresh"
+		removed = "arn:aws:iam::210987654321:role/Removed"
+	)
+	config := Config{
+		AliasToARN: map[string]string{
+			"db":      "arn:aws:iam::123456789012:role/SomethingDB",
+			"noperms": "arn:aws:iam::123456789012:role/NoPerms",
+		},
+		AliasOptions: map[string]AliasOptions{
+			"db":      AliasOptions{Via: []string{broker}},
+			"noperms": AliasOptions{Via: []string{fresh}},
+		},
+		DefaultAlias: "db",
+	}
+
+	var calls []string
+	containers := refreshContainerStub{byIP: make(map[string]ContainerInfo), byID: make(map[string]ContainerInfo)}
+	c, err := newCredentialsProvider(chainRefreshSTSStub{calls: &calls}, containers, config, func(context.Context) (string, error) { return "", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	addLink := func(arn string, expiresIn time.Duration) {
+		c.chainLinks[chainKey([]string{arn})] = chainLink{creds: credentials{AccessKey: "cached", Expiration: now.Add(expiresIn)}}
+	}
+	// Renewed regardless of jitter: within refreshAhead.
+	addLink(broker, refreshAhead-time.Second)
+	// Never renewed: beyond refreshAhead plus the maximum jitter.
+	addLink(fresh, refreshAhead+refreshJitter+time.Second)
+	// Evicted: no alias selects it.
+	addLink(removed, time.Hour)
+
+	c.refreshExpiring(context.Background(), now)
+
+	if len(calls) != 1 || calls[0] != broker {
+		t.Fatalf("expected only [%s] to be renewed, got %v", broker, calls)
+	}
+	for arn, expected := range map[string]string{broker: "renewed", fresh: "cached"} {
+		link, found := c.chainLinks[chainKey([]string{arn})]
+		if !found {
+			t.Fatalf("expected link [%s] to be kept", arn)
+		}
+		if link.creds.AccessKey != expected {
+			t.Fatalf("expected link [%s] to have key [%s], got [%s]", arn, expected, link.creds.AccessKey)
+		}
+	}
+	if _, found := c.chainLinks[chainKey([]string{removed})]; found {
+		t.Fatalf("expected link [%s] to be evicted", removed)
+	}
+}
+
+func TestSharedChainLinkCanceled(t *testing.T) {
+	const broker = "arn:aws:iam::210987654321:role/Broker"
+	config := Config{
+		AliasToARN:   map[string]string{"db": "arn:aws:iam::123456789012:role/SomethingDB"},
+		AliasOptions: map[string]AliasOptions{"db": AliasOptions{Via: []string{broker}}},
+		DefaultAlias: "db",
+	}
+
+	var calls []string
+	containers := refreshContainerStub{byIP: make(map[string]ContainerInfo), byID: make(map[string]ContainerInfo)}
+	c, err := newCredentialsProvider(chainRefreshSTSStub{calls: &calls}, containers, config, func(context.Context) (string, error) { return "", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The role is being assumed by another request, which never finishes.
+	c.chainInflight[chainKey([]string{broker})] = &chainCall{done: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.chainClient(ctx, []string{broker}, time.Now())
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to end with the context, got [%v]", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("expected no AssumeRole calls, got %v", calls)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// blockingAssumeRoleStub holds AssumeRole calls for selected roles until released, and counts
+// calls per role. Unlike assumeRoleStub, it is safe for concurrent use.
+type blockingAssumeRoleStub struct {
+	stsiface.STSAPI
+	block   map[string]chan struct{}
+	calls   map[string]int
+	started chan string
+	lock    sync.Mutex
+}
+
+func newBlockingAssumeRoleStub(blockedRoleARNs ...string) *blockingAssumeRoleStub {
+	s := &blockingAssumeRoleStub{
+		block:   make(map[string]chan struct{}),
+		calls:   make(map[string]int),
+		started: make(chan string, 100),
+	}
+	for _, arn := range blockedRoleARNs {
+		s.block[arn] = make(chan struct{})
+	}
+	return s
+}
+
+func (s *blockingAssumeRoleStub) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	s.lock.Lock()
+	s.calls[*input.RoleArn]++
+	block := s.block[*input.RoleArn]
+	s.lock.Unlock()
+
+	s.started <- *input.RoleArn
+	if block != nil {
+		<-block
+	}
+
+	return defaultAssumeRoleOutput(), nil
+}
+
+func (s *blockingAssumeRoleStub) Release(arn string) {
+	close(s.block[arn])
+}
+
+func (s *blockingAssumeRoleStub) Calls(arn string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[arn]
+}
+
+func TestCredentialsConcurrency(t *testing.T) {
+	t.Run("should share in-flight AssumeRole for the same container", func(t *testing.T) {
+		config := defaultConfig()
+		dbARN := config.AliasToARN["db"]
+		stsSvc := newBlockingAssumeRoleStub(dbARN)
+		h := newTestHandler(t, config, stsSvc)
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res := serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil)
+				codes <- res.Code
+			}()
+		}
+
+		<-stsSvc.started
+		time.Sleep(50 * time.Millisecond) // let the other requests reach the in-flight call
+		stsSvc.Release(dbARN)
+		wg.Wait()
+		close(codes)
+
+		for code := range codes {
+			if code != http.StatusOK {
+				t.Fatalf("expected HTTP code 200, got %d", code)
+			}
+		}
+		if calls := stsSvc.Calls(dbARN); calls != 1 {
+			t.Fatalf("expected 1 AssumeRole call, got %d", calls)
+		}
+	})
+
+	t.Run("should not block other containers during AssumeRole", func(t *testing.T) {
+		config := defaultConfig()
+		dbARN := config.AliasToARN["db"]
+		stsSvc := newBlockingAssumeRoleStub(dbARN)
+		h := newTestHandler(t, config, stsSvc)
+		defer stsSvc.Release(dbARN)
+
+		go serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil)
+		<-stsSvc.started
+
+		done := make(chan int)
+		go func() {
+			done <- serveRequest(h, "GET", defaultPathReq, defaultIP, nil).Code
+		}()
+
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Fatalf("expected HTTP code 200, got %d", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("request for another container was blocked by an in-flight AssumeRole")
+		}
+	})
+}
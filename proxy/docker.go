@@ -2,18 +2,28 @@ package proxy
 
 import (
 	"context"
-	"log"
 	"os"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/pkg/errors"
 )
 
 const runningState = "running"
 
+var (
+	// minWatchBackoff and maxWatchBackoff bound the delay between attempts to reconnect
+	// to the docker events stream.
+	minWatchBackoff = 1 * time.Second
+	maxWatchBackoff = 30 * time.Second
+)
+
 type dockerContainerInfo struct {
 	ContainerInfo
 	RefreshTime time.Time
@@ -21,21 +31,36 @@ type dockerContainerInfo struct {
 
 // DockerContainerService queries the Docker daemon and maintains a mapping of IPs
 // to container details.
+//
+// While Watch is connected to the daemon's event stream, the mapping is kept current from
+// container/network events and lookups are served from it without querying the daemon, except
+// to resync on a miss, ex. of a container whose start event is not handled yet.
 type DockerContainerService struct {
 	containerIPMap map[string]dockerContainerInfo
 	aliasToARN     map[string]string
 	docker         *client.Client
-	log            *log.Logger
+	log            *Logger
+	watching       bool
+	syncTime       time.Time
+	lock           sync.RWMutex
+
+	// syncLock serializes resyncs and event handling, so that a listing taken before an event
+	// cannot replace the mapping after the event is handled, ex. to resurrect a dead container.
+	syncLock sync.Mutex
+
+	// imageDigests caches the repo digests of images by image ID, which is content-addressed.
+	imageDigests     map[string][]string
+	imageDigestsLock sync.Mutex
 }
 
 // NewDockerContainerService creates a Docker specific ContainerService implementation.
-func NewDockerContainerService(config Config, logger *log.Logger) (*DockerContainerService, error) {
+func NewDockerContainerService(config Config, logger *Logger) (*DockerContainerService, error) {
 	if config.DockerHost != "" {
 		err := os.Setenv("DOCKER_HOST", config.DockerHost)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error setting DOCKER_HOST [%s]", config.DockerHost)
 		}
-		logger.Printf("DOCKER_HOST is now [%s]", config.DockerHost)
+		logger.Info("NewDockerContainerService: DOCKER_HOST is now set", "docker_host", config.DockerHost)
 	}
 
 	c, err := client.NewEnvClient()
@@ -45,6 +70,7 @@ func NewDockerContainerService(config Config, logger *log.Logger) (*DockerContai
 	return &DockerContainerService{
 		aliasToARN:     config.AliasToARN,
 		containerIPMap: make(map[string]dockerContainerInfo),
+		imageDigests:   make(map[string][]string),
 		docker:         c,
 		log:            logger,
 	}, nil
@@ -52,21 +78,68 @@ func NewDockerContainerService(config Config, logger *log.Logger) (*DockerContai
 
 // TypeName implements a ContainerService method.
 func (d *DockerContainerService) TypeName() string {
-	return "docker"
+	return ContainerRuntimeDocker
+}
+
+// ApplyConfig replaces the alias-to-ARN mapping, ex. after the config file changes, and
+// resyncs all containers so their roles reflect it.
+func (d *DockerContainerService) ApplyConfig(config Config) error {
+	d.lock.Lock()
+	d.aliasToARN = config.AliasToARN
+	d.lock.Unlock()
+
+	return d.syncContainers(context.Background(), time.Now())
+}
+
+// Containers implements a ContainerInventory method.
+func (d *DockerContainerService) Containers() []ContainerEntry {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	entries := make([]ContainerEntry, 0, len(d.containerIPMap))
+	for ip, info := range d.containerIPMap {
+		entries = append(entries, ContainerEntry{ContainerInfo: info.ContainerInfo, IP: ip, RefreshTime: info.RefreshTime})
+	}
+	return entries
+}
+
+// Resync implements a ContainerInventory method.
+func (d *DockerContainerService) Resync(ctx context.Context, containerID string) error {
+	if containerID == "" {
+		return d.syncContainers(ctx, time.Now())
+	}
+
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+	d.refreshContainer(ctx, containerID)
+	return nil
 }
 
 // ContainerForIP implements a ContainerService method.
 //
-// If ContainerInfo exists in the cache, keyed by the container IP, then it is returned.
+// If ContainerInfo exists in the cache, keyed by the container IP, then it is returned. If Watch
+// is connected to the event stream, cached entries are current and the daemon is not queried.
 // Otherwise syncContainer is used to collect fresh ContainerInfo from the docker API.
+//
+// On a cache miss, all containers are resynced. While watching, at most once per second.
 func (d *DockerContainerService) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	d.lock.RLock()
 	info, found := d.containerIPMap[containerIP]
+	watching := d.watching
+	syncTime := d.syncTime
+	d.lock.RUnlock()
+
 	now := time.Now()
 
 	if !found {
-		d.syncContainers(ctx, now)
-		info, found = d.containerIPMap[containerIP]
-	} else if now.After(info.RefreshTime) {
+		if !watching || now.After(refreshTime(syncTime)) {
+			if err := d.syncContainers(ctx, now); err == nil {
+				d.lock.RLock()
+				info, found = d.containerIPMap[containerIP]
+				d.lock.RUnlock()
+			}
+		}
+	} else if !watching && now.After(info.RefreshTime) {
 		info, found = d.syncContainer(ctx, containerIP, info, now)
 	}
 
@@ -77,90 +150,368 @@ func (d *DockerContainerService) ContainerForIP(ctx context.Context, containerIP
 	return info.ContainerInfo, nil
 }
 
+// Watch subscribes to the docker event stream and keeps the IP mapping current until the
+// context is canceled. After each (re)connection, a full resync replaces the mapping.
+//
+// If the stream disconnects, lookups fall back to querying the daemon until Watch reconnects.
+func (d *DockerContainerService) Watch(ctx context.Context) {
+	backoff := minWatchBackoff
+
+	for {
+		if d.watchEvents(ctx) {
+			backoff = minWatchBackoff
+		}
+
+		d.setWatching(false)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// watchEvents consumes a single event stream connection. It returns true if the stream
+// was established and the mapping resynced.
+func (d *DockerContainerService) watchEvents(ctx context.Context) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := filters.NewArgs()
+	args.Add("type", events.ContainerEventType)
+	args.Add("type", events.NetworkEventType)
+	for _, action := range []string{"start", "die", "destroy", "connect", "disconnect"} {
+		args.Add("event", action)
+	}
+
+	// Ask the daemon to replay events since the subscription time so that none are lost
+	// between the subscription and the resync below.
+	since := strconv.FormatInt(time.Now().Unix(), 10)
+	messages, errs := d.docker.Events(ctx, types.EventsOptions{Since: since, Filters: args})
+
+	if err := d.syncContainers(ctx, time.Now()); err != nil {
+		d.log.Error("Watch: Error resyncing containers after subscribing to events", logKeyError, err)
+		return false
+	}
+
+	d.setWatching(true)
+	dockerCallsTotal.Inc("events", resultSuccess)
+	d.log.Info("Watch: subscribed to docker events")
+
+	for {
+		select {
+		case msg := <-messages:
+			d.handleEvent(ctx, msg)
+		case err := <-errs:
+			if ctx.Err() == nil {
+				dockerCallsTotal.Inc("events", resultError)
+				d.log.Warn("Watch: docker event stream closed", logKeyError, err)
+			}
+			return true
+		}
+	}
+}
+
+func (d *DockerContainerService) setWatching(watching bool) {
+	d.lock.Lock()
+	d.watching = watching
+	d.lock.Unlock()
+}
+
+// handleEvent updates the mapping for the container that the event describes.
+func (d *DockerContainerService) handleEvent(ctx context.Context, msg events.Message) {
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+
+	switch msg.Type {
+	case events.ContainerEventType:
+		switch msg.Action {
+		case "start":
+			d.refreshContainer(ctx, msg.Actor.ID)
+		case "die", "destroy":
+			d.removeContainer(msg.Actor.ID)
+		}
+	case events.NetworkEventType:
+		// Network events identify the container in an attribute. The actor is the network.
+		if id := msg.Actor.Attributes["container"]; id != "" {
+			d.refreshContainer(ctx, id)
+		}
+	}
+}
+
+// refreshContainer replaces all mapping entries of the container with ones based on its current
+// state. The caller holds syncLock.
+func (d *DockerContainerService) refreshContainer(ctx context.Context, containerID string) {
+	container, err := d.inspect(ctx, containerID)
+	if err != nil {
+		if !client.IsErrContainerNotFound(err) {
+			d.log.Error("refreshContainer: Error inspecting container", logKeyContainerID, containerID, logKeyError, err)
+		}
+		d.removeContainer(containerID)
+		return
+	}
+
+	if container.State == nil || container.State.Status != runningState || container.Config == nil || container.NetworkSettings == nil {
+		d.removeContainer(containerID)
+		return
+	}
+
+	info, ok := d.newContainerInfo(d.log, container.ID, []string{container.Name}, container.Config.Image, container.Config.Labels)
+	if !ok {
+		d.removeContainer(containerID)
+		return
+	}
+	info.ImageDigests = d.resolveImageDigests(ctx, container.Image)
+
+	refreshAt := refreshTime(time.Now())
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.removeContainerLocked(containerID)
+	for _, ipAddress := range networkIPs(container.NetworkSettings.Networks) {
+		d.log.Debug("refreshContainer: indexed container",
+			logKeyContainerID, shortContainerID(container.ID),
+			"ip", ipAddress,
+			"image", container.Config.Image,
+			logKeyRoleARN, info.IamRole,
+		)
+		d.containerIPMap[ipAddress] = dockerContainerInfo{ContainerInfo: info, RefreshTime: refreshAt}
+	}
+}
+
+func (d *DockerContainerService) removeContainer(containerID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.removeContainerLocked(containerID)
+}
+
+func (d *DockerContainerService) removeContainerLocked(containerID string) {
+	for ip, info := range d.containerIPMap {
+		if info.ID == containerID {
+			delete(d.containerIPMap, ip)
+		}
+	}
+}
+
 func (d *DockerContainerService) syncContainer(ctx context.Context, containerIP string, oldInfo dockerContainerInfo, now time.Time) (dockerContainerInfo, bool) {
-	reqID := requestIDFromContext(ctx)
+	log := loggerFromContext(ctx, d.log)
 
-	container, err := d.docker.ContainerInspect(ctx, oldInfo.ID)
+	container, err := d.inspect(ctx, oldInfo.ID)
 
-	if err != nil || container.State.Status != runningState {
+	if err != nil || container.State == nil || container.State.Status != runningState {
 		if client.IsErrContainerNotFound(err) {
-			d.log.Printf("syncContainer (%s): container not found, refreshing container info [%s]", reqID, oldInfo.ID)
+			log.Info("syncContainer: container not found, refreshing container info", logKeyContainerID, oldInfo.ID)
 		} else {
-			d.log.Printf("syncContainer (%s): Error inspecting container, refreshing container info [%s]: %+v", reqID, oldInfo.ID, err)
+			log.Warn("syncContainer: Error inspecting container, refreshing container info", logKeyContainerID, oldInfo.ID, logKeyError, err)
+		}
+
+		if syncErr := d.syncContainers(ctx, now); syncErr != nil {
+			return dockerContainerInfo{}, false
 		}
 
-		d.syncContainers(ctx, now)
+		d.lock.RLock()
 		info, found := d.containerIPMap[containerIP]
+		d.lock.RUnlock()
 		return info, found
 	}
 
 	oldInfo.RefreshTime = refreshTime(now)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// The entry may have been removed or replaced while the container was inspected.
+	if current, found := d.containerIPMap[containerIP]; !found || current.ID != oldInfo.ID {
+		return current, found
+	}
 	d.containerIPMap[containerIP] = oldInfo
+
 	return oldInfo, true
 }
 
-func (d *DockerContainerService) syncContainers(ctx context.Context, now time.Time) {
-	reqID := requestIDFromContext(ctx)
+func (d *DockerContainerService) syncContainers(ctx context.Context, now time.Time) error {
+	log := loggerFromContext(ctx, d.log)
+
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
 
-	apiContainers, err := d.docker.ContainerList(ctx, types.ContainerListOptions{})
+	apiContainers, err := d.list(ctx)
 	if err != nil {
-		d.log.Printf("syncContainers (%s): Error listing running containers: %+v", reqID, err)
-		return
+		log.Error("syncContainers: Error listing running containers", logKeyError, err)
+		return errors.Wrap(err, "Error listing running containers")
 	}
 
 	refreshAt := refreshTime(now)
 	containerIPMap := make(map[string]dockerContainerInfo)
+	imageIDs := make(map[string]bool)
 
 	for _, container := range apiContainers {
 		if container.State != runningState {
 			continue
 		}
-		alias, ok := container.Labels[RoleLabelKey]
-		if !ok {
-			continue
-		}
 
 		var containerIPs []string
-		for _, net := range container.NetworkSettings.Networks {
-			if net.IPAddress != "" {
-				containerIPs = append(containerIPs, net.IPAddress)
-			}
-		}
-
-		if len(containerIPs) == 0 {
-			d.log.Printf("syncContainers (%s): no IP addresses discovered for container [%s]", reqID, container.ID)
-			continue
+		if container.NetworkSettings != nil {
+			containerIPs = networkIPs(container.NetworkSettings.Networks)
 		}
 
-		roleName, ok := d.aliasToARN[alias]
+		info, ok := d.newContainerInfo(log, container.ID, container.Names, container.Image, container.Labels)
 		if !ok {
-			d.log.Printf("syncContainers (%s): container [%s] %v has an unmapped role alias [%s]", reqID, container.ID, container.Names, alias)
 			continue
 		}
-		role, roleErr := NewRoleARN(roleName)
-		if roleErr != nil {
-			d.log.Printf("syncContainers (%s): Error creating new role ARN with invalid name [%s]: %+v", reqID, role, roleErr)
+		info.ImageDigests = d.resolveImageDigests(ctx, container.ImageID)
+		imageIDs[container.ImageID] = true
+
+		if len(containerIPs) == 0 {
+			log.Warn("syncContainers: no IP addresses discovered for container", logKeyContainerID, container.ID)
 			continue
 		}
 
 		for _, ipAddress := range containerIPs {
-			d.log.Printf("syncContainers (%s): id [%s] ip [%s] image [%s] role [%s]", reqID, container.ID[:6], ipAddress, container.Image, role)
+			log.Debug("syncContainers: indexed container",
+				logKeyContainerID, shortContainerID(container.ID),
+				"ip", ipAddress,
+				"image", container.Image,
+				logKeyRoleARN, info.IamRole,
+			)
 
 			containerIPMap[ipAddress] = dockerContainerInfo{
-				ContainerInfo: ContainerInfo{
-					ID:        container.ID,
-					Name:      strings.Join(container.Names, ","),
-					IamRole:   role,
-					IamPolicy: container.Labels[PolicyLabelKey],
-				},
-				RefreshTime: refreshAt,
+				ContainerInfo: info,
+				RefreshTime:   refreshAt,
 			}
 		}
 	}
 
+	d.lock.Lock()
 	d.containerIPMap = containerIPMap
+	d.syncTime = now
+	d.lock.Unlock()
+
+	// Forget the digests of images that no running container uses.
+	d.imageDigestsLock.Lock()
+	for imageID := range d.imageDigests {
+		if !imageIDs[imageID] {
+			delete(d.imageDigests, imageID)
+		}
+	}
+	d.imageDigestsLock.Unlock()
+
+	return nil
+}
+
+// resolveImageDigests returns the image ID and the image's repo digests. If the image cannot
+// be inspected, only the ID is returned, so that no repo digest pattern matches.
+func (d *DockerContainerService) resolveImageDigests(ctx context.Context, imageID string) []string {
+	if imageID == "" {
+		return nil
+	}
+
+	d.imageDigestsLock.Lock()
+	repoDigests, found := d.imageDigests[imageID]
+	d.imageDigestsLock.Unlock()
+
+	if !found {
+		image, _, err := d.docker.ImageInspectWithRaw(ctx, imageID)
+		dockerCallsTotal.Inc("image_inspect", callResult(err))
+		if err != nil {
+			loggerFromContext(ctx, d.log).Warn("resolveImageDigests: Error inspecting image", "image_id", imageID, logKeyError, err)
+			return []string{imageID}
+		}
+		repoDigests = image.RepoDigests
+
+		d.imageDigestsLock.Lock()
+		d.imageDigests[imageID] = repoDigests
+		d.imageDigestsLock.Unlock()
+	}
+
+	return append([]string{imageID}, repoDigests...)
+}
+
+// newContainerInfo resolves the role/policy selected in container labels with the current
+// alias-to-ARN mapping. It returns false if the container should not be indexed.
+func (d *DockerContainerService) newContainerInfo(log *Logger, id string, names []string, image string, labels map[string]string) (ContainerInfo, bool) {
+	d.lock.RLock()
+	aliasToARN := d.aliasToARN
+	d.lock.RUnlock()
+
+	return newContainerInfo(log, aliasToARN, id, names, image, labels)
+}
+
+// inspect wraps ContainerInspect to record metrics. A missing container is not an error.
+func (d *DockerContainerService) inspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	container, err := d.docker.ContainerInspect(ctx, containerID)
+	if err != nil && client.IsErrContainerNotFound(err) {
+		dockerCallsTotal.Inc("inspect", resultSuccess)
+	} else {
+		dockerCallsTotal.Inc("inspect", callResult(err))
+	}
+	return container, err
+}
+
+// ContainerForID implements a ContainerResolver method. The container is inspected, because
+// containers that share the host's network namespace are not in the IP mapping.
+func (d *DockerContainerService) ContainerForID(ctx context.Context, containerID string) (ContainerInfo, error) {
+	container, err := d.inspect(ctx, containerID)
+	if err != nil {
+		return ContainerInfo{}, errors.Wrapf(err, "Error inspecting container [%s]", containerID)
+	}
+	if container.State == nil || container.State.Status != runningState || container.Config == nil {
+		return ContainerInfo{}, errors.Errorf("Container [%s] is not running", containerID)
+	}
+
+	info, ok := d.newContainerInfo(loggerFromContext(ctx, d.log), container.ID, []string{container.Name}, container.Config.Image, container.Config.Labels)
+	if !ok {
+		return ContainerInfo{}, errors.Errorf("Container [%s] selects an unmapped role", containerID)
+	}
+	info.ImageDigests = d.resolveImageDigests(ctx, container.Image)
+	return info, nil
+}
+
+// Ping implements a ContainerPinger method.
+func (d *DockerContainerService) Ping(ctx context.Context) error {
+	_, err := d.docker.Ping(ctx)
+	dockerCallsTotal.Inc("ping", callResult(err))
+	return errors.Wrap(err, "Error pinging docker daemon")
+}
+
+// list wraps ContainerList to record metrics.
+func (d *DockerContainerService) list(ctx context.Context) ([]types.Container, error) {
+	containers, err := d.docker.ContainerList(ctx, types.ContainerListOptions{})
+	dockerCallsTotal.Inc("list", callResult(err))
+	return containers, err
+}
+
+// networkIPs returns the IPv4 and global IPv6 addresses of a container's networks, in the
+// canonical form of the client IPs that they are looked up by.
+func networkIPs(networks map[string]*network.EndpointSettings) []string {
+	var ips []string
+	for _, settings := range networks {
+		if settings == nil {
+			continue
+		}
+		for _, ip := range []string{settings.IPAddress, settings.GlobalIPv6Address} {
+			if ip != "" {
+				ips = append(ips, normalizeIP(ip))
+			}
+		}
+	}
+	return ips
 }
 
 func refreshTime(now time.Time) time.Time {
 	return now.Add(1 * time.Second)
 }
+
+func shortContainerID(id string) string {
+	if len(id) > 6 {
+		return id[:6]
+	}
+	return id
+}
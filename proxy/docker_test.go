@@ -2,8 +2,19 @@ package proxy_test
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/codeactual/ec2metaproxy/proxy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 	"github.com/pkg/errors"
 )
 
@@ -12,7 +23,8 @@ type ipContainerInfo map[string]proxy.ContainerInfo
 
 // containerServiceStub queries its ContainerInfo map instead of the Docker daemon.
 type containerServiceStub struct {
-	info ipContainerInfo
+	info     ipContainerInfo
+	resynced []string
 }
 
 func (c *containerServiceStub) ContainerForIP(ctx context.Context, containerIP string) (proxy.ContainerInfo, error) {
@@ -23,11 +35,402 @@ func (c *containerServiceStub) ContainerForIP(ctx context.Context, containerIP s
 	return i, nil
 }
 
+func (c *containerServiceStub) ContainerForID(ctx context.Context, containerID string) (proxy.ContainerInfo, error) {
+	for _, i := range c.info {
+		if i.ID == containerID {
+			return i, nil
+		}
+	}
+	return proxy.ContainerInfo{}, errors.Errorf("No container found for ID [%s]", containerID)
+}
+
 func (c *containerServiceStub) TypeName() string {
 	return "docker"
 }
 
+func (c *containerServiceStub) Containers() []proxy.ContainerEntry {
+	var entries []proxy.ContainerEntry
+	for ip, info := range c.info {
+		entries = append(entries, proxy.ContainerEntry{ContainerInfo: info, IP: ip})
+	}
+	return entries
+}
+
+func (c *containerServiceStub) Resync(ctx context.Context, containerID string) error {
+	c.resynced = append(c.resynced, containerID)
+	return nil
+}
+
 // newDockerContainerServiceStub creates a service stub backed by the chosen info.
 func newDockerContainerServiceStub(info ipContainerInfo) *containerServiceStub {
 	return &containerServiceStub{info: info}
 }
+
+// dockerDaemonStub serves the subset of the Docker remote API used by DockerContainerService.
+type dockerDaemonStub struct {
+	containers map[string]types.ContainerJSON
+	images     map[string]types.ImageInspect
+	events     chan events.Message
+	listCalls  int
+	lock       sync.Mutex
+
+	// If holdList is set, list responses signal listHeld after the list is taken, and are
+	// then delayed until holdList is closed.
+	holdList chan struct{}
+	listHeld chan struct{}
+}
+
+func newDockerDaemonStub() *dockerDaemonStub {
+	return &dockerDaemonStub{
+		containers: make(map[string]types.ContainerJSON),
+		images:     make(map[string]types.ImageInspect),
+		events:     make(chan events.Message),
+	}
+}
+
+// SetContainer adds or replaces a container with a single network.
+func (d *dockerDaemonStub) SetContainer(id, state, ip string, labels map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.containers[id] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  "/" + id,
+			Image: "sha256:" + id,
+			State: &types.ContainerState{Status: state},
+		},
+		Config: &container.Config{Image: "image-" + id, Labels: labels},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: map[string]*network.EndpointSettings{"bridge": {IPAddress: ip}},
+		},
+	}
+}
+
+// SetImage adds or replaces the image of the container.
+func (d *dockerDaemonStub) SetImage(containerID string, repoDigests []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.images["sha256:"+containerID] = types.ImageInspect{ID: "sha256:" + containerID, RepoDigests: repoDigests}
+}
+
+func (d *dockerDaemonStub) ListCalls() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.listCalls
+}
+
+func (d *dockerDaemonStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if i := strings.Index(path[1:], "/"); strings.HasPrefix(path, "/v") && i >= 0 {
+		path = path[i+1:]
+	}
+
+	switch {
+	case path == "/containers/json":
+		d.lock.Lock()
+		d.listCalls++
+		var list []types.Container
+		for _, c := range d.containers {
+			if c.State.Status != "running" {
+				continue
+			}
+			list = append(list, types.Container{
+				ID:              c.ID,
+				Names:           []string{c.Name},
+				Image:           c.Config.Image,
+				ImageID:         c.Image,
+				Labels:          c.Config.Labels,
+				State:           c.State.Status,
+				NetworkSettings: &types.SummaryNetworkSettings{Networks: c.NetworkSettings.Networks},
+			})
+		}
+		holdList, listHeld := d.holdList, d.listHeld
+		d.lock.Unlock()
+		if holdList != nil {
+			listHeld <- struct{}{}
+			<-holdList
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+		d.lock.Lock()
+		c, ok := d.containers[id]
+		d.lock.Unlock()
+		if !ok {
+			http.Error(w, `{"message":"No such container: `+id+`"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(c)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		d.lock.Lock()
+		image, ok := d.images[id]
+		d.lock.Unlock()
+		if !ok {
+			http.Error(w, `{"message":"No such image: `+id+`"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(image)
+	case path == "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg := <-d.events:
+				_ = enc.Encode(msg)
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newWatchedDockerContainerService connects a DockerContainerService to the daemon stub and
+// returns once the event stream is established.
+func newWatchedDockerContainerService(t *testing.T, ctx context.Context, daemon *dockerDaemonStub) *proxy.DockerContainerService {
+	server := httptest.NewServer(daemon)
+	go func() {
+		<-ctx.Done()
+		server.CloseClientConnections()
+		server.Close()
+	}()
+
+	config := defaultConfig()
+	config.DockerHost = "tcp://" + server.Listener.Addr().String()
+
+	svc, err := proxy.NewDockerContainerService(config, newLogger().logger)
+	fatalOnErr(t, err)
+
+	go svc.Watch(ctx)
+
+	// Lookups stop triggering a list operation once the events stream is established.
+	waitFor(t, func() bool {
+		before := daemon.ListCalls()
+		_, _ = svc.ContainerForIP(ctx, "10.0.0.1")
+		return before > 0 && daemon.ListCalls() == before
+	})
+
+	return svc
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDockerContainerService(t *testing.T) {
+	t.Run("should update cache from events without listing containers", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+		listCalls := daemon.ListCalls()
+
+		info, err := svc.ContainerForIP(ctx, "172.30.0.2")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{"c1", info.ID},
+			[2]string{dbRoleARNFriendlyName, info.IamRole.RoleName()},
+		})
+
+		daemon.SetContainer("c2", "running", "172.30.0.3", map[string]string{proxy.RoleLabelKey: "noperms"})
+		daemon.events <- events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "c2"}}
+		waitFor(t, func() bool {
+			_, err := svc.ContainerForIP(ctx, "172.30.0.3")
+			return err == nil
+		})
+
+		daemon.SetContainer("c1", "exited", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		daemon.events <- events.Message{Type: "container", Action: "die", Actor: events.Actor{ID: "c1"}}
+		waitFor(t, func() bool {
+			_, err := svc.ContainerForIP(ctx, "172.30.0.2")
+			return err != nil
+		})
+
+		if daemon.ListCalls() != listCalls {
+			t.Fatalf("expected no list calls after events subscription, got %d", daemon.ListCalls()-listCalls)
+		}
+	})
+
+	t.Run("should resync on a miss before the start event is handled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		// No start event is sent, ex. because it is still queued behind others.
+		daemon.SetContainer("c2", "running", "172.30.0.3", map[string]string{proxy.RoleLabelKey: "noperms"})
+		waitFor(t, func() bool {
+			info, err := svc.ContainerForIP(ctx, "172.30.0.3")
+			return err == nil && info.ID == "c2"
+		})
+
+		// Misses resync at most once per second.
+		listCalls := daemon.ListCalls()
+		for i := 0; i < 3; i++ {
+			if _, err := svc.ContainerForIP(ctx, "172.30.0.4"); err == nil {
+				t.Fatal("expected error for unknown IP")
+			}
+		}
+		if daemon.ListCalls() > listCalls+1 {
+			t.Fatalf("expected at most 1 list call, got %d", daemon.ListCalls()-listCalls)
+		}
+	})
+
+	t.Run("should index container without role label", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.PolicyLabelKey: defaultPolicy})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		info, err := svc.ContainerForIP(ctx, "172.30.0.2")
+		fatalOnErr(t, err)
+		if !info.IamRole.Empty() {
+			t.Fatalf("expected empty role, got [%s]", info.IamRole)
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"c1", info.ID},
+			[2]string{defaultPolicy, info.IamPolicy},
+		})
+	})
+
+	t.Run("should index IPv6 addresses", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		daemon.containers["c1"].NetworkSettings.Networks["bridge"].GlobalIPv6Address = "fd00:0:0:0::2"
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		for _, ip := range []string{"172.30.0.2", "fd00::2"} {
+			info, err := svc.ContainerForIP(ctx, ip)
+			fatalOnErr(t, err)
+			stringsEqual(t, [][2]string{[2]string{"c1", info.ID}})
+		}
+	})
+
+	t.Run("should resync a container on demand", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		// No event announces the new IP.
+		daemon.SetContainer("c1", "running", "172.31.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		fatalOnErr(t, svc.Resync(ctx, "c1"))
+
+		entries := svc.Containers()
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 entry, got [%d]", len(entries))
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"c1", entries[0].ID},
+			[2]string{"172.31.0.2", entries[0].IP},
+			[2]string{dbRoleARNFriendlyName, entries[0].IamRole.RoleName()},
+		})
+	})
+
+	t.Run("should not resurrect a container that dies during a resync", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		holdList := make(chan struct{})
+		daemon.lock.Lock()
+		daemon.holdList, daemon.listHeld = holdList, make(chan struct{})
+		listHeld := daemon.listHeld
+		daemon.lock.Unlock()
+
+		resynced := make(chan error)
+		go func() { resynced <- svc.Resync(ctx, "") }()
+		<-listHeld
+
+		// The listing still includes the container.
+		daemon.SetContainer("c1", "exited", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		daemon.events <- events.Message{Type: "container", Action: "die", Actor: events.Actor{ID: "c1"}}
+
+		close(holdList)
+		fatalOnErr(t, <-resynced)
+
+		waitFor(t, func() bool {
+			_, err := svc.ContainerForIP(ctx, "172.30.0.2")
+			return err != nil
+		})
+	})
+
+	t.Run("should resolve image digests", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		daemon.SetImage("c1", []string{"example/db@sha256:9f3b"})
+		daemon.SetContainer("c2", "running", "172.30.0.3", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		info, err := svc.ContainerForIP(ctx, "172.30.0.2")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{"sha256:c1,example/db@sha256:9f3b", strings.Join(info.ImageDigests, ",")}})
+
+		// Images that cannot be inspected have no repo digests.
+		info, err = svc.ContainerForIP(ctx, "172.30.0.3")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{"sha256:c2", strings.Join(info.ImageDigests, ",")}})
+
+		info, err = svc.ContainerForID(ctx, "c1")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{"sha256:c1,example/db@sha256:9f3b", strings.Join(info.ImageDigests, ",")}})
+	})
+
+	t.Run("should update cache from network events", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := newDockerDaemonStub()
+		daemon.SetContainer("c1", "running", "172.30.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+
+		svc := newWatchedDockerContainerService(t, ctx, daemon)
+
+		daemon.SetContainer("c1", "running", "172.31.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		daemon.events <- events.Message{
+			Type:   "network",
+			Action: "connect",
+			Actor:  events.Actor{ID: "network-id", Attributes: map[string]string{"container": "c1"}},
+		}
+		waitFor(t, func() bool {
+			_, oldErr := svc.ContainerForIP(ctx, "172.30.0.2")
+			_, newErr := svc.ContainerForIP(ctx, "172.31.0.2")
+			return oldErr != nil && newErr == nil
+		})
+	})
+}
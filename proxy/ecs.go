@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ecsCredentialsPathPrefix selects requests from the ECS credential provider of AWS SDKs, which
+// requests http://169.254.170.2$AWS_CONTAINER_CREDENTIALS_RELATIVE_URI. Any path under the prefix
+// is accepted because the container is identified by its IP, not the path.
+const ecsCredentialsPathPrefix = "/v2/credentials/"
+
+// ECSCredentials fields are returned in ECS container credentials responses as JSON.
+type ECSCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+	RoleArn         string
+}
+
+// isECSCredentialsPath returns true if the path selects the ECS container credentials endpoint.
+func isECSCredentialsPath(path string) bool {
+	return strings.HasPrefix(path, ecsCredentialsPathPrefix)
+}
+
+// HandleECSCredentials responds to ECS container credentials requests identified in ServeHTTP.
+//
+// If the container defines an authorization token, the request's Authorization header
+// (set by SDKs from AWS_CONTAINER_AUTHORIZATION_TOKEN) must match it.
+func (p *Proxy) HandleECSCredentials(c *credentialsProvider, w http.ResponseWriter, r *http.Request) {
+	clientIP := remoteIP(r.RemoteAddr)
+	ctx := r.Context()
+	log := loggerFromContext(ctx, p.log)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	container, err := c.container.ContainerForIP(ctx, clientIP)
+	if isAccessDenied(err) {
+		log.Warn("HandleECSCredentials: Denied container", logKeyError, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("HandleECSCredentials: Error finding container", logKeyError, err)
+		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+		return
+	}
+
+	if container.AuthorizationToken != "" {
+		authorization := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte(container.AuthorizationToken)) != 1 {
+			log.Warn("HandleECSCredentials: Rejected invalid authorization token", logKeyContainerID, container.ID)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	credentials, err := c.CredentialsForContainer(ctx, clientIP, container)
+
+	if isAccessDenied(err) {
+		log.Warn("HandleECSCredentials: Denied credentials", logKeyContainerID, container.ID, logKeyError, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("HandleECSCredentials: Error getting credentials", logKeyContainerID, container.ID, logKeyError, err)
+		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+		return
+	}
+
+	setCredentialsRole(w, credentials)
+
+	creds, err := json.Marshal(&ECSCredentials{
+		AccessKeyID:     credentials.AccessKey,
+		SecretAccessKey: credentials.SecretKey,
+		Token:           credentials.Token,
+		Expiration:      credentials.Expiration,
+		RoleArn:         credentials.RoleArn.String(),
+	})
+	if err != nil {
+		log.Error("HandleECSCredentials: Error marshaling credentials", logKeyError, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	p.auditCredentials(log, requestIDFromContext(ctx), clientIP, credentials)
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, writeErr := w.Write(creds); writeErr != nil {
+		log.Warn("HandleECSCredentials: Error writing credentials to response", logKeyError, writeErr)
+	}
+
+	log.Debug("HandleECSCredentials: proxy response", "path", r.URL.Path, logKeyContainerID, credentials.Container.ID, logKeyRoleARN, credentials.RoleArn)
+}
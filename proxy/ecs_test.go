@@ -0,0 +1,93 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+// lookupCounter counts the ContainerForIP calls of the wrapped service.
+type lookupCounter struct {
+	proxy.ContainerService
+	lookups int
+}
+
+func (l *lookupCounter) ContainerForIP(ctx context.Context, containerIP string) (proxy.ContainerInfo, error) {
+	l.lookups++
+	return l.ContainerService.ContainerForIP(ctx, containerIP)
+}
+
+func TestECSCredentials(t *testing.T) {
+	t.Run("should return credentials in ECS format", func(t *testing.T) {
+		config := defaultConfig()
+		stsSvc := defaultStsSvcStub()
+		h := newTestHandler(t, config, stsSvc)
+
+		res := serveRequest(h, "GET", "/v2/credentials/any-id", defaultIP, nil)
+		responseCodeIs(t, res, 200)
+
+		var c proxy.ECSCredentials
+		fatalOnErr(t, json.NewDecoder(res.Body).Decode(&c))
+
+		expectedCreds := defaultCreds()
+		stringsEqual(t, [][2]string{
+			[2]string{*expectedCreds.AccessKeyId, c.AccessKeyID},
+			[2]string{*expectedCreds.SecretAccessKey, c.SecretAccessKey},
+			[2]string{*expectedCreds.SessionToken, c.Token},
+			[2]string{stsSvc.output.Credentials.Expiration.String(), c.Expiration.String()},
+			[2]string{config.AliasToARN["noperms"], c.RoleArn},
+			[2]string{"application/json", res.Header().Get("Content-Type")},
+		})
+		assumeRoleAliasIs(t, "noperms", config, stsSvc)
+	})
+
+	t.Run("should require authorization token if container defines one", func(t *testing.T) {
+		config := defaultConfig()
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		res := serveRequest(h, "GET", "/v2/credentials/any-id", ipWithAllLabels, nil)
+		responseCodeIs(t, res, 401)
+
+		res = serveRequest(h, "GET", "/v2/credentials/any-id", ipWithAllLabels, map[string]string{
+			"Authorization": "invalid",
+		})
+		responseCodeIs(t, res, 401)
+
+		res = serveRequest(h, "GET", "/v2/credentials/any-id", ipWithAllLabels, map[string]string{
+			"Authorization": defaultAuthorizationToken,
+		})
+		responseCodeIs(t, res, 200)
+	})
+
+	t.Run("should not require IMDSv2 token", func(t *testing.T) {
+		config := defaultConfig()
+		config.HTTPTokens = proxy.HTTPTokensRequired
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		res := serveRequest(h, "GET", "/v2/credentials/any-id", defaultIP, nil)
+		responseCodeIs(t, res, 200)
+	})
+
+	t.Run("should look up the container once", func(t *testing.T) {
+		containers := &lookupCounter{ContainerService: defaultContainerSvcStub()}
+		p, err := proxy.New(defaultConfig(), roundTripperStub{}, defaultStsSvcStub(), containers, newLogger().logger)
+		fatalOnErr(t, err)
+		h := proxy.RequestID(p)
+
+		res := serveRequest(h, "GET", "/v2/credentials/any-id", defaultIP, nil)
+		responseCodeIs(t, res, 200)
+
+		if containers.lookups != 1 {
+			t.Fatalf("expected 1 container lookup, got [%d]", containers.lookups)
+		}
+	})
+
+	t.Run("should reject non-GET method", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		res := serveRequest(h, "POST", "/v2/credentials/any-id", defaultIP, nil)
+		responseCodeIs(t, res, 405)
+	})
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+)
+
+const (
+	readinessCheckMetadata = "metadata"
+	readinessCheckSTS      = "sts"
+	readinessCheckOK       = "ok"
+)
+
+var (
+	// readinessCacheTTL is how long a readiness result is reused, so that frequent health checks
+	// do not create load on the container platform, the metadata service and STS.
+	readinessCacheTTL = 10 * time.Second
+	// readinessCheckTimeout bounds each dependency check.
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// Readiness is the response of HandleReadyz.
+type Readiness struct {
+	Ready     bool      `json:"ready"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// Checks maps each dependency, ex. "docker", to "ok" or an error message.
+	Checks map[string]string `json:"checks"`
+}
+
+// readinessCache holds the most recent Readiness. Its lock is held while checks run, so that
+// concurrent health checks share one result.
+type readinessCache struct {
+	readiness Readiness
+	lock      sync.Mutex
+}
+
+// HandleHealthz responds with 200 while the process is serving requests.
+func (p *Proxy) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	if _, err := w.Write([]byte(readinessCheckOK)); err != nil {
+		p.log.Warn("HandleHealthz: Error writing response", logKeyError, err)
+	}
+}
+
+// HandleReadyz responds with 200 if the proxy can serve credentials: the container platform,
+// ex. the docker daemon, answers pings (if the ContainerService implements ContainerPinger),
+// the upstream metadata service is reachable, and STS GetCallerIdentity succeeds with the
+// instance credentials.
+// Otherwise it responds with 503. Both include the result of each check.
+func (p *Proxy) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := p.readiness(time.Now())
+
+	code := http.StatusOK
+	if !readiness.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	p.writeAdminJSON(w, code, readiness)
+}
+
+// readiness returns the cached Readiness, or checks the dependencies if it is older than
+// readinessCacheTTL.
+func (p *Proxy) readiness(now time.Time) Readiness {
+	p.ready.lock.Lock()
+	defer p.ready.lock.Unlock()
+
+	if !p.ready.readiness.CheckedAt.IsZero() && now.Sub(p.ready.readiness.CheckedAt) < readinessCacheTTL {
+		return p.ready.readiness
+	}
+
+	checks := map[string]func(context.Context) error{
+		readinessCheckMetadata: p.checkMetadata,
+		readinessCheckSTS:      p.checkSTS,
+	}
+	if pinger, ok := p.credsProvider.container.(ContainerPinger); ok {
+		checks[p.credsProvider.container.TypeName()] = pinger.Ping
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check func(context.Context) error) {
+			results <- result{name: name, err: check(ctx)}
+		}(name, check)
+	}
+
+	readiness := Readiness{Ready: true, CheckedAt: now, Checks: make(map[string]string, len(checks))}
+	for range checks {
+		res := <-results
+		readiness.Checks[res.name] = readinessCheckOK
+		if res.err != nil {
+			readiness.Ready = false
+			readiness.Checks[res.name] = res.err.Error()
+			p.log.Warn("readiness: check failed", "check", res.name, logKeyError, res.err)
+		}
+	}
+
+	p.ready.readiness = readiness
+	return readiness
+}
+
+// checkMetadata requests the metadata index from the upstream metadata service.
+func (p *Proxy) checkMetadata(ctx context.Context) error {
+	req, err := http.NewRequest("GET", p.metadataURL()+"/latest/meta-data/", nil)
+	if err != nil {
+		return errors.Wrap(err, "Error creating metadata request")
+	}
+
+	resp, err := p.roundTripUpstream(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "Error requesting metadata")
+	}
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		p.log.Warn("checkMetadata: Error closing response body", logKeyError, closeErr)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Metadata request returned code [%d]", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkSTS calls GetCallerIdentity, which requires no permissions, with the instance credentials.
+func (p *Proxy) checkSTS(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.credsProvider.awsSts.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return errors.Wrap(err, "Error calling STS GetCallerIdentity")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "Error waiting for STS GetCallerIdentity")
+	}
+}
@@ -0,0 +1,81 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+	"github.com/pkg/errors"
+)
+
+// pingingContainerServiceStub adds a ContainerPinger implementation to containerServiceStub.
+type pingingContainerServiceStub struct {
+	*containerServiceStub
+	err error
+}
+
+func (c pingingContainerServiceStub) Ping(ctx context.Context) error {
+	return c.err
+}
+
+func readiness(t *testing.T, p *proxy.Proxy, expectedCode int) proxy.Readiness {
+	res := serveAdminRequest(p, "GET", "/readyz")
+	responseCodeIs(t, res, expectedCode)
+
+	var r proxy.Readiness
+	fatalOnErr(t, json.NewDecoder(res.Body).Decode(&r))
+	return r
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("should report process health", func(t *testing.T) {
+		p := newAdminTestProxy(t, defaultContainerSvcStub())
+		responseCodeIs(t, serveAdminRequest(p, "GET", "/healthz"), 200)
+	})
+
+	t.Run("should report readiness from cached checks", func(t *testing.T) {
+		stsSvc := defaultStsSvcStub()
+		httpClient := roundTripperStub{res: &http.Response{Body: ioutil.NopCloser(strings.NewReader("")), StatusCode: 200}}
+		containerSvc := pingingContainerServiceStub{containerServiceStub: defaultContainerSvcStub()}
+		p, err := proxy.New(defaultConfig(), httpClient, stsSvc, containerSvc, newLogger().logger)
+		fatalOnErr(t, err)
+
+		r := readiness(t, p, 200)
+		if !r.Ready {
+			t.Fatalf("expected ready, got [%+v]", r)
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"ok", r.Checks["docker"]},
+			[2]string{"ok", r.Checks["metadata"]},
+			[2]string{"ok", r.Checks["sts"]},
+		})
+
+		readiness(t, p, 200)
+		if stsSvc.callerIdentityCalls != 1 {
+			t.Fatalf("expected 1 GetCallerIdentity call, got [%d]", stsSvc.callerIdentityCalls)
+		}
+	})
+
+	t.Run("should report unavailable dependencies", func(t *testing.T) {
+		stsSvc := defaultStsSvcStub()
+		stsSvc.callerIdentityErr = errors.New("ExpiredToken")
+		httpClient := roundTripperStub{res: &http.Response{Body: ioutil.NopCloser(strings.NewReader("")), StatusCode: 500}}
+		containerSvc := pingingContainerServiceStub{containerServiceStub: defaultContainerSvcStub(), err: errors.New("daemon down")}
+		p, err := proxy.New(defaultConfig(), httpClient, stsSvc, containerSvc, newLogger().logger)
+		fatalOnErr(t, err)
+
+		r := readiness(t, p, 503)
+		if r.Ready {
+			t.Fatalf("expected not ready, got [%+v]", r)
+		}
+		for check, expected := range map[string]string{"docker": "daemon down", "metadata": "[500]", "sts": "ExpiredToken"} {
+			if !strings.Contains(r.Checks[check], expected) {
+				t.Fatalf("expected check [%s] to contain [%s], got [%s]", check, expected, r.Checks[check])
+			}
+		}
+	})
+}
@@ -0,0 +1,644 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultProcRoot = "/proc"
+
+	// procTCPListen is the /proc/net/tcp state of listening sockets.
+	procTCPListen = "0A"
+
+	// socketOwnerTTL is how long the owner process and container of a socket inode are cached.
+	socketOwnerTTL = time.Minute
+	// maxSocketOwners limits the number of cached socket owners, and of host network containers.
+	maxSocketOwners = 4096
+
+	// hostRefreshInterval is how long host network containers found by ID, and the addresses of
+	// the host's interfaces, are cached.
+	hostRefreshInterval = 10 * time.Second
+)
+
+// metadataPeerAddrs are the addresses of the metadata service, which are the peers of client
+// sockets whose connections are redirected to the proxy by a DNAT rule.
+var metadataPeerAddrs = []string{"169.254.169.254:80", "[fd00:ec2::254]:80"}
+
+// cgroupContainerIDRegexp matches the docker container ID in a /proc/<pid>/cgroup line, ex.
+// "12:pids:/docker/<id>" (cgroupfs driver) or "0::/system.slice/docker-<id>.scope" (systemd driver).
+var cgroupContainerIDRegexp = regexp.MustCompile(`docker[-/]([0-9a-f]{64})(?:\.scope)?`)
+
+// cgroupIDRegexp matches a container ID in a cgroup path, ex. of a containerd, CRI-O or podman
+// container: "/system.slice/cri-containerd-<id>.scope" or "/machine.slice/libpod-<id>.scope".
+var cgroupIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// hostCgroupSlices are the systemd slices of system services and user sessions. Processes in
+// them, or in the root cgroup, are host processes unless their cgroup holds a container ID.
+var hostCgroupSlices = []string{"/system.slice", "/user.slice"}
+
+// HostNetworkConfig selects how containers that share the host's network namespace are identified.
+type HostNetworkConfig struct {
+	// Enabled identifies the container of each request from one of the host's own IPs by the
+	// process that owns the client socket. The proxy must run in the host's network and PID
+	// namespaces.
+	Enabled bool `json:"enabled"`
+	// ProcRoot is the procfs mount of the host's PID namespace. Defaults to "/proc". It is also
+	// used to find the users of host processes, if HostUsers are mapped.
+	ProcRoot string `json:"procRoot"`
+	// HostIPs holds the host's own IPs. Defaults to the addresses of the host's interfaces.
+	HostIPs []string `json:"hostIPs"`
+}
+
+func (h *HostNetworkConfig) validate() error {
+	if h.ProcRoot == "" {
+		h.ProcRoot = defaultProcRoot
+	}
+	for i, ip := range h.HostIPs {
+		if net.ParseIP(normalizeIP(ip)) == nil {
+			return errors.Errorf("Config file selected an invalid 'hostNetwork.hostIPs' value [%s].", ip)
+		}
+		h.HostIPs[i] = normalizeIP(ip)
+	}
+	return nil
+}
+
+type clientConnContextKey struct{}
+
+// clientConn describes the connection of a request. Its client socket is found at most once per
+// request, although the request's container may be looked up several times, ex. to validate an
+// IMDSv2 token and then to select credentials.
+type clientConn struct {
+	// addr is the "host:port" address of the client.
+	addr string
+	// localAddr is the "host:port" address of the proxy that accepted the connection, if known.
+	localAddr string
+
+	once   sync.Once
+	socket procSocket
+	err    error
+}
+
+// contextWithClientConn returns a copy of the context that holds the client and local
+// "host:port" addresses of the request's connection.
+func contextWithClientConn(ctx context.Context, addr, localAddr string) context.Context {
+	return context.WithValue(ctx, clientConnContextKey{}, &clientConn{addr: addr, localAddr: localAddr})
+}
+
+func clientConnFromContext(ctx context.Context) (*clientConn, bool) {
+	conn, ok := ctx.Value(clientConnContextKey{}).(*clientConn)
+	return conn, ok
+}
+
+// socketOwner is a cached owner process of a socket inode, and the process' container ID.
+type socketOwner struct {
+	pid         string
+	containerID string
+	expiration  time.Time
+}
+
+// hostContainerInfo is a cached host network container.
+type hostContainerInfo struct {
+	ContainerInfo
+	RefreshTime time.Time
+}
+
+// HostNetworkContainerService identifies the clients whose requests come from the host's own
+// IPs: containers that share the host's network namespace, ex. monitoring agents run with
+// `--net=host`, if HostNetwork is enabled, and processes that run directly on the host, if
+// HostUsers are mapped. Requests from other IPs are passed to the wrapped ContainerService.
+//
+// The client socket of a request from a host IP is found in /proc/net/tcp and tcp6, its owner
+// process by the socket links in /proc/<pid>/fd, and the process' container by its cgroup.
+// The container is then found by ID with the wrapped ContainerResolver. Processes in host
+// cgroups are identified by the socket's UID instead, and processes in other containers, ex.
+// containerd's, are denied.
+type HostNetworkContainerService struct {
+	ContainerService
+	resolver ContainerResolver
+	config   HostNetworkConfig
+	log      *Logger
+
+	// users and aliasToARN are replaced by ApplyConfig.
+	users      HostUsersConfig
+	aliasToARN map[string]string
+	lock       sync.RWMutex
+
+	// owners caches socketOwners by socket inode, so that the processes' file descriptors are
+	// not walked for each request of a kept-alive connection.
+	owners     map[string]socketOwner
+	ownersLock sync.Mutex
+
+	// containers caches host network containers by ID, and interfaceIPs the addresses of the
+	// host's interfaces, until their RefreshTime, so that each request does not query them.
+	containers       map[string]hostContainerInfo
+	interfaceIPs     []string
+	interfaceRefresh time.Time
+	cacheLock        sync.Mutex
+}
+
+// NewHostNetworkContainerService wraps a ContainerService. If HostNetwork is enabled, the
+// service must implement ContainerResolver.
+func NewHostNetworkContainerService(config Config, svc ContainerService, logger *Logger) (*HostNetworkContainerService, error) {
+	resolver, ok := svc.(ContainerResolver)
+	if !ok && config.HostNetwork.Enabled {
+		return nil, errors.Errorf("Container service [%s] cannot find containers by ID for 'hostNetwork'", svc.TypeName())
+	}
+
+	hostConfig := config.HostNetwork
+	if err := hostConfig.validate(); err != nil {
+		return nil, err
+	}
+	users := config.HostUsers
+	if err := users.validate(config.AliasToARN); err != nil {
+		return nil, err
+	}
+
+	return &HostNetworkContainerService{
+		ContainerService: svc,
+		resolver:         resolver,
+		config:           hostConfig,
+		log:              logger,
+		users:            users,
+		aliasToARN:       config.AliasToARN,
+		owners:           make(map[string]socketOwner),
+		containers:       make(map[string]hostContainerInfo),
+	}, nil
+}
+
+// ContainerForIP implements a ContainerService method.
+//
+// If the IP is one of the host's own, the container or host user is identified by the client
+// socket of the request in the context.
+func (h *HostNetworkContainerService) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	hostIP, err := h.isHostIP(containerIP)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	if !hostIP {
+		return h.ContainerService.ContainerForIP(ctx, containerIP)
+	}
+
+	conn, ok := clientConnFromContext(ctx)
+	if !ok || remoteIP(conn.addr) != containerIP {
+		return ContainerInfo{}, errors.Errorf("No client connection found for host IP [%s]", containerIP)
+	}
+	addr := conn.addr
+
+	conn.once.Do(func() {
+		conn.socket, conn.err = h.socket(conn.addr, conn.localAddr)
+	})
+	if conn.err != nil {
+		return ContainerInfo{}, errors.Wrapf(conn.err, "Error identifying host client [%s]", addr)
+	}
+	socket := conn.socket
+
+	pid, containerID, err := h.socketProcess(socket.inode)
+	if err != nil {
+		return ContainerInfo{}, errors.Wrapf(err, "Error identifying host client [%s]", addr)
+	}
+
+	log := loggerFromContext(ctx, h.log)
+
+	if containerID == "" {
+		h.lock.RLock()
+		users, aliasToARN := h.users, h.aliasToARN
+		h.lock.RUnlock()
+
+		if !users.enabled() {
+			return ContainerInfo{}, errors.Errorf("Process [%s] of client [%s] is not in a docker container", pid, addr)
+		}
+
+		user, err := findHostUser(users.PasswdFile, 2, socket.uid)
+		if err != nil {
+			return ContainerInfo{}, errors.Wrapf(err, "Error identifying user of host client [%s]", addr)
+		}
+
+		log.Debug("ContainerForIP: identified host user", "client", addr, "user", user.name, "uid", user.uid)
+
+		return newHostUserInfo(h.log, aliasToARN, users, user)
+	}
+
+	if !h.config.Enabled {
+		return ContainerInfo{}, errors.Errorf("Process [%s] of client [%s] is in a host network container, but 'hostNetwork' is not enabled", pid, addr)
+	}
+
+	log.Debug("ContainerForIP: identified host network container", "client", addr, logKeyContainerID, shortContainerID(containerID))
+
+	return h.ContainerForID(ctx, containerID)
+}
+
+// ContainerForID implements a ContainerResolver method. IDs of host users, ex. "user-deploy",
+// are mapped again, ex. so that cached credentials reflect HostUsers changes.
+func (h *HostNetworkContainerService) ContainerForID(ctx context.Context, containerID string) (ContainerInfo, error) {
+	if strings.HasPrefix(containerID, hostUserIDPrefix) {
+		h.lock.RLock()
+		users, aliasToARN := h.users, h.aliasToARN
+		h.lock.RUnlock()
+
+		if !users.enabled() {
+			return ContainerInfo{}, errors.Errorf("No host users are mapped for ID [%s]", containerID)
+		}
+
+		user, err := findHostUser(users.PasswdFile, 0, strings.TrimPrefix(containerID, hostUserIDPrefix))
+		if err != nil {
+			return ContainerInfo{}, err
+		}
+		return newHostUserInfo(h.log, aliasToARN, users, user)
+	}
+
+	if h.resolver == nil {
+		return ContainerInfo{}, errors.Errorf("Container service [%s] cannot find containers by ID", h.ContainerService.TypeName())
+	}
+
+	now := time.Now()
+
+	h.cacheLock.Lock()
+	cached, found := h.containers[containerID]
+	h.cacheLock.Unlock()
+	if found && now.Before(cached.RefreshTime) {
+		return cached.ContainerInfo, nil
+	}
+
+	info, err := h.resolver.ContainerForID(ctx, containerID)
+	if err != nil {
+		h.cacheLock.Lock()
+		delete(h.containers, containerID)
+		h.cacheLock.Unlock()
+		return ContainerInfo{}, err
+	}
+	info.HostNetwork = true
+
+	h.cacheLock.Lock()
+	defer h.cacheLock.Unlock()
+	if len(h.containers) >= maxSocketOwners {
+		for id, c := range h.containers {
+			if !now.Before(c.RefreshTime) {
+				delete(h.containers, id)
+			}
+		}
+	}
+	if len(h.containers) < maxSocketOwners {
+		h.containers[containerID] = hostContainerInfo{ContainerInfo: info, RefreshTime: now.Add(hostRefreshInterval)}
+	}
+
+	return info, nil
+}
+
+// forgetContainers removes the cached host network container, or all of them if the ID is empty.
+func (h *HostNetworkContainerService) forgetContainers(containerID string) {
+	h.cacheLock.Lock()
+	defer h.cacheLock.Unlock()
+	if containerID == "" {
+		h.containers = make(map[string]hostContainerInfo)
+	} else {
+		delete(h.containers, containerID)
+	}
+}
+
+// Containers implements a ContainerInventory method, if the wrapped service does.
+func (h *HostNetworkContainerService) Containers() []ContainerEntry {
+	if inventory, ok := h.ContainerService.(ContainerInventory); ok {
+		return inventory.Containers()
+	}
+	return nil
+}
+
+// Resync implements a ContainerInventory method, if the wrapped service does. Cached host
+// network containers are found again.
+func (h *HostNetworkContainerService) Resync(ctx context.Context, containerID string) error {
+	h.forgetContainers(containerID)
+	if inventory, ok := h.ContainerService.(ContainerInventory); ok {
+		return inventory.Resync(ctx, containerID)
+	}
+	return nil
+}
+
+// Ping implements a ContainerPinger method, if the wrapped service does.
+func (h *HostNetworkContainerService) Ping(ctx context.Context) error {
+	if pinger, ok := h.ContainerService.(ContainerPinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Watch implements a ContainerWatcher method, if the wrapped service does.
+func (h *HostNetworkContainerService) Watch(ctx context.Context) {
+	if watcher, ok := h.ContainerService.(ContainerWatcher); ok {
+		watcher.Watch(ctx)
+	}
+}
+
+// ApplyConfig implements a ConfigApplier method. HostUsers and the alias-to-ARN mapping are
+// replaced, and the config is also applied to the wrapped service if it implements ConfigApplier.
+func (h *HostNetworkContainerService) ApplyConfig(config Config) error {
+	users := config.HostUsers
+	if err := users.validate(config.AliasToARN); err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	h.users = users
+	h.aliasToARN = config.AliasToARN
+	h.lock.Unlock()
+
+	// Roles of cached host network containers reflect the previous mapping.
+	h.forgetContainers("")
+
+	if applier, ok := h.ContainerService.(ConfigApplier); ok {
+		return applier.ApplyConfig(config)
+	}
+	return nil
+}
+
+// isHostIP returns true if the IP is loopback or one of the host's own.
+func (h *HostNetworkContainerService) isHostIP(ip string) (bool, error) {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+		return true, nil
+	}
+
+	if len(h.config.HostIPs) > 0 {
+		return containsString(h.config.HostIPs, ip), nil
+	}
+
+	ips, err := h.hostInterfaceIPs()
+	if err != nil {
+		return false, err
+	}
+	return containsString(ips, ip), nil
+}
+
+// hostInterfaceIPs returns the addresses of the host's interfaces. They are cached for
+// hostRefreshInterval.
+func (h *HostNetworkContainerService) hostInterfaceIPs() ([]string, error) {
+	now := time.Now()
+
+	h.cacheLock.Lock()
+	defer h.cacheLock.Unlock()
+	if now.Before(h.interfaceRefresh) {
+		return h.interfaceIPs, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing host interface addresses")
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, normalizeIP(ipNet.IP.String()))
+		}
+	}
+
+	h.interfaceIPs = ips
+	h.interfaceRefresh = now.Add(hostRefreshInterval)
+	return ips, nil
+}
+
+// socketProcess returns the PID of the process that owns the socket inode, and the docker
+// container ID of the process or an empty string if it is a host process. Results are cached
+// for socketOwnerTTL.
+func (h *HostNetworkContainerService) socketProcess(inode string) (string, string, error) {
+	now := time.Now()
+
+	h.ownersLock.Lock()
+	owner, found := h.owners[inode]
+	h.ownersLock.Unlock()
+	if found && now.Before(owner.expiration) {
+		return owner.pid, owner.containerID, nil
+	}
+
+	pid, err := h.socketOwner(inode)
+	if err != nil {
+		return "", "", err
+	}
+	containerID, err := h.processContainerID(pid)
+	if err != nil {
+		return "", "", err
+	}
+
+	h.ownersLock.Lock()
+	defer h.ownersLock.Unlock()
+	if len(h.owners) >= maxSocketOwners {
+		for k, v := range h.owners {
+			if !now.Before(v.expiration) {
+				delete(h.owners, k)
+			}
+		}
+	}
+	if len(h.owners) < maxSocketOwners {
+		h.owners[inode] = socketOwner{pid: pid, containerID: containerID, expiration: now.Add(socketOwnerTTL)}
+	}
+
+	return pid, containerID, nil
+}
+
+// processContainerID returns the docker container ID of the process, or an empty string if
+// the process is a host process. It returns an accessDeniedError if the process is in another
+// cgroup, ex. of a containerd or Kubernetes container, so that it never receives the role of
+// a host user.
+func (h *HostNetworkContainerService) processContainerID(pid string) (string, error) {
+	cgroupPath := filepath.Join(h.config.ProcRoot, pid, "cgroup")
+	cgroup, err := ioutil.ReadFile(cgroupPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error reading cgroup of process [%s]", pid)
+	}
+
+	match := cgroupContainerIDRegexp.FindSubmatch(cgroup)
+	if match != nil {
+		return string(match[1]), nil
+	}
+
+	// Lines have the form "hierarchy-ID:controllers:path".
+	for _, line := range strings.Split(strings.TrimSpace(string(cgroup)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 && !isHostCgroup(fields[2]) {
+			return "", errors.WithStack(accessDeniedError{
+				reason: fmt.Sprintf("Process [%s] is in cgroup [%s] of a container that cannot be identified", pid, fields[2]),
+			})
+		}
+	}
+	return "", nil
+}
+
+// isHostCgroup returns true if the cgroup path is the root cgroup, the init process' or one in
+// hostCgroupSlices that holds no container ID.
+func isHostCgroup(path string) bool {
+	if path == "/" || path == "/init.scope" {
+		return true
+	}
+	if cgroupIDRegexp.MatchString(path) {
+		return false
+	}
+	for _, slice := range hostCgroupSlices {
+		if path == slice || strings.HasPrefix(path, slice+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// procSocket is an entry of the /proc/net/tcp or tcp6 table.
+type procSocket struct {
+	inode string
+	uid   string
+}
+
+// procAddr is a decoded address of the /proc/net/tcp or tcp6 table.
+type procAddr struct {
+	ip   string
+	port int
+}
+
+// parseProcAddr parses a "host:port" address.
+func parseProcAddr(addr string) (procAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return procAddr{}, errors.Wrapf(err, "Error parsing address [%s]", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return procAddr{}, errors.Wrapf(err, "Error parsing port of address [%s]", addr)
+	}
+	return procAddr{ip: normalizeIP(host), port: port}, nil
+}
+
+// socket returns the TCP socket of a client connection: its local address is the client's
+// "host:port" address, and its remote address is the proxy's local address, or the metadata
+// service's if the connection was redirected by a DNAT rule.
+func (h *HostNetworkContainerService) socket(addr, localAddr string) (procSocket, error) {
+	local, err := parseProcAddr(addr)
+	if err != nil {
+		return procSocket{}, errors.Wrap(err, "Error parsing client address")
+	}
+
+	peerAddrs := metadataPeerAddrs
+	if localAddr != "" {
+		peerAddrs = append([]string{localAddr}, metadataPeerAddrs...)
+	}
+	var peers []procAddr
+	for _, peerAddr := range peerAddrs {
+		peer, err := parseProcAddr(peerAddr)
+		if err != nil {
+			return procSocket{}, errors.Wrap(err, "Error parsing proxy address")
+		}
+		peers = append(peers, peer)
+	}
+
+	for _, name := range []string{"tcp", "tcp6"} {
+		socket, found, err := findProcSocket(filepath.Join(h.config.ProcRoot, "net", name), local, peers)
+		if err != nil {
+			return procSocket{}, err
+		}
+		if found {
+			return socket, nil
+		}
+	}
+
+	return procSocket{}, errors.Errorf("No socket found for client [%s]", addr)
+}
+
+// findProcSocket returns the connected socket in the /proc/net/tcp or tcp6 table whose local
+// address is the one given and whose remote address is one of the peers, and false if there is none.
+func findProcSocket(table string, local procAddr, peers []procAddr) (procSocket, bool, error) {
+	f, err := os.Open(table)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return procSocket{}, false, nil
+		}
+		return procSocket{}, false, errors.Wrapf(err, "Error opening socket table [%s]", table)
+	}
+	defer f.Close()
+
+	// Lines have the form "sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+	// retrnsmt uid timeout inode ...", after a header line.
+	scanner := bufio.NewScanner(f)
+	for header := true; scanner.Scan(); header = false {
+		fields := strings.Fields(scanner.Text())
+		if header || len(fields) < 10 || fields[3] == procTCPListen || fields[9] == "0" {
+			continue
+		}
+
+		localIP, localPort, err := decodeProcAddr(fields[1])
+		if err != nil || localIP != local.ip || localPort != local.port {
+			continue
+		}
+		remoteIP, remotePort, err := decodeProcAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		for _, peer := range peers {
+			if remoteIP == peer.ip && remotePort == peer.port {
+				return procSocket{inode: fields[9], uid: fields[7]}, true, nil
+			}
+		}
+	}
+
+	return procSocket{}, false, errors.Wrapf(scanner.Err(), "Error reading socket table [%s]", table)
+}
+
+// decodeProcAddr parses a /proc/net/tcp address, ex. "0100007F:1F90" for 127.0.0.1:8080. The
+// IP is hex encoded in 32-bit words of host byte order, which is little-endian on EC2.
+func decodeProcAddr(addr string) (string, int, error) {
+	parts := strings.SplitN(addr, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, errors.Errorf("Invalid socket address [%s]", addr)
+	}
+
+	ip, err := hex.DecodeString(parts[0])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return "", 0, errors.Errorf("Invalid socket address IP [%s]", addr)
+	}
+	for word := 0; word < len(ip); word += 4 {
+		ip[word], ip[word+1], ip[word+2], ip[word+3] = ip[word+3], ip[word+2], ip[word+1], ip[word]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", 0, errors.Errorf("Invalid socket address port [%s]", addr)
+	}
+
+	return normalizeIP(net.IP(ip).String()), int(port), nil
+}
+
+// socketOwner returns the PID of a process with a file descriptor of the socket inode.
+func (h *HostNetworkContainerService) socketOwner(inode string) (string, error) {
+	procs, err := ioutil.ReadDir(h.config.ProcRoot)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error listing processes [%s]", h.config.ProcRoot)
+	}
+
+	target := "socket:[" + inode + "]"
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join(h.config.ProcRoot, proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// The process exited, or its file descriptors are not readable.
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return proc.Name(), nil
+			}
+		}
+	}
+
+	return "", errors.Errorf("No process found for socket inode [%s]", inode)
+}
@@ -0,0 +1,277 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+const (
+	hostIP             = "10.0.0.10"
+	agentContainerID   = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	sidecarContainerID = "f0e1d2c3b4a5968778695a4b3c2d1e0ff0e1d2c3b4a5968778695a4b3c2d1e0f"
+)
+
+// newProcStub creates a procfs tree in which the agent container owns the socket of client
+// port 4567 (in net/tcp) and the sidecar container owns the socket of port 4568 (in net/tcp6,
+// as an IPv4-mapped address). A host process owns the sockets of ports 4569 (user "deploy"),
+// 4570 (user "backup", a member of group "cron") and 4571 (user "nobody"). The sidecar also
+// owns a socket of port 4567 connected to another peer, and a socket of port 4572 connected to
+// the proxy's listen address 10.0.0.10:18000. Root processes of a containerd container in a
+// Kubernetes pod (cgroup v2) and of a Kubernetes pod (cgroup v1) own the sockets of ports 4573
+// and 4574.
+func newProcStub(t *testing.T) string {
+	root, err := ioutil.TempDir("", "ec2metaproxy-proc")
+	fatalOnErr(t, err)
+
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	files := map[string]string{
+		"net/tcp": header +
+			"   0: 00000000:4E20 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1111 1 0000000000000000 100 0 0 10 0\n" +
+			"   1: 0A00000A:11D7 6300000A:01BB 01 00000000:00000000 00:00000000 00000000     0        0 4444 1 0000000000000000 20 4 30 10 -1\n" +
+			"   1: 0A00000A:11D7 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 5555 1 0000000000000000 20 4 30 10 -1\n" +
+			"   2: 0A00000A:11D9 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000  1001        0 7777 1 0000000000000000 20 4 30 10 -1\n" +
+			"   3: 0A00000A:11DA FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000  1002        0 8888 1 0000000000000000 20 4 30 10 -1\n" +
+			"   4: 0A00000A:11DB FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000 65534        0 9999 1 0000000000000000 20 4 30 10 -1\n" +
+			"   5: 0A00000A:11DC 0A00000A:4650 01 00000000:00000000 00:00000000 00000000     0        0 3333 1 0000000000000000 20 4 30 10 -1\n" +
+			"   6: 0A00000A:11DD FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 1212 1 0000000000000000 20 4 30 10 -1\n" +
+			"   7: 0A00000A:11DE FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 1313 1 0000000000000000 20 4 30 10 -1\n",
+		"net/tcp6": header +
+			"   0: 0000000000000000FFFF00000A00000A:11D8 0000000000000000FFFF0000FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 6666 1 0000000000000000 20 4 30 10 -1\n",
+		"1234/cgroup": "0::/system.slice/docker-" + agentContainerID + ".scope\n",
+		"2345/cgroup": "12:pids:/docker/" + sidecarContainerID + "\n11:memory:/docker/" + sidecarContainerID + "\n",
+		"99/cgroup":   "0::/init.scope\n",
+		"3456/cgroup": "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1f2e.slice/cri-containerd-" + sidecarContainerID + ".scope\n",
+		"4567/cgroup": "12:pids:/kubepods/besteffort/pod1f2e\n11:memory:/kubepods/besteffort/pod1f2e\n1:name=systemd:/\n",
+		"passwd":      "root:x:0:0:root:/root:/bin/bash\ndeploy:x:1001:1001::/home/deploy:/bin/sh\nbackup:x:1002:1002::/home/backup:/bin/sh\nnobody:x:65534:65534::/:/usr/sbin/nologin\n",
+		"group":       "root:x:0:\ndeploy:x:1001:\nbackup:x:1002:\ncron:x:1100:deploy,backup\nops:x:1200:backup\nnogroup:x:65534:\n",
+	}
+	for name, content := range files {
+		fatalOnErr(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0700))
+		fatalOnErr(t, ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0600))
+	}
+
+	links := map[string]string{
+		"1234/fd/0": "/dev/null",
+		"1234/fd/3": "socket:[5555]",
+		"2345/fd/7": "socket:[6666]",
+		"2345/fd/8": "socket:[4444]",
+		"2345/fd/9": "socket:[3333]",
+		"99/fd/4":   "socket:[7777]",
+		"99/fd/5":   "socket:[8888]",
+		"99/fd/6":   "socket:[9999]",
+		"3456/fd/3": "socket:[1212]",
+		"4567/fd/3": "socket:[1313]",
+	}
+	for name, target := range links {
+		fatalOnErr(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0700))
+		fatalOnErr(t, os.Symlink(target, filepath.Join(root, name)))
+	}
+
+	return root
+}
+
+func TestHostNetworkContainerService(t *testing.T) {
+	procRoot := newProcStub(t)
+	defer os.RemoveAll(procRoot)
+
+	info := defaultIPContainerInfo()
+	info["agent"] = proxy.ContainerInfo{ID: agentContainerID, Name: "/agent", RoleAlias: "db", IamRole: info[ipWithAllLabels].IamRole}
+	info["sidecar"] = proxy.ContainerInfo{ID: sidecarContainerID, Name: "/sidecar"}
+
+	config := defaultConfig()
+	config.HostNetwork = proxy.HostNetworkConfig{Enabled: true, ProcRoot: procRoot, HostIPs: []string{hostIP}}
+
+	svc, err := proxy.NewHostNetworkContainerService(config, newDockerContainerServiceStub(info), newLogger().logger)
+	fatalOnErr(t, err)
+
+	httpClient := roundTripperStub{
+		res: &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(defaultProxiedBody)),
+			StatusCode: 200,
+		},
+	}
+	stsSvc := defaultStsSvcStub()
+	p, err := proxy.New(config, httpClient, stsSvc, svc, newLogger().logger)
+	fatalOnErr(t, err)
+	h := proxy.RequestID(p)
+
+	serveFrom := func(path, remoteAddr string, localAddr net.Addr) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if localAddr != nil {
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, localAddr))
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("should identify containers by the owner of the client socket", func(t *testing.T) {
+		res := serveFrom(defaultPathReqBase+"/"+dbRoleARNFriendlyName, hostIP+":4567", nil)
+		responseCodeIs(t, res, 200)
+		stringsEqual(t, [][2]string{
+			[2]string{"docker-" + agentContainerID[:25], aws.StringValue(stsSvc.input.RoleSessionName)},
+			[2]string{info[ipWithAllLabels].IamRole.String(), aws.StringValue(stsSvc.input.RoleArn)},
+		})
+
+		res = serveFrom(defaultPathReqBase+"/"+defaultRoleARNFriendlyName, hostIP+":4568", nil)
+		responseCodeIs(t, res, 200)
+		stringsEqual(t, [][2]string{
+			[2]string{"docker-" + sidecarContainerID[:25], aws.StringValue(stsSvc.input.RoleSessionName)},
+		})
+	})
+
+	t.Run("should match the peer of the client socket", func(t *testing.T) {
+		listenAddr := &net.TCPAddr{IP: net.ParseIP(hostIP), Port: 18000}
+
+		res := serveFrom(defaultPathReqBase+"/"+defaultRoleARNFriendlyName, hostIP+":4572", listenAddr)
+		responseCodeIs(t, res, 200)
+		stringsEqual(t, [][2]string{
+			[2]string{"docker-" + sidecarContainerID[:25], aws.StringValue(stsSvc.input.RoleSessionName)},
+		})
+
+		res = serveFrom(defaultPathReqBase+"/"+defaultRoleARNFriendlyName, hostIP+":4572", nil)
+		if res.Code == 200 {
+			t.Fatal("expected error for a socket not connected to the proxy")
+		}
+	})
+
+	t.Run("should cache the owners of client sockets", func(t *testing.T) {
+		fatalOnErr(t, os.Remove(filepath.Join(procRoot, "1234/fd/3")))
+
+		// The cached credentials are only selected once the socket owner is identified again.
+		responseCodeIs(t, serveFrom(defaultPathReqBase+"/"+dbRoleARNFriendlyName, hostIP+":4567", nil), 200)
+	})
+
+	t.Run("should cache host network containers until resynced", func(t *testing.T) {
+		stub := newDockerContainerServiceStub(ipContainerInfo{"agent": info["agent"]})
+		svc, err := proxy.NewHostNetworkContainerService(config, stub, newLogger().logger)
+		fatalOnErr(t, err)
+		ctx := context.Background()
+
+		_, err = svc.ContainerForID(ctx, agentContainerID)
+		fatalOnErr(t, err)
+
+		delete(stub.info, "agent")
+		cached, err := svc.ContainerForID(ctx, agentContainerID)
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{agentContainerID, cached.ID}})
+
+		fatalOnErr(t, svc.Resync(ctx, agentContainerID))
+		if _, err := svc.ContainerForID(ctx, agentContainerID); err == nil {
+			t.Fatal("expected error for a removed container after a resync")
+		}
+	})
+
+	t.Run("should cache credentials of each host network container", func(t *testing.T) {
+		res := serveAdminRequest(p, "GET", "/credentials")
+		responseCodeIs(t, res, 200)
+
+		var list []proxy.AdminCredentials
+		fatalOnErr(t, json.NewDecoder(res.Body).Decode(&list))
+		if len(list) != 2 {
+			t.Fatalf("expected 2 entries, got [%+v]", list)
+		}
+		for _, creds := range list {
+			stringsEqual(t, [][2]string{[2]string{hostIP, creds.IP}})
+		}
+	})
+
+	t.Run("should not identify host processes", func(t *testing.T) {
+		for _, remoteAddr := range []string{hostIP + ":4569", hostIP + ":5000"} {
+			res := serveFrom(defaultPathReqBase+"/"+defaultRoleARNFriendlyName, remoteAddr, nil)
+			if res.Code == 200 {
+				t.Fatalf("expected error for [%s], got [%s]", remoteAddr, strings.TrimSpace(res.Body.String()))
+			}
+		}
+	})
+
+	t.Run("should pass other IPs to the wrapped service", func(t *testing.T) {
+		responseCodeIs(t, serveFrom(defaultPathReq, defaultIP+":4567", nil), 200)
+	})
+}
+
+func TestHostUsers(t *testing.T) {
+	procRoot := newProcStub(t)
+	defer os.RemoveAll(procRoot)
+
+	config := defaultConfig()
+	config.HostNetwork = proxy.HostNetworkConfig{ProcRoot: procRoot, HostIPs: []string{hostIP}}
+	config.HostUsers = proxy.HostUsersConfig{
+		Users:      map[string]string{"deploy": "db", "root": "db"},
+		Groups:     map[string]string{"cron": "noperms"},
+		PasswdFile: filepath.Join(procRoot, "passwd"),
+		GroupFile:  filepath.Join(procRoot, "group"),
+	}
+
+	svc, err := proxy.NewHostNetworkContainerService(config, defaultContainerSvcStub(), newLogger().logger)
+	fatalOnErr(t, err)
+
+	dbARN := defaultConfig().AliasToARN["db"]
+	noPermsARN := defaultConfig().AliasToARN["noperms"]
+
+	t.Run("should select roles by the user or groups of host processes", func(t *testing.T) {
+		for _, c := range []struct {
+			port        string
+			path        string
+			sessionName string
+			roleARN     string
+		}{
+			{"4569", defaultPathReqBase + "/" + dbRoleARNFriendlyName, "host-user-deploy", dbARN},
+			{"4570", defaultPathReq, "host-user-backup", noPermsARN},
+		} {
+			stsSvc := defaultStsSvcStub()
+			res, _, err := stubRequest(defaultPathSpec, c.path, config, stsSvc, svc, hostIP+":"+c.port)
+			fatalOnErr(t, err)
+			responseCodeIs(t, res, 200)
+			stringsEqual(t, [][2]string{
+				[2]string{c.sessionName, aws.StringValue(stsSvc.input.RoleSessionName)},
+				[2]string{c.roleARN, aws.StringValue(stsSvc.input.RoleArn)},
+			})
+		}
+	})
+
+	t.Run("should not identify unmapped users or host network containers", func(t *testing.T) {
+		for _, port := range []string{"4571", "4567"} {
+			res, _, err := stubRequest(defaultPathSpec, defaultPathReq, config, defaultStsSvcStub(), svc, hostIP+":"+port)
+			fatalOnErr(t, err)
+			if res.Code == 200 {
+				t.Fatalf("expected error for port [%s]", port)
+			}
+		}
+	})
+
+	t.Run("should deny processes in other containers", func(t *testing.T) {
+		for _, port := range []string{"4573", "4574"} {
+			res, _, err := stubRequest(defaultPathSpec, defaultPathReq, config, defaultStsSvcStub(), svc, hostIP+":"+port)
+			fatalOnErr(t, err)
+			responseCodeIs(t, res, 403)
+		}
+	})
+
+	t.Run("should apply changed mappings", func(t *testing.T) {
+		next := config
+		next.HostUsers.Users = map[string]string{"deploy": "noperms"}
+		next.HostUsers.Groups = map[string]string{"cron": "noperms", "ops": "db"}
+		fatalOnErr(t, svc.ApplyConfig(next))
+
+		info, err := svc.ContainerForID(context.Background(), "user-deploy")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{noPermsARN, info.IamRole.String()}})
+
+		if _, err := svc.ContainerForID(context.Background(), "user-backup"); err == nil {
+			t.Fatal("expected error for groups mapped to different aliases")
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPasswdFile = "/etc/passwd"
+	defaultGroupFile  = "/etc/group"
+
+	// hostUserIDPrefix prefixes the user name in the ContainerInfo ID of a host process.
+	hostUserIDPrefix = "user-"
+
+	// hostUserPlatform is the session name platform of host processes.
+	hostUserPlatform = "host"
+)
+
+// HostUsersConfig maps the Unix users and groups of processes that run directly on the host,
+// ex. cron jobs and deploy agents, to role aliases.
+type HostUsersConfig struct {
+	// Users maps user names to `aliasToARN` keys. They take precedence over Groups.
+	Users map[string]string `json:"users"`
+	// Groups maps group names to `aliasToARN` keys. A user's primary and supplementary groups
+	// must not select different aliases.
+	Groups map[string]string `json:"groups"`
+	// PasswdFile lists the host's users. Defaults to "/etc/passwd".
+	PasswdFile string `json:"passwdFile"`
+	// GroupFile lists the host's groups. Defaults to "/etc/group".
+	GroupFile string `json:"groupFile"`
+}
+
+// enabled returns true if any user or group is mapped.
+func (h HostUsersConfig) enabled() bool {
+	return len(h.Users) > 0 || len(h.Groups) > 0
+}
+
+func (h *HostUsersConfig) validate(aliasToARN map[string]string) error {
+	if h.PasswdFile == "" {
+		h.PasswdFile = defaultPasswdFile
+	}
+	if h.GroupFile == "" {
+		h.GroupFile = defaultGroupFile
+	}
+
+	for kind, mapping := range map[string]map[string]string{"users": h.Users, "groups": h.Groups} {
+		for name, alias := range mapping {
+			if name == "" {
+				return errors.Errorf("Config file selected an empty name in 'hostUsers.%s'.", kind)
+			}
+			if aliasToARN[alias] == "" {
+				return errors.Errorf("Config file selected an alias [%s] of [%s] in 'hostUsers.%s' not mapped in 'aliasToARN'.", alias, name, kind)
+			}
+		}
+	}
+	return nil
+}
+
+// hostUser is an entry of the passwd file.
+type hostUser struct {
+	name string
+	uid  string
+	gid  string
+}
+
+// findHostUser returns the passwd file entry whose field, 0 for the name or 2 for the UID,
+// has the value.
+func findHostUser(passwdFile string, field int, value string) (hostUser, error) {
+	var found hostUser
+	err := scanColonFile(passwdFile, func(fields []string) bool {
+		// Lines have the form "name:password:uid:gid:gecos:home:shell".
+		if len(fields) < 4 || fields[field] != value {
+			return true
+		}
+		found = hostUser{name: fields[0], uid: fields[2], gid: fields[3]}
+		return false
+	})
+	if err != nil {
+		return hostUser{}, err
+	}
+	if found.name == "" {
+		return hostUser{}, errors.Errorf("No user found for [%s] in [%s]", value, passwdFile)
+	}
+	return found, nil
+}
+
+// hostUserGroups returns the names of the user's primary group and of the groups that list
+// the user as a member.
+func hostUserGroups(groupFile string, user hostUser) ([]string, error) {
+	var groups []string
+	err := scanColonFile(groupFile, func(fields []string) bool {
+		// Lines have the form "name:password:gid:member,member".
+		if len(fields) < 4 {
+			return true
+		}
+		if fields[2] == user.gid || containsString(strings.Split(fields[3], ","), user.name) {
+			groups = append(groups, fields[0])
+		}
+		return true
+	})
+	return groups, err
+}
+
+// scanColonFile passes the fields of each line of a passwd(5) or group(5) style file to the
+// callback, until it returns false. Comments and blank lines are skipped.
+func scanColonFile(name string, callback func(fields []string) bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrapf(err, "Error opening [%s]", name)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !callback(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "Error reading [%s]", name)
+}
+
+// hostUserAlias returns the alias mapped to the user, or else to the user's groups.
+func hostUserAlias(config HostUsersConfig, user hostUser) (string, error) {
+	if alias, ok := config.Users[user.name]; ok {
+		return alias, nil
+	}
+
+	groups, err := hostUserGroups(config.GroupFile, user)
+	if err != nil {
+		return "", err
+	}
+
+	var alias string
+	var mapped []string
+	conflict := false
+	for _, group := range groups {
+		groupAlias, ok := config.Groups[group]
+		if !ok {
+			continue
+		}
+		if alias != "" && groupAlias != alias {
+			conflict = true
+		}
+		alias = groupAlias
+		mapped = append(mapped, group+"="+groupAlias)
+	}
+
+	if alias == "" {
+		return "", errors.Errorf("User [%s] is not mapped in 'hostUsers'", user.name)
+	}
+	if conflict {
+		return "", errors.Errorf("User [%s] has groups mapped to different aliases in 'hostUsers': %s", user.name, strings.Join(mapped, ", "))
+	}
+	return alias, nil
+}
+
+// newHostUserInfo returns the ContainerInfo of a host process run by the user.
+func newHostUserInfo(log *Logger, aliasToARN map[string]string, config HostUsersConfig, user hostUser) (ContainerInfo, error) {
+	alias, err := hostUserAlias(config, user)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+
+	info, ok := newContainerInfo(log, aliasToARN, hostUserIDPrefix+user.name, []string{user.name}, "", map[string]string{RoleLabelKey: alias})
+	if !ok {
+		return ContainerInfo{}, errors.Errorf("User [%s] selected an invalid role alias [%s]", user.name, alias)
+	}
+	info.Labels = nil
+	info.Platform = hostUserPlatform
+	info.HostNetwork = true
+	return info, nil
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"net"
 	"net/http"
 	"strings"
 )
@@ -17,13 +18,69 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
+// remoteIP returns the IP of a "host:port" address, ex. "10.0.0.2:4567" or "[fd00::2]:4567",
+// in the form that normalizeIP selects.
 func remoteIP(addr string) string {
-	index := strings.Index(addr, ":")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// The address has no port.
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	return normalizeIP(host)
+}
 
-	if index < 0 {
-		return addr
+// normalizeIP returns the canonical form of an IP, so that different notations of the same
+// address match, ex. "fd00:0::2" and "fd00::2". IPv4-mapped IPv6 addresses, which dual-stack
+// listeners report for IPv4 clients, are converted to IPv4. Values that are not IPs are returned as-is.
+func normalizeIP(ip string) string {
+	if i := strings.Index(ip, "%"); i >= 0 {
+		// Drop the zone of link-local addresses, ex. "fe80::1%eth0".
+		ip = ip[:i]
 	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return parsed.String()
+}
 
-	return addr[:index]
+// statusRecorder captures the response code, and the role of credentials responses,
+// for metrics and logs.
+type statusRecorder struct {
+	http.ResponseWriter
+	code        int
+	roleAlias   string
+	roleARN     string
+	containerID string
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
 
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Code returns the response code, which is 200 if the handler wrote nothing.
+func (s *statusRecorder) Code() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
+
+// setCredentialsRole records the role, and the container, of the credentials in the response.
+func setCredentialsRole(w http.ResponseWriter, c credentials) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.roleAlias = c.RoleAlias
+		rec.roleARN = c.RoleArn.String()
+		rec.containerID = c.Container.ID
+	}
 }
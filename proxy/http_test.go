@@ -3,17 +3,18 @@ package proxy_test
 import (
 	"bytes"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"testing"
 
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/codeactual/ec2metaproxy/proxy"
 	"github.com/pkg/errors"
 )
 
 type logger struct {
-	logger *log.Logger
+	logger *proxy.Logger
 	events []string
 }
 
@@ -21,7 +22,7 @@ func newLogger() *logger {
 	l := logger{
 		events: []string{},
 	}
-	l.logger = log.New(&l, "", 0)
+	l.logger = proxy.NewLogger(&l, proxy.Config{LogLevel: "debug"})
 	return &l
 }
 
@@ -76,3 +77,32 @@ func stubRequest(pathSpec, pathReq string, config proxy.Config, stsSvc *assumeRo
 
 	return recorder, l.events, nil
 }
+
+// newTestHandler creates a Proxy whose upstream always responds with the default proxied body.
+// Unlike stubRequest, the handler can serve multiple requests.
+func newTestHandler(t *testing.T, config proxy.Config, stsSvc stsiface.STSAPI) http.Handler {
+	httpClient := roundTripperStub{
+		res: &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(defaultProxiedBody)),
+			StatusCode: 200,
+		},
+	}
+
+	p, err := proxy.New(config, httpClient, stsSvc, defaultContainerSvcStub(), newLogger().logger)
+	fatalOnErr(t, err)
+
+	return proxy.RequestID(p)
+}
+
+// serveRequest performs a request with optional headers against the handler.
+func serveRequest(h http.Handler, method, path, clientIP string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = clientIP + ":4567"
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	return recorder
+}
@@ -0,0 +1,771 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultKubernetesCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// AllowedRoleAliasesAnnotationKey identifies the Kubernetes namespace annotation that holds
+	// a comma-separated list of the role aliases its pods may use.
+	AllowedRoleAliasesAnnotationKey = "ec2metaproxy.AllowedRoleAliases"
+
+	kubernetesWatchTimeout = 5 * time.Minute
+
+	kubeEventAdded    = "ADDED"
+	kubeEventModified = "MODIFIED"
+	kubeEventDeleted  = "DELETED"
+	kubeEventBookmark = "BOOKMARK"
+	kubeEventError    = "ERROR"
+
+	kubePodSucceeded = "Succeeded"
+	kubePodFailed    = "Failed"
+)
+
+// KubernetesConfig selects the API server and node of a KubernetesContainerService.
+type KubernetesConfig struct {
+	// APIServer is the base URL of the API server. Defaults to the in-cluster address from the
+	// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT environment variables.
+	APIServer string `json:"apiServer"`
+	// TokenFile holds the bearer token, which is re-read for each request so that rotated tokens
+	// are used. Defaults to the in-cluster service account token.
+	TokenFile string `json:"tokenFile"`
+	// CAFile holds the certificates that verify the API server. Defaults to the in-cluster
+	// service account CA.
+	CAFile string `json:"caFile"`
+	// NodeName selects the node whose pods are indexed. Defaults to the NODE_NAME environment
+	// variable, ex. set from the downward API.
+	NodeName string `json:"nodeName"`
+}
+
+func (k *KubernetesConfig) validate() error {
+	if k.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errors.New("Config file must select a Kubernetes API server ('kubernetes.apiServer') outside of a cluster.")
+		}
+		k.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if u, err := url.Parse(k.APIServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("Config file selected an invalid 'kubernetes.apiServer' [%s].", k.APIServer)
+	}
+	if k.TokenFile == "" {
+		k.TokenFile = defaultKubernetesTokenFile
+	}
+	if k.CAFile == "" {
+		k.CAFile = defaultKubernetesCAFile
+	}
+	if k.NodeName == "" {
+		k.NodeName = os.Getenv("NODE_NAME")
+	}
+	if k.NodeName == "" {
+		return errors.New("Config file must select a Kubernetes node ('kubernetes.nodeName' or the NODE_NAME environment variable).")
+	}
+	return nil
+}
+
+// kubeObjectMeta holds the metadata fields used by KubernetesContainerService.
+type kubeObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+	// DeletionTimestamp is set once the object is being deleted, ex. a pod that is terminating.
+	DeletionTimestamp string `json:"deletionTimestamp"`
+}
+
+type kubeNamespace struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+}
+
+type kubePod struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		HostNetwork bool `json:"hostNetwork"`
+		Containers  []struct {
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+// terminating returns true if the pod is being deleted or has terminated. Its IPs may already
+// be reused by another pod.
+func (p kubePod) terminating() bool {
+	return p.Metadata.DeletionTimestamp != "" || p.Status.Phase == kubePodSucceeded || p.Status.Phase == kubePodFailed
+}
+
+// ips returns the normalized pod IPs, or none if the pod shares the node's network namespace
+// or has terminated.
+func (p kubePod) ips() []string {
+	if p.Spec.HostNetwork || p.Status.Phase == kubePodSucceeded || p.Status.Phase == kubePodFailed {
+		return nil
+	}
+
+	var ips []string
+	seen := make(map[string]bool)
+	add := func(ip string) {
+		if ip == "" {
+			return
+		}
+		ip = normalizeIP(ip)
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+
+	add(p.Status.PodIP)
+	for _, podIP := range p.Status.PodIPs {
+		add(podIP.IP)
+	}
+	return ips
+}
+
+type kubeList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items json.RawMessage `json:"items"`
+}
+
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeStatus holds the fields of a Status object, ex. of an ERROR watch event.
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// kubeStatusError is an API response other than 200, or an ERROR watch event.
+type kubeStatusError struct {
+	path string
+	code int
+	body string
+}
+
+func (e kubeStatusError) Error() string {
+	return fmt.Sprintf("Kubernetes request [%s] returned code [%d]: %s", e.path, e.code, e.body)
+}
+
+// kubeStatusCode returns the code of a kubeStatusError, and false if the error is not one.
+func kubeStatusCode(err error) (int, bool) {
+	statusErr, ok := errors.Cause(err).(kubeStatusError)
+	return statusErr.code, ok
+}
+
+// kubeResourceVersions are the resource versions that the pod and namespace watches resume
+// from. They are empty if pods and namespaces must be listed first.
+type kubeResourceVersions struct {
+	pods       string
+	namespaces string
+}
+
+type kubernetesContainerInfo struct {
+	ContainerInfo
+	RefreshTime time.Time
+}
+
+// KubernetesContainerService watches the pods scheduled to the local node, and their namespaces,
+// through the API server and maintains a mapping of pod IPs to pod details.
+//
+// Pods select a role alias and policy with the ec2metaproxy.RoleAlias and ec2metaproxy.Policy
+// annotations, which default to the same annotations of their namespace. A namespace can
+// restrict the aliases of its pods with the ec2metaproxy.AllowedRoleAliases annotation.
+// Pods that share the node's network namespace are not indexed.
+//
+// While Watch is connected to the pod and namespace watch streams, the mapping is kept current
+// from their events and lookups are served from it without querying the API server, except to
+// resync on a miss, ex. of a pod whose event is not handled yet.
+//
+// A pod that is terminating does not replace the mapping entry of another pod that reuses its IP.
+type KubernetesContainerService struct {
+	pods           map[string]kubePod
+	namespaces     map[string]kubeNamespace
+	containerIPMap map[string]kubernetesContainerInfo
+	aliasToARN     map[string]string
+	config         KubernetesConfig
+	client         *http.Client
+	log            *Logger
+	watching       bool
+	syncTime       time.Time
+	lock           sync.RWMutex
+
+	// syncLock serializes resyncs and event handling, so that a list taken before an event
+	// cannot replace the mapping after the event is handled.
+	syncLock sync.Mutex
+}
+
+// NewKubernetesContainerService creates a Kubernetes specific ContainerService implementation.
+func NewKubernetesContainerService(config Config, logger *Logger) (*KubernetesContainerService, error) {
+	kubeConfig := config.Kubernetes
+	if err := kubeConfig.validate(); err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if strings.HasPrefix(kubeConfig.APIServer, "https://") {
+		pem, err := ioutil.ReadFile(kubeConfig.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading Kubernetes CA file [%s]", kubeConfig.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("Kubernetes CA file [%s] holds no certificates", kubeConfig.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	logger.Info("NewKubernetesContainerService: using Kubernetes API server", "api_server", kubeConfig.APIServer, "node", kubeConfig.NodeName)
+
+	return &KubernetesContainerService{
+		pods:           make(map[string]kubePod),
+		namespaces:     make(map[string]kubeNamespace),
+		containerIPMap: make(map[string]kubernetesContainerInfo),
+		aliasToARN:     config.AliasToARN,
+		config:         kubeConfig,
+		client:         &http.Client{Transport: transport},
+		log:            logger,
+	}, nil
+}
+
+// TypeName implements a ContainerService method.
+func (k *KubernetesContainerService) TypeName() string {
+	return ContainerRuntimeKubernetes
+}
+
+// ApplyConfig replaces the alias-to-ARN mapping, ex. after the config file changes, and
+// resyncs all pods so their roles reflect it.
+func (k *KubernetesContainerService) ApplyConfig(config Config) error {
+	k.lock.Lock()
+	k.aliasToARN = config.AliasToARN
+	k.lock.Unlock()
+
+	_, _, err := k.syncPods(context.Background())
+	return err
+}
+
+// ContainerForIP implements a ContainerService method.
+//
+// Pods and namespaces are listed if the IP is not in the cache, or its entry is due for a
+// refresh. If Watch is connected to the watch streams, cached entries are current, and misses
+// list at most once per second.
+func (k *KubernetesContainerService) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	k.lock.RLock()
+	info, found := k.containerIPMap[containerIP]
+	watching := k.watching
+	syncTime := k.syncTime
+	k.lock.RUnlock()
+
+	now := time.Now()
+	var resync bool
+	if watching {
+		resync = !found && now.After(refreshTime(syncTime))
+	} else {
+		resync = !found || now.After(info.RefreshTime)
+	}
+
+	if resync {
+		if _, _, err := k.syncPods(ctx); err == nil {
+			k.lock.RLock()
+			info, found = k.containerIPMap[containerIP]
+			k.lock.RUnlock()
+		}
+	}
+
+	if !found {
+		return ContainerInfo{}, errors.Errorf("No pod found for IP [%s]", containerIP)
+	}
+
+	return info.ContainerInfo, nil
+}
+
+// Containers implements a ContainerInventory method.
+func (k *KubernetesContainerService) Containers() []ContainerEntry {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	entries := make([]ContainerEntry, 0, len(k.containerIPMap))
+	for ip, info := range k.containerIPMap {
+		entries = append(entries, ContainerEntry{ContainerInfo: info.ContainerInfo, IP: ip, RefreshTime: info.RefreshTime})
+	}
+	return entries
+}
+
+// Resync implements a ContainerInventory method. All pods are resynced, because a single pod
+// cannot be fetched by its UID.
+func (k *KubernetesContainerService) Resync(ctx context.Context, containerID string) error {
+	_, _, err := k.syncPods(ctx)
+	return err
+}
+
+// Ping implements a ContainerPinger method.
+func (k *KubernetesContainerService) Ping(ctx context.Context) error {
+	resp, err := k.get(ctx, "version", "/version", nil)
+	if err != nil {
+		return errors.Wrap(err, "Error pinging Kubernetes API server")
+	}
+	k.closeBody(resp)
+	return nil
+}
+
+// Watch subscribes to the pod and namespace watch streams and keeps the IP mapping current
+// until the context is canceled. The streams resume from the resource versions of the last
+// events, ex. after their timeout. A full resync replaces the mapping first, and again if the
+// resource versions expired.
+//
+// If a stream cannot be resumed, lookups fall back to querying the API server until Watch reconnects.
+func (k *KubernetesContainerService) Watch(ctx context.Context) {
+	backoff := minWatchBackoff
+	var versions kubeResourceVersions
+
+	for {
+		established := k.watchEvents(ctx, &versions)
+		if established {
+			backoff = minWatchBackoff
+		}
+
+		if !established || versions.pods == "" || versions.namespaces == "" {
+			k.setWatching(false)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// watchEvents consumes a single connection of both watch streams, which start from the resource
+// versions, after listing pods and namespaces if they are empty. The versions are updated from
+// the events, and emptied if they expired. It returns true if the streams were established.
+func (k *KubernetesContainerService) watchEvents(ctx context.Context, versions *kubeResourceVersions) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resumed := versions.pods != "" && versions.namespaces != ""
+	if !resumed {
+		// Watches start from the resource versions of the lists, so that no event is lost.
+		podsVersion, namespacesVersion, err := k.syncPods(ctx)
+		if err != nil {
+			return false
+		}
+		*versions = kubeResourceVersions{pods: podsVersion, namespaces: namespacesVersion}
+	}
+
+	namespaceEvents, err := k.openWatch(ctx, "watch_namespaces", "/api/v1/namespaces", nil, versions.namespaces)
+	if err != nil {
+		k.log.Error("Watch: Error watching namespaces", logKeyError, err)
+		k.expireResourceVersions(versions, err)
+		return false
+	}
+	podEvents, err := k.openWatch(ctx, "watch_pods", "/api/v1/pods", k.podsQuery(), versions.pods)
+	if err != nil {
+		k.log.Error("Watch: Error watching pods", logKeyError, err)
+		k.expireResourceVersions(versions, err)
+		return false
+	}
+
+	k.setWatching(true)
+	if resumed {
+		k.log.Debug("Watch: resumed Kubernetes pod and namespace events", "node", k.config.NodeName)
+	} else {
+		k.log.Info("Watch: subscribed to Kubernetes pod and namespace events", "node", k.config.NodeName)
+	}
+
+	for {
+		var event kubeWatchEvent
+		var ok bool
+		var version *string
+		var handle func(kubeWatchEvent) (string, error)
+
+		select {
+		case event, ok = <-namespaceEvents:
+			version, handle = &versions.namespaces, k.handleNamespaceEvent
+		case event, ok = <-podEvents:
+			version, handle = &versions.pods, k.handlePodEvent
+		}
+
+		if !ok {
+			if ctx.Err() == nil {
+				k.log.Debug("Watch: Kubernetes watch stream ended")
+			}
+			return true
+		}
+
+		resourceVersion, err := handle(event)
+		if err != nil {
+			k.log.Warn("Watch: Error handling Kubernetes watch event", logKeyError, err)
+			// Unless the API server reported an error, an event was not applied.
+			if _, isStatus := kubeStatusCode(err); !isStatus {
+				*versions = kubeResourceVersions{}
+			}
+			k.expireResourceVersions(versions, err)
+			return true
+		}
+		if resourceVersion != "" {
+			*version = resourceVersion
+		}
+	}
+}
+
+// expireResourceVersions empties the resource versions if the error reports that they expired.
+func (k *KubernetesContainerService) expireResourceVersions(versions *kubeResourceVersions, err error) {
+	if code, _ := kubeStatusCode(err); code == http.StatusGone {
+		*versions = kubeResourceVersions{}
+	}
+}
+
+// kubeWatchError returns a kubeStatusError of an ERROR watch event.
+func kubeWatchError(path string, event kubeWatchEvent) error {
+	var status kubeStatus
+	if err := json.Unmarshal(event.Object, &status); err != nil {
+		return errors.Wrapf(err, "Error parsing Kubernetes watch error [%s]", path)
+	}
+	return errors.WithStack(kubeStatusError{path: path, code: status.Code, body: status.Message})
+}
+
+func (k *KubernetesContainerService) setWatching(watching bool) {
+	k.lock.Lock()
+	k.watching = watching
+	k.lock.Unlock()
+}
+
+// handleNamespaceEvent updates the namespace and reindexes its pods. It returns the resource
+// version of the event, or an error if the stream must be reestablished, ex. because its
+// resource version expired.
+func (k *KubernetesContainerService) handleNamespaceEvent(event kubeWatchEvent) (string, error) {
+	if event.Type == kubeEventError {
+		return "", kubeWatchError("/api/v1/namespaces", event)
+	}
+
+	var namespace kubeNamespace
+	if err := json.Unmarshal(event.Object, &namespace); err != nil {
+		return "", errors.Wrap(err, "Error parsing namespace")
+	}
+
+	k.syncLock.Lock()
+	defer k.syncLock.Unlock()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	switch event.Type {
+	case kubeEventAdded, kubeEventModified:
+		k.namespaces[namespace.Metadata.Name] = namespace
+	case kubeEventDeleted:
+		delete(k.namespaces, namespace.Metadata.Name)
+	default:
+		// ex. BOOKMARK events, which only carry a resource version.
+		return namespace.Metadata.ResourceVersion, nil
+	}
+
+	refreshAt := refreshTime(time.Now())
+	for _, pod := range k.pods {
+		if pod.Metadata.Namespace == namespace.Metadata.Name {
+			k.indexPodLocked(pod, refreshAt)
+		}
+	}
+	return namespace.Metadata.ResourceVersion, nil
+}
+
+// handlePodEvent updates the pod's mapping entries. It returns the resource version of the
+// event, or an error if the stream must be reestablished, ex. because its resource version expired.
+func (k *KubernetesContainerService) handlePodEvent(event kubeWatchEvent) (string, error) {
+	if event.Type == kubeEventError {
+		return "", kubeWatchError("/api/v1/pods", event)
+	}
+
+	var pod kubePod
+	if err := json.Unmarshal(event.Object, &pod); err != nil {
+		return "", errors.Wrap(err, "Error parsing pod")
+	}
+
+	k.syncLock.Lock()
+	defer k.syncLock.Unlock()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	switch event.Type {
+	case kubeEventAdded, kubeEventModified:
+		k.pods[pod.Metadata.UID] = pod
+		k.indexPodLocked(pod, refreshTime(time.Now()))
+	case kubeEventDeleted:
+		delete(k.pods, pod.Metadata.UID)
+		k.removePodLocked(pod.Metadata.UID)
+	}
+	return pod.Metadata.ResourceVersion, nil
+}
+
+// syncPods replaces the cached pods and namespaces, and the mapping, with the API server's
+// lists. It returns the resource versions of the pod and namespace lists.
+func (k *KubernetesContainerService) syncPods(ctx context.Context) (string, string, error) {
+	log := loggerFromContext(ctx, k.log)
+
+	k.syncLock.Lock()
+	defer k.syncLock.Unlock()
+
+	var namespaceItems []kubeNamespace
+	namespacesVersion, err := k.list(ctx, "list_namespaces", "/api/v1/namespaces", nil, &namespaceItems)
+	if err != nil {
+		log.Error("syncPods: Error listing namespaces", logKeyError, err)
+		return "", "", err
+	}
+
+	var podItems []kubePod
+	podsVersion, err := k.list(ctx, "list_pods", "/api/v1/pods", k.podsQuery(), &podItems)
+	if err != nil {
+		log.Error("syncPods: Error listing pods", logKeyError, err)
+		return "", "", err
+	}
+
+	namespaces := make(map[string]kubeNamespace, len(namespaceItems))
+	for _, namespace := range namespaceItems {
+		namespaces[namespace.Metadata.Name] = namespace
+	}
+	pods := make(map[string]kubePod, len(podItems))
+	for _, pod := range podItems {
+		pods[pod.Metadata.UID] = pod
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	now := time.Now()
+	k.namespaces = namespaces
+	k.pods = pods
+	k.containerIPMap = make(map[string]kubernetesContainerInfo)
+	k.syncTime = now
+
+	refreshAt := refreshTime(now)
+	for _, pod := range pods {
+		k.indexPodLocked(pod, refreshAt)
+	}
+
+	return podsVersion, namespacesVersion, nil
+}
+
+// indexPodLocked replaces the pod's mapping entries with ones based on its cached state and
+// the cached state of its namespace. IPs indexed for another pod are skipped if this pod is
+// terminating and the other pod is not.
+func (k *KubernetesContainerService) indexPodLocked(pod kubePod, refreshAt time.Time) {
+	k.removePodLocked(pod.Metadata.UID)
+
+	ips := pod.ips()
+	if len(ips) == 0 {
+		return
+	}
+
+	namespace := k.namespaces[pod.Metadata.Namespace]
+	selectors := make(map[string]string)
+	for _, key := range []string{RoleLabelKey, PolicyLabelKey, AuthorizationTokenLabelKey} {
+		if value, found := pod.Metadata.Annotations[key]; found {
+			selectors[key] = value
+		} else if value, found := namespace.Metadata.Annotations[key]; found && key != AuthorizationTokenLabelKey {
+			selectors[key] = value
+		}
+	}
+
+	var image string
+	if len(pod.Spec.Containers) > 0 {
+		image = pod.Spec.Containers[0].Image
+	}
+
+	name := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	info, ok := newContainerInfo(k.log, k.aliasToARN, pod.Metadata.UID, []string{name}, image, selectors)
+	if !ok {
+		return
+	}
+	info.Labels = pod.Metadata.Labels
+
+	if allowed, found := namespace.Metadata.Annotations[AllowedRoleAliasesAnnotationKey]; found {
+		info.AllowedAliases = []string{}
+		for _, alias := range strings.Split(allowed, ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				info.AllowedAliases = append(info.AllowedAliases, alias)
+			}
+		}
+	}
+
+	for _, ipAddress := range ips {
+		if !k.mayIndexLocked(pod, ipAddress) {
+			k.log.Debug("indexPodLocked: skipped IP of terminating pod", logKeyContainerID, pod.Metadata.UID, "pod", name, "ip", ipAddress)
+			continue
+		}
+		k.log.Debug("indexPodLocked: indexed pod",
+			logKeyContainerID, pod.Metadata.UID,
+			"pod", name,
+			"ip", ipAddress,
+			logKeyRoleARN, info.IamRole,
+		)
+		k.containerIPMap[ipAddress] = kubernetesContainerInfo{ContainerInfo: info, RefreshTime: refreshAt}
+	}
+}
+
+// mayIndexLocked returns true if the pod may replace the mapping entry of the IP.
+func (k *KubernetesContainerService) mayIndexLocked(pod kubePod, ip string) bool {
+	current, found := k.containerIPMap[ip]
+	if !found || current.ID == pod.Metadata.UID || !pod.terminating() {
+		return true
+	}
+	other, found := k.pods[current.ID]
+	return !found || other.terminating()
+}
+
+// removePodLocked removes the mapping entries of the pod, but not those of other pods that
+// reuse its IPs.
+func (k *KubernetesContainerService) removePodLocked(uid string) {
+	for ip, info := range k.containerIPMap {
+		if info.ID == uid {
+			delete(k.containerIPMap, ip)
+		}
+	}
+}
+
+// podsQuery selects the pods scheduled to the node.
+func (k *KubernetesContainerService) podsQuery() url.Values {
+	return url.Values{"fieldSelector": []string{"spec.nodeName=" + k.config.NodeName}}
+}
+
+// list decodes the items of a list response into the slice that items points to, and returns
+// the list's resource version.
+func (k *KubernetesContainerService) list(ctx context.Context, operation, path string, query url.Values, items interface{}) (string, error) {
+	resp, err := k.get(ctx, operation, path, query)
+	if err != nil {
+		return "", err
+	}
+	defer k.closeBody(resp)
+
+	var list kubeList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", errors.Wrapf(err, "Error parsing Kubernetes list [%s]", path)
+	}
+	if len(list.Items) > 0 {
+		if err := json.Unmarshal(list.Items, items); err != nil {
+			return "", errors.Wrapf(err, "Error parsing Kubernetes list items [%s]", path)
+		}
+	}
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// openWatch starts a watch from the resource version. Events are sent on the returned channel,
+// which is closed when the stream ends.
+func (k *KubernetesContainerService) openWatch(ctx context.Context, operation, path string, query url.Values, resourceVersion string) (<-chan kubeWatchEvent, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("watch", "true")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(int(kubernetesWatchTimeout/time.Second)))
+
+	resp, err := k.get(ctx, operation, path, query)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan kubeWatchEvent)
+	go func() {
+		defer close(events)
+		defer k.closeBody(resp)
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event kubeWatchEvent
+			if err := decoder.Decode(&event); err != nil {
+				if ctx.Err() == nil {
+					k.log.Debug("openWatch: watch stream ended", "path", path, logKeyError, err)
+				}
+				return
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// get sends a GET request to the API server with the service account token, and records metrics.
+// Responses other than 200 are returned as errors.
+func (k *KubernetesContainerService) get(ctx context.Context, operation, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimSuffix(k.config.APIServer, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error creating Kubernetes request [%s]", path)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token, err := ioutil.ReadFile(k.config.TokenFile)
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Error reading Kubernetes token file [%s]", k.config.TokenFile)
+	}
+
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err == nil && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		k.closeBody(resp)
+		err = errors.WithStack(kubeStatusError{path: path, code: resp.StatusCode, body: strings.TrimSpace(string(body))})
+	}
+	kubernetesCallsTotal.Inc(operation, callResult(err))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error requesting Kubernetes API [%s]", path)
+	}
+
+	return resp, nil
+}
+
+func (k *KubernetesContainerService) closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		k.log.Warn("closeBody: Error closing Kubernetes response body", logKeyError, err)
+	}
+}
@@ -0,0 +1,368 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+const kubeNodeName = "node-1"
+
+// kubeAPIStub serves the subset of the Kubernetes API used by KubernetesContainerService.
+type kubeAPIStub struct {
+	pods            map[string]map[string]interface{}
+	namespaces      map[string]map[string]interface{}
+	podEvents       chan map[string]interface{}
+	namespaceEvents chan map[string]interface{}
+	listCalls       int
+	watchVersions   []string
+	lock            sync.Mutex
+}
+
+func newKubeAPIStub() *kubeAPIStub {
+	return &kubeAPIStub{
+		pods:            make(map[string]map[string]interface{}),
+		namespaces:      make(map[string]map[string]interface{}),
+		podEvents:       make(chan map[string]interface{}),
+		namespaceEvents: make(chan map[string]interface{}),
+	}
+}
+
+func kubePodObject(uid, namespace, ip string, hostNetwork bool, annotations map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":        "pod-" + uid,
+			"namespace":   namespace,
+			"uid":         uid,
+			"labels":      map[string]string{"app": uid},
+			"annotations": annotations,
+		},
+		"spec": map[string]interface{}{
+			"nodeName":    kubeNodeName,
+			"hostNetwork": hostNetwork,
+			"containers":  []map[string]string{{"image": "registry.example.com/" + uid + ":1"}},
+		},
+		"status": map[string]interface{}{
+			"phase":  "Running",
+			"podIP":  ip,
+			"podIPs": []map[string]string{{"ip": ip}},
+		},
+	}
+}
+
+func kubeNamespaceObject(name string, annotations map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name, "annotations": annotations},
+	}
+}
+
+func kubeEvent(eventType string, object map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": eventType, "object": object}
+}
+
+func (k *kubeAPIStub) SetPod(uid, namespace, ip string, annotations map[string]string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.pods[uid] = kubePodObject(uid, namespace, ip, false, annotations)
+}
+
+func (k *kubeAPIStub) SetNamespace(name string, annotations map[string]string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.namespaces[name] = kubeNamespaceObject(name, annotations)
+}
+
+func (k *kubeAPIStub) ListCalls() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.listCalls
+}
+
+// WatchVersions returns the paths and resource versions, ex. "/api/v1/pods@5", of the watch requests.
+func (k *kubeAPIStub) WatchVersions() []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return append([]string(nil), k.watchVersions...)
+}
+
+// ServeHTTP serves lists and watches. A nil event ends a watch stream, as its timeout would.
+func (k *kubeAPIStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var objects map[string]map[string]interface{}
+	var events chan map[string]interface{}
+
+	switch r.URL.Path {
+	case "/version":
+		_ = json.NewEncoder(w).Encode(map[string]string{"major": "1", "minor": "20"})
+		return
+	case "/api/v1/pods":
+		if r.URL.Query().Get("fieldSelector") != "spec.nodeName="+kubeNodeName {
+			http.Error(w, "unexpected field selector", http.StatusBadRequest)
+			return
+		}
+		objects, events = k.pods, k.podEvents
+	case "/api/v1/namespaces":
+		objects, events = k.namespaces, k.namespaceEvents
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("watch") == "true" {
+		k.lock.Lock()
+		k.watchVersions = append(k.watchVersions, r.URL.Path+"@"+r.URL.Query().Get("resourceVersion"))
+		k.lock.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				if event == nil {
+					return
+				}
+				_ = json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.listCalls++
+
+	items := make([]map[string]interface{}, 0, len(objects))
+	for _, object := range objects {
+		items = append(items, object)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"metadata": map[string]string{"resourceVersion": "1"},
+		"items":    items,
+	})
+}
+
+func newKubernetesContainerService(t *testing.T, ctx context.Context, api *kubeAPIStub) *proxy.KubernetesContainerService {
+	server := httptest.NewServer(api)
+	go func() {
+		<-ctx.Done()
+		server.CloseClientConnections()
+		server.Close()
+	}()
+
+	config := defaultConfig()
+	config.ContainerRuntime = proxy.ContainerRuntimeKubernetes
+	config.Kubernetes = proxy.KubernetesConfig{
+		APIServer: server.URL,
+		TokenFile: "/nonexistent/token",
+		NodeName:  kubeNodeName,
+	}
+
+	svc, err := proxy.NewKubernetesContainerService(config, newLogger().logger)
+	fatalOnErr(t, err)
+	return svc
+}
+
+func TestKubernetesContainerService(t *testing.T) {
+	t.Run("should resolve roles from pod and namespace annotations", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		api := newKubeAPIStub()
+		api.SetNamespace("team-a", map[string]string{proxy.RoleLabelKey: "db"})
+		api.SetNamespace("team-b", nil)
+		api.SetPod("p1", "team-a", "10.2.0.2", nil)
+		api.SetPod("p2", "team-a", "10.2.0.3", map[string]string{proxy.RoleLabelKey: "noperms", proxy.PolicyLabelKey: defaultPolicy})
+		api.SetPod("p3", "team-b", "10.2.0.4", nil)
+		api.pods["p4"] = kubePodObject("p4", "team-a", "10.1.0.10", true, nil)
+
+		svc := newKubernetesContainerService(t, ctx, api)
+
+		info, err := svc.ContainerForIP(ctx, "10.2.0.2")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{"p1", info.ID},
+			[2]string{"team-a/pod-p1", info.Name},
+			[2]string{"registry.example.com/p1:1", info.Image},
+			[2]string{"p1", info.Labels["app"]},
+			[2]string{dbRoleARNFriendlyName, info.IamRole.RoleName()},
+		})
+
+		info, err = svc.ContainerForIP(ctx, "10.2.0.3")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{defaultRoleARNFriendlyName, info.IamRole.RoleName()},
+			[2]string{defaultPolicy, info.IamPolicy},
+		})
+
+		info, err = svc.ContainerForIP(ctx, "10.2.0.4")
+		fatalOnErr(t, err)
+		if !info.IamRole.Empty() || info.AllowedAliases != nil {
+			t.Fatalf("expected unrestricted pod without role, got [%+v]", info)
+		}
+
+		if _, err := svc.ContainerForIP(ctx, "10.1.0.10"); err == nil {
+			t.Fatal("expected host network pod to not be indexed")
+		}
+	})
+
+	t.Run("should update cache from watch events without listing pods", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		api := newKubeAPIStub()
+		api.SetNamespace("team-a", nil)
+
+		svc := newKubernetesContainerService(t, ctx, api)
+		go svc.Watch(ctx)
+
+		// Lookups stop triggering a list operation once the watch streams are established.
+		waitFor(t, func() bool {
+			before := api.ListCalls()
+			_, _ = svc.ContainerForIP(ctx, "10.9.9.9")
+			return before > 0 && api.ListCalls() == before
+		})
+		listCalls := api.ListCalls()
+
+		api.podEvents <- kubeEvent("ADDED", kubePodObject("p1", "team-a", "10.2.0.2", false, nil))
+		waitFor(t, func() bool {
+			_, err := svc.ContainerForIP(ctx, "10.2.0.2")
+			return err == nil
+		})
+
+		api.namespaceEvents <- kubeEvent("MODIFIED", kubeNamespaceObject("team-a", map[string]string{proxy.RoleLabelKey: "db"}))
+		waitFor(t, func() bool {
+			info, err := svc.ContainerForIP(ctx, "10.2.0.2")
+			return err == nil && info.IamRole.RoleName() == dbRoleARNFriendlyName
+		})
+
+		api.podEvents <- kubeEvent("DELETED", kubePodObject("p1", "team-a", "10.2.0.2", false, nil))
+		waitFor(t, func() bool {
+			_, err := svc.ContainerForIP(ctx, "10.2.0.2")
+			return err != nil
+		})
+
+		if api.ListCalls() != listCalls {
+			t.Fatalf("expected no list calls after watch, got %d", api.ListCalls()-listCalls)
+		}
+	})
+
+	t.Run("should resync on a miss before the pod event is handled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		api := newKubeAPIStub()
+		api.SetNamespace("team-a", nil)
+
+		svc := newKubernetesContainerService(t, ctx, api)
+		go svc.Watch(ctx)
+		waitFor(t, func() bool { return len(api.WatchVersions()) == 2 })
+
+		// No event is sent, ex. because it is still queued behind others.
+		api.SetPod("p1", "team-a", "10.2.0.2", nil)
+		waitFor(t, func() bool {
+			info, err := svc.ContainerForIP(ctx, "10.2.0.2")
+			return err == nil && info.ID == "p1"
+		})
+	})
+
+	t.Run("should keep the entry of a pod that reuses the IP of a terminating pod", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		api := newKubeAPIStub()
+		api.SetNamespace("team-a", nil)
+
+		svc := newKubernetesContainerService(t, ctx, api)
+		go svc.Watch(ctx)
+		waitFor(t, func() bool { return len(api.WatchVersions()) == 2 })
+
+		api.podEvents <- kubeEvent("ADDED", kubePodObject("p1", "team-a", "10.2.0.2", false, nil))
+		oldPod := kubePodObject("p1", "team-a", "10.2.0.2", false, nil)
+		oldPod["metadata"].(map[string]interface{})["deletionTimestamp"] = "2020-01-01T00:00:00Z"
+		api.podEvents <- kubeEvent("MODIFIED", oldPod)
+		api.podEvents <- kubeEvent("ADDED", kubePodObject("p2", "team-a", "10.2.0.2", false, nil))
+
+		// The terminating pod still reports the IP until it is deleted.
+		api.podEvents <- kubeEvent("MODIFIED", oldPod)
+		api.podEvents <- kubeEvent("DELETED", oldPod)
+
+		// Events of a stream are handled in order.
+		api.podEvents <- kubeEvent("ADDED", kubePodObject("p3", "team-a", "10.2.0.3", false, nil))
+		waitFor(t, func() bool {
+			_, err := svc.ContainerForIP(ctx, "10.2.0.3")
+			return err == nil
+		})
+
+		info, err := svc.ContainerForIP(ctx, "10.2.0.2")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{"p2", info.ID}})
+	})
+
+	t.Run("should resume watches without listing pods", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		api := newKubeAPIStub()
+		api.SetNamespace("team-a", nil)
+
+		svc := newKubernetesContainerService(t, ctx, api)
+		go svc.Watch(ctx)
+
+		waitFor(t, func() bool { return len(api.WatchVersions()) == 2 })
+		listCalls := api.ListCalls()
+
+		pod := kubePodObject("p1", "team-a", "10.2.0.2", false, nil)
+		pod["metadata"].(map[string]interface{})["resourceVersion"] = "5"
+		api.podEvents <- kubeEvent("ADDED", pod)
+
+		// The stream times out.
+		api.podEvents <- nil
+		waitFor(t, func() bool {
+			for _, version := range api.WatchVersions() {
+				if version == "/api/v1/pods@5" {
+					return true
+				}
+			}
+			return false
+		})
+
+		if _, err := svc.ContainerForIP(ctx, "10.2.0.2"); err != nil {
+			t.Fatalf("expected cached pod after resuming, got [%s]", err)
+		}
+		if api.ListCalls() != listCalls {
+			t.Fatalf("expected no list calls after a watch timeout, got %d", api.ListCalls()-listCalls)
+		}
+
+		// The resource version expired.
+		api.podEvents <- kubeEvent("ERROR", map[string]interface{}{"kind": "Status", "code": 410, "message": "too old resource version"})
+		waitFor(t, func() bool { return api.ListCalls() > listCalls })
+	})
+
+	t.Run("should deny aliases not allowed in the namespace", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		api := newKubeAPIStub()
+		api.SetNamespace("team-a", map[string]string{proxy.AllowedRoleAliasesAnnotationKey: "noperms, other"})
+		api.SetPod("p1", "team-a", "10.2.0.2", map[string]string{proxy.RoleLabelKey: "db"})
+		api.SetPod("p2", "team-a", "10.2.0.3", map[string]string{proxy.RoleLabelKey: "noperms"})
+
+		h := proxy.RequestID(newAdminTestProxy(t, newKubernetesContainerService(t, ctx, api)))
+
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, "10.2.0.2", nil), 403)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReqBase+"/"+defaultRoleARNFriendlyName, "10.2.0.3", nil), 200)
+	})
+
+	t.Run("should ping the API server", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		fatalOnErr(t, newKubernetesContainerService(t, ctx, newKubeAPIStub()).Ping(ctx))
+	})
+}
@@ -0,0 +1,150 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+// freeAddr returns a loopback address whose port was free when checked.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListenContext(t *testing.T) {
+	t.Run("should drain in-flight requests after cancellation", func(t *testing.T) {
+		config := defaultConfig()
+		config.ListenAddr = freeAddr(t)
+		config.ShutdownGraceSeconds = 5
+
+		dbARN := config.AliasToARN["db"]
+		stsSvc := newBlockingAssumeRoleStub(dbARN)
+		httpClient := roundTripperStub{
+			res: &http.Response{Body: ioutil.NopCloser(strings.NewReader("")), StatusCode: 200},
+		}
+
+		// Requests over TCP arrive from loopback, so map it to the container with the DB role.
+		containerSvc := newDockerContainerServiceStub(ipContainerInfo{
+			"127.0.0.1": defaultIPContainerInfo()[ipWithAllLabels],
+		})
+
+		p, err := proxy.New(config, httpClient, stsSvc, containerSvc, nil)
+		fatalOnErr(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		listenErr := make(chan error, 1)
+		go func() {
+			listenErr <- p.ListenContext(ctx)
+		}()
+
+		waitFor(t, func() bool {
+			conn, dialErr := net.Dial("tcp", config.ListenAddr)
+			if dialErr == nil {
+				conn.Close()
+			}
+			return dialErr == nil
+		})
+
+		resCode := make(chan int, 1)
+		go func() {
+			res, getErr := http.Get("http://" + config.ListenAddr + defaultPathReqBase + "/" + dbRoleARNFriendlyName)
+			if getErr != nil {
+				resCode <- 0
+				return
+			}
+			res.Body.Close()
+			resCode <- res.StatusCode
+		}()
+
+		<-stsSvc.started
+		cancel()
+
+		select {
+		case err := <-listenErr:
+			t.Fatalf("expected ListenContext to wait for the in-flight request, returned [%+v]", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		stsSvc.Release(dbARN)
+
+		if code := <-resCode; code != http.StatusOK {
+			t.Fatalf("expected HTTP code 200, got %d", code)
+		}
+
+		select {
+		case err := <-listenErr:
+			fatalOnErr(t, err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for ListenContext to return")
+		}
+
+		if conn, dialErr := net.Dial("tcp", config.ListenAddr); dialErr == nil {
+			conn.Close()
+			t.Fatal("expected listener to be closed")
+		}
+	})
+
+	t.Run("should close all servers that do not drain in time", func(t *testing.T) {
+		config := defaultConfig()
+		config.ListenAddr = freeAddr(t)
+		config.AdminListenAddr = freeAddr(t)
+		config.ShutdownGraceSeconds = 1
+
+		p, err := proxy.New(config, roundTripperStub{}, defaultStsSvcStub(), defaultContainerSvcStub(), nil)
+		fatalOnErr(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		listenErr := make(chan error, 1)
+		go func() {
+			listenErr <- p.ListenContext(ctx)
+		}()
+
+		// Each server holds a connection with an incomplete request, which keeps it from draining.
+		var conns []net.Conn
+		for _, addr := range []string{config.ListenAddr, config.AdminListenAddr} {
+			var conn net.Conn
+			waitFor(t, func() bool {
+				var dialErr error
+				conn, dialErr = net.Dial("tcp", addr)
+				return dialErr == nil
+			})
+			defer conn.Close()
+			_, err := conn.Write([]byte("GET / HTTP/1.1\r\n"))
+			fatalOnErr(t, err)
+			conns = append(conns, conn)
+		}
+		time.Sleep(50 * time.Millisecond) // let the servers read from the connections
+
+		cancel()
+
+		select {
+		case err := <-listenErr:
+			if err == nil {
+				t.Fatal("expected error for servers that did not drain")
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for ListenContext to return")
+		}
+
+		for _, conn := range conns {
+			fatalOnErr(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("expected connection to [%s] to be closed, got [%v]", conn.RemoteAddr(), err)
+			}
+		}
+	})
+}
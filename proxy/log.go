@@ -1,7 +1,266 @@
 package proxy
 
-type nopWriter struct{}
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-func (nopWriter) Write(p []byte) (int, error) {
-	return len(p), nil
+	"github.com/pkg/errors"
+)
+
+// Level selects the minimum severity of logged lines.
+type Level int
+
+// Levels in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Log formats selected by Config.LogFormat.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Keys of fields shared by log lines of different components.
+const (
+	logKeyRequestID   = "request_id"
+	logKeyClientIP    = "client_ip"
+	logKeyContainerID = "container_id"
+	logKeyRoleARN     = "role_arn"
+	logKeyLatency     = "latency"
+	logKeyError       = "error"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the name, ex. "info".
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.Errorf("invalid log level [%s]", name)
+}
+
+// loggerOutput is shared by a Logger and those derived from it with With, so that ApplyConfig
+// affects all of them.
+type loggerOutput struct {
+	out    io.Writer
+	level  Level
+	format string
+	now    func() time.Time
+	lock   sync.Mutex
+}
+
+// Logger writes leveled lines with key/value fields in the text (logfmt) or JSON format.
+// It is safe for concurrent use.
+type Logger struct {
+	output *loggerOutput
+	fields []interface{}
+}
+
+// NewLogger creates a Logger with the level and format selected by the config.
+// Verbose selects the debug level if no level is selected.
+func NewLogger(out io.Writer, config Config) *Logger {
+	l := &Logger{output: &loggerOutput{out: out, now: time.Now}}
+	_ = l.ApplyConfig(config)
+	return l
+}
+
+// newNopLogger creates a Logger that discards all lines.
+func newNopLogger() *Logger {
+	return NewLogger(ioutil.Discard, Config{LogLevel: "error"})
+}
+
+// ApplyConfig replaces the level and format, ex. after the config file changes.
+func (l *Logger) ApplyConfig(config Config) error {
+	level := LevelInfo
+	if config.Verbose {
+		level = LevelDebug
+	}
+	if config.LogLevel != "" {
+		var err error
+		if level, err = ParseLevel(config.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	format := config.LogFormat
+	if format == "" {
+		format = LogFormatText
+	}
+
+	l.output.lock.Lock()
+	l.output.level = level
+	l.output.format = format
+	l.output.lock.Unlock()
+
+	return nil
+}
+
+// With returns a Logger that adds the key/value pairs to each line.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{output: l.output, fields: fields}
+}
+
+// Enabled returns true if lines of the level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.output.lock.Lock()
+	defer l.output.lock.Unlock()
+	return level >= l.output.level
+}
+
+// Debug writes a line with alternating keys and values, ex. "container_id", id.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info writes a line with alternating keys and values.
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn writes a line with alternating keys and values.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error writes a line with alternating keys and values.
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	o := l.output
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if level < o.level {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	fields = append(fields, "time", o.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+	if o.level == LevelDebug {
+		fields = appendErrorStacks(fields)
+	}
+
+	var buf bytes.Buffer
+	if o.format == LogFormatJSON {
+		writeJSONFields(&buf, fields)
+	} else {
+		writeTextFields(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	_, _ = o.out.Write(buf.Bytes())
+}
+
+// appendErrorStacks adds a "<key>_stack" field, ex. "error_stack", for each error field whose
+// "%+v" form adds to its message, ex. the stack trace of a github.com/pkg/errors error.
+func appendErrorStacks(fields []interface{}) []interface{} {
+	n := len(fields)
+	for i := 0; i < n; i += 2 {
+		err, ok := fields[i+1].(error)
+		if !ok || err == nil {
+			continue
+		}
+		if stack := fmt.Sprintf("%+v", err); stack != err.Error() {
+			fields = append(fields, fmt.Sprint(fields[i])+"_stack", stack)
+		}
+	}
+	return fields
+}
+
+// logValue converts values without a useful JSON/text form, ex. errors, to strings.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.Seconds()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func writeJSONFields(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%+v", fields[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func writeTextFields(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		value := fmt.Sprintf("%v", logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+const loggerContextKey contextKey = "ec2metaproxyLogger"
+
+// contextWithLogger stores a request-scoped Logger, ex. with request ID and client IP fields.
+func contextWithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, l)
+}
+
+// loggerFromContext returns the request-scoped Logger, or the fallback if there is none.
+func loggerFromContext(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(loggerContextKey).(*Logger); ok {
+		return l
+	}
+	return fallback
 }
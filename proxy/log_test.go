@@ -0,0 +1,97 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+	"github.com/pkg/errors"
+)
+
+func TestLogger(t *testing.T) {
+	t.Run("should write JSON lines with bound fields", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := proxy.NewLogger(&buf, proxy.Config{LogFormat: proxy.LogFormatJSON})
+
+		l.With("request_id", "id-1").Warn("Test: message", "error", errors.New("failed"))
+
+		var line map[string]interface{}
+		fatalOnErr(t, json.Unmarshal(buf.Bytes(), &line))
+		for key, expected := range map[string]string{"level": "warn", "msg": "Test: message", "request_id": "id-1", "error": "failed"} {
+			if line[key] != expected {
+				t.Fatalf("expected field [%s] to be [%s], got [%v]", key, expected, line[key])
+			}
+		}
+		if _, ok := line["time"]; !ok {
+			t.Fatalf("expected a time field, got [%s]", buf.String())
+		}
+	})
+
+	t.Run("should omit lines below the level", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := proxy.NewLogger(&buf, proxy.Config{LogLevel: "warn"})
+
+		l.Info("Test: info")
+		if buf.Len() != 0 {
+			t.Fatalf("expected no output, got [%s]", buf.String())
+		}
+
+		fatalOnErr(t, l.ApplyConfig(proxy.Config{Verbose: true}))
+		l.Debug("Test: debug", "key", "a value")
+		if !strings.Contains(buf.String(), `level=debug msg="Test: debug" key="a value"`) {
+			t.Fatalf("expected a debug line, got [%s]", buf.String())
+		}
+	})
+
+	t.Run("should add stack traces of errors at the debug level", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := proxy.NewLogger(&buf, proxy.Config{LogFormat: proxy.LogFormatJSON})
+		err := errors.Wrap(errors.New("failed"), "Error testing")
+
+		l.Error("Test: without stack", "error", err)
+		fatalOnErr(t, l.ApplyConfig(proxy.Config{LogFormat: proxy.LogFormatJSON, Verbose: true}))
+		l.Error("Test: with stack", "error", err)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 lines, got [%s]", buf.String())
+		}
+		for i, expectStack := range []bool{false, true} {
+			var line map[string]interface{}
+			fatalOnErr(t, json.Unmarshal([]byte(lines[i]), &line))
+			if line["error"] != "Error testing: failed" {
+				t.Fatalf("expected the error message, got [%v]", line["error"])
+			}
+			stack, _ := line["error_stack"].(string)
+			if expectStack != strings.Contains(stack, "log_test.go") {
+				t.Fatalf("expected stack trace [%t], got [%s]", expectStack, lines[i])
+			}
+		}
+	})
+
+	t.Run("should log request fields of credentials responses", func(t *testing.T) {
+		var buf bytes.Buffer
+		config := defaultConfig()
+		config.LogFormat = proxy.LogFormatJSON
+
+		p, err := proxy.New(config, roundTripperStub{res: &http.Response{StatusCode: 200, Body: http.NoBody}}, defaultStsSvcStub(), defaultContainerSvcStub(), proxy.NewLogger(&buf, config))
+		fatalOnErr(t, err)
+
+		res := serveRequest(proxy.RequestID(p), "GET", defaultPathReq, defaultIP, nil)
+		responseCodeIs(t, res, 200)
+
+		var line map[string]interface{}
+		fatalOnErr(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &line))
+		for _, key := range []string{"request_id", "client_ip", "container_id", "role_arn", "latency"} {
+			if v, ok := line[key]; !ok || v == "" {
+				t.Fatalf("expected field [%s], got [%s]", key, buf.String())
+			}
+		}
+		if line["role_arn"] != config.AliasToARN["noperms"] {
+			t.Fatalf("expected role ARN [%s], got [%v]", config.AliasToARN["noperms"], line["role_arn"])
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package proxy
+
+// Minimal Prometheus text exposition (format version 0.0.4) support, in place of the client
+// library, to keep dependencies limited to the AWS SDK and Docker client.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLatencyBuckets are histogram upper bounds in seconds.
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsRegistry holds all collectors exposed by the /metrics handler.
+type metricsRegistry struct {
+	collectors []collector
+	lock       sync.Mutex
+}
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+func (r *metricsRegistry) register(c collector) {
+	r.lock.Lock()
+	r.collectors = append(r.collectors, c)
+	r.lock.Unlock()
+}
+
+// ServeHTTP writes all collectors in the text exposition format.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.writeTo(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// labelKey joins label values into a map key. Values are escaped when written.
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// counterVec is a monotonically increasing counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	keys   map[string][]string
+	lock   sync.Mutex
+}
+
+func newCounterVec(r *metricsRegistry, name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds 1 to the counter with the label values, in the order of the declared labels.
+func (c *counterVec) Inc(labelValues ...string) {
+	key := labelKey(labelValues)
+
+	c.lock.Lock()
+	c.values[key]++
+	if _, found := c.keys[key]; !found {
+		c.keys[key] = labelValues
+	}
+	c.lock.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec observes value distributions, e.g. latencies, partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+	lock    sync.Mutex
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(r *metricsRegistry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records a value with the label values, in the order of the declared labels.
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, found := h.series[key]
+	if !found {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	// metrics is shared by all Proxy and ContainerService instances in the process.
+	metrics = new(metricsRegistry)
+
+	requestsTotal = newCounterVec(metrics, "ec2metaproxy_requests_total",
+		"Container requests by route, HTTP status code and role alias.",
+		"route", "code", "role_alias")
+	requestDuration = newHistogramVec(metrics, "ec2metaproxy_request_duration_seconds",
+		"Container request latency by route, HTTP status code and role alias.", defaultLatencyBuckets,
+		"route", "code", "role_alias")
+
+	assumeRoleTotal = newCounterVec(metrics, "ec2metaproxy_sts_assume_role_total",
+		"STS AssumeRole calls by result.",
+		"result")
+	assumeRoleDuration = newHistogramVec(metrics, "ec2metaproxy_sts_assume_role_duration_seconds",
+		"STS AssumeRole latency.", defaultLatencyBuckets)
+
+	credentialsCacheTotal = newCounterVec(metrics, "ec2metaproxy_credentials_cache_total",
+		"Credentials cache lookups by result (hit or miss).",
+		"result")
+
+	dockerCallsTotal = newCounterVec(metrics, "ec2metaproxy_docker_calls_total",
+		"Docker API calls by operation and result.",
+		"operation", "result")
+
+	containerdCallsTotal = newCounterVec(metrics, "ec2metaproxy_containerd_calls_total",
+		"containerd (ctr) calls by operation and result.",
+		"operation", "result")
+
+	kubernetesCallsTotal = newCounterVec(metrics, "ec2metaproxy_kubernetes_calls_total",
+		"Kubernetes API calls by operation and result.",
+		"operation", "result")
+)
+
+const (
+	routeCredentials    = "credentials"
+	routeECSCredentials = "ecs_credentials"
+	routeForwarded      = "forwarded"
+	routeToken          = "token"
+
+	resultSuccess = "success"
+	resultError   = "error"
+	resultHit     = "hit"
+	resultMiss    = "miss"
+)
+
+// MetricsHandler serves process-wide metrics in the Prometheus text exposition format.
+func MetricsHandler() http.Handler {
+	return metrics
+}
+
+// callResult returns the result label of an API call.
+func callResult(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultSuccess
+}
@@ -0,0 +1,39 @@
+package proxy_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("should expose request, STS and cache metrics", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", defaultPathReq, defaultIP, nil), 200)
+		responseCodeIs(t, serveRequest(h, "GET", "/latest/meta-data/local-hostname", defaultIP, nil), 200)
+
+		res := httptest.NewRecorder()
+		proxy.MetricsHandler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+		responseCodeIs(t, res, 200)
+		body := bodyIsNonEmpty(t, res.Body)
+
+		for _, expected := range []string{
+			`ec2metaproxy_requests_total{route="credentials",code="200",role_alias="noperms"} `,
+			`ec2metaproxy_requests_total{route="forwarded",code="200",role_alias=""} `,
+			`ec2metaproxy_request_duration_seconds_bucket{route="credentials",code="200",role_alias="noperms",le="+Inf"} `,
+			`ec2metaproxy_request_duration_seconds_count{route="forwarded",code="200",role_alias=""} `,
+			`ec2metaproxy_sts_assume_role_total{result="success"} `,
+			`ec2metaproxy_sts_assume_role_duration_seconds_count `,
+			`ec2metaproxy_credentials_cache_total{result="hit"} `,
+			`ec2metaproxy_credentials_cache_total{result="miss"} `,
+			`# TYPE ec2metaproxy_docker_calls_total counter`,
+		} {
+			if !strings.Contains(body, expected) {
+				t.Fatalf("expected metrics to contain [%s], got:\n%s", expected, body)
+			}
+		}
+	})
+}
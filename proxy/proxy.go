@@ -1,13 +1,20 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
@@ -16,6 +23,14 @@ import (
 
 var credsRegex = regexp.MustCompile("^/(.+?)/meta-data/iam/security-credentials/(.*)$")
 
+const instanceIDPath = "/latest/meta-data/instance-id"
+
+var (
+	serverReadTimeout  = 10 * time.Second
+	serverWriteTimeout = 30 * time.Second
+	serverIdleTimeout  = 120 * time.Second
+)
+
 // MetadataCredentials fields are returned in HTTP responses as JSON.
 type MetadataCredentials struct {
 	Code            string
@@ -35,66 +50,163 @@ type Proxy struct {
 	httpClient    http.RoundTripper
 	credsProvider *credentialsProvider
 	config        Config
-	log           *log.Logger
+	log           *Logger
+	audit         *auditLog
+	tokens        *tokenStore
+	upstreamToken upstreamToken
+	configLock    sync.RWMutex
+	ready         readinessCache
+
+	hostInstanceID string
+	instanceIDLock sync.Mutex
 }
 
 // New creates a Proxy instance using the given configuration.
-func New(config Config, httpClient http.RoundTripper, stsSvc stsiface.STSAPI, containerSvc ContainerService, logger *log.Logger) (*Proxy, error) {
+func New(config Config, httpClient http.RoundTripper, stsSvc stsiface.STSAPI, containerSvc ContainerService, logger *Logger) (*Proxy, error) {
 	if logger == nil {
-		logger = log.New(new(nopWriter), "", log.LstdFlags)
+		logger = newNopLogger()
 	}
 
-	var defaultIamRole RoleARN
-	var err error
+	audit, err := newAuditLog(config.Audit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error configuring audit log")
+	}
 
-	if config.DefaultAlias != "" {
-		defaultIamRole, err = NewRoleARN(config.AliasToARN[config.DefaultAlias])
-		if err != nil {
-			return nil, errors.Wrap(err, "Error configuring proxy")
-		}
+	p := &Proxy{
+		httpClient: httpClient,
+		log:        logger,
+		audit:      audit,
+		config:     config,
+		tokens:     newTokenStore(),
 	}
 
-	p := Proxy{
-		credsProvider: newCredentialsProvider(stsSvc, containerSvc, defaultIamRole, config.DefaultPolicy),
-		httpClient:    httpClient,
-		log:           logger,
-		config:        config,
+	credsProvider, err := newCredentialsProvider(stsSvc, containerSvc, config, p.instanceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error configuring proxy")
 	}
+	p.credsProvider = credsProvider
 
-	return &p, nil
+	return p, nil
+}
+
+// ApplyConfig replaces the configuration, ex. after the config file changes, and evicts cached
+// credentials whose role or policy changed. Listen addresses cannot change while listening.
+func (p *Proxy) ApplyConfig(config Config) error {
+	if err := p.credsProvider.ApplyConfig(config); err != nil {
+		return errors.Wrap(err, "Error applying config to credentials provider")
+	}
+
+	p.configLock.Lock()
+	p.config = config
+	p.configLock.Unlock()
+
+	return nil
+}
+
+// currentConfig returns the most recently applied configuration.
+func (p *Proxy) currentConfig() Config {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.config
 }
 
 // ServeHTTP can be used to handle "/" requests and will delegate to HandleCredentials
 // to produce a response.
+//
+// IMDSv2 token requests are answered by HandleToken. Tokens presented by containers are
+// validated here and never forwarded upstream.
+//
+// ECS container credentials requests are answered by HandleECSCredentials. They are not subject
+// to IMDSv2 token validation.
+//
+// Each request is logged at the info level when it completes.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	clientIP := remoteIP(r.RemoteAddr)
-	reqID := requestIDFromContext(r.Context())
+	log := p.log.With(logKeyRequestID, requestIDFromContext(r.Context()), logKeyClientIP, clientIP)
+	var localAddr string
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr.String()
+	}
+	r = r.WithContext(contextWithClientConn(contextWithLogger(r.Context(), log), r.RemoteAddr, localAddr))
 
-	p.log.Printf("HandleCredentials (%s): PROXY REQUEST ip [%s] url [%s]", reqID, clientIP, r.URL.String())
+	log.Debug("ServeHTTP: proxy request", "method", r.Method, "url", r.URL.String())
 
 	match := credsRegex.FindStringSubmatch(r.URL.Path)
-	if match != nil {
-		p.HandleCredentials(MetadataURL, match[1], match[2], p.credsProvider, w, r)
+
+	route := routeForwarded
+	if r.URL.Path == tokenPath {
+		route = routeToken
+	} else if isECSCredentialsPath(r.URL.Path) {
+		route = routeECSCredentials
+	} else if match != nil {
+		route = routeCredentials
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer func() {
+		latency := time.Since(start)
+		code := strconv.Itoa(rec.Code())
+		requestDuration.Observe(latency.Seconds(), route, code, rec.roleAlias)
+		requestsTotal.Inc(route, code, rec.roleAlias)
+		log.Info("ServeHTTP: request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"code", rec.Code(),
+			"role_alias", rec.roleAlias,
+			logKeyContainerID, rec.containerID,
+			logKeyRoleARN, rec.roleARN,
+			logKeyLatency, latency,
+		)
+	}()
+
+	if route == routeToken {
+		p.HandleToken(w, r)
+		return
+	}
+
+	if route == routeECSCredentials {
+		p.HandleECSCredentials(p.credsProvider, w, r)
 		return
 	}
 
-	if p.config.Verbose {
-		p.log.Printf("ServeHTTP (%s): FORWARD REQUEST ip [%s] path [%s]", reqID, clientIP, r.URL.Path)
+	if !p.authorizeToken(w, r) {
+		return
 	}
 
-	proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", MetadataURL, r.URL.Path), r.Body)
+	if route == routeCredentials {
+		p.HandleCredentials(p.metadataURL(), match[1], match[2], p.credsProvider, w, r)
+		return
+	}
+
+	log.Debug("ServeHTTP: forward request", "path", r.URL.Path)
+
+	var body io.Reader
+	if r.ContentLength != 0 {
+		body = r.Body
+	}
+
+	proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", p.metadataURL(), r.URL.Path), body)
 
 	if err != nil {
-		p.log.Printf("ServeHTTP (%s): Error creating proxy http request: %+v", reqID, err)
+		log.Error("ServeHTTP: Error creating proxy http request", logKeyError, err)
 		http.Error(w, "An unexpected error occurred communicating with Amazon", http.StatusInternalServerError)
 		return
 	}
 
+	// Retries stop once the client disconnects.
+	proxyReq = proxyReq.WithContext(r.Context())
+
 	copyHeaders(proxyReq.Header, r.Header)
-	resp, err := p.httpClient.RoundTrip(proxyReq)
+	proxyReq.Header.Del(tokenHeaderKey)
+	proxyReq.Header.Del(tokenTTLHeaderKey)
+
+	resp, err := p.roundTripUpstream(proxyReq)
 
 	if err != nil {
-		p.log.Printf("ServeHTTP (%s): Error forwarding request to EC2 metadata service: %+v", reqID, err)
+		log.Error("ServeHTTP: Error forwarding request to EC2 metadata service", logKeyError, err)
 		http.Error(w, "An unexpected error occurred communicating with Amazon", http.StatusInternalServerError)
 		return
 	}
@@ -102,54 +214,230 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		closeErr := resp.Body.Close()
 		if closeErr != nil {
-			p.log.Printf("ServeHTTP (%s): Error closing respond body: %+v", reqID, closeErr)
+			log.Warn("ServeHTTP: Error closing response body", logKeyError, closeErr)
 		}
 	}()
 
 	copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 	if _, err := io.Copy(w, resp.Body); err != nil {
-		p.log.Printf("ServeHTTP (%s): Error copying response content from EC2 metadata service: %+v", reqID, err)
+		log.Warn("ServeHTTP: Error copying response content from EC2 metadata service", logKeyError, err)
+	}
+
+	log.Debug("ServeHTTP: forward response", "path", r.URL.Path, "code", resp.StatusCode)
+}
+
+// HandleToken responds to IMDSv2 session token requests identified in ServeHTTP.
+//
+// The token is issued by the proxy itself and bound to the requesting container, so it is only
+// accepted from the same client IP and container until the requested TTL elapses.
+func (p *Proxy) HandleToken(w http.ResponseWriter, r *http.Request) {
+	clientIP := remoteIP(r.RemoteAddr)
+	ctx := r.Context()
+	log := loggerFromContext(ctx, p.log)
+
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Mirror the upstream service: reject token requests that were forwarded by another proxy.
+	if r.Header.Get("X-Forwarded-For") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ttl, err := parseTokenTTL(r.Header.Get(tokenTTLHeaderKey))
+	if err != nil {
+		log.Warn("HandleToken: Invalid token request", logKeyError, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	containerID := p.containerIDForIP(ctx, clientIP)
+	token, err := p.tokens.Issue(clientIP, containerID, ttl, time.Now())
+	if err != nil {
+		log.Error("HandleToken: Error issuing token", logKeyContainerID, containerID, logKeyError, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(tokenTTLHeaderKey, strconv.Itoa(int(ttl/time.Second)))
+	if _, writeErr := w.Write([]byte(token)); writeErr != nil {
+		log.Warn("HandleToken: Error writing token to response", logKeyError, writeErr)
+	}
+
+	log.Debug("HandleToken: proxy response", logKeyContainerID, containerID, "ttl", ttl)
+}
+
+// authorizeToken validates the IMDSv2 token, if any, of a non-token request. It writes a 401
+// response and returns false if the token is invalid, or missing while the config requires one.
+func (p *Proxy) authorizeToken(w http.ResponseWriter, r *http.Request) bool {
+	clientIP := remoteIP(r.RemoteAddr)
+	ctx := r.Context()
+	log := loggerFromContext(ctx, p.log)
+	token := r.Header.Get(tokenHeaderKey)
+
+	if token == "" {
+		if p.currentConfig().HTTPTokens != HTTPTokensRequired {
+			return true
+		}
+		log.Warn("ServeHTTP: Rejected IMDSv1 request", "path", r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	if !p.tokens.Valid(token, clientIP, p.containerIDForIP(ctx, clientIP), time.Now()) {
+		log.Warn("ServeHTTP: Rejected invalid token", "path", r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// containerIDForIP returns the ID of the container at the IP, or an empty string if none is known.
+func (p *Proxy) containerIDForIP(ctx context.Context, clientIP string) string {
+	container, err := p.credsProvider.container.ContainerForIP(ctx, clientIP)
+	if err != nil {
+		return ""
+	}
+	return container.ID
+}
+
+// roundTripUpstream sends the request to the upstream metadata service with the proxy's own
+// IMDSv2 token, if one is cached. If the upstream service rejects a request without a token,
+// e.g. because the instance requires IMDSv2, a token is obtained and the request is retried once.
+func (p *Proxy) roundTripUpstream(req *http.Request) (*http.Response, error) {
+	token := p.upstreamToken.Get(time.Now())
+	if token != "" {
+		req.Header.Set(tokenHeaderKey, token)
 	}
 
-	if p.config.Verbose {
-		p.log.Printf("ServeHTTP (%s): FORWARD RESPONSE ip [%s] path [%s]", reqID, clientIP, r.URL.Path)
+	resp, err := p.roundTripRetry(req)
+	if err != nil || token != "" || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
 	}
+
+	token, err = p.fetchUpstreamToken(req.Context())
+	if err != nil {
+		loggerFromContext(req.Context(), p.log).Error("roundTripUpstream: Error requesting upstream token", logKeyError, err)
+		return resp, nil
+	}
+
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		loggerFromContext(req.Context(), p.log).Warn("roundTripUpstream: Error closing unauthorized response body", logKeyError, closeErr)
+	}
+
+	req.Header.Set(tokenHeaderKey, token)
+	return p.roundTripRetry(req)
+}
+
+// fetchUpstreamToken requests and caches a new IMDSv2 token from the upstream metadata service.
+func (p *Proxy) fetchUpstreamToken(ctx context.Context) (string, error) {
+	tokenReq, err := http.NewRequest(http.MethodPut, p.metadataURL()+tokenPath, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating upstream token request")
+	}
+	tokenReq = tokenReq.WithContext(ctx)
+	tokenReq.Header.Set(tokenTTLHeaderKey, strconv.Itoa(maxTokenTTLSeconds))
+
+	now := time.Now()
+	resp, err := p.roundTripRetry(tokenReq)
+	if err != nil {
+		return "", errors.Wrap(err, "Error requesting upstream token")
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			p.log.Warn("fetchUpstreamToken: Error closing token response body", logKeyError, closeErr)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Upstream token request returned code [%d]", resp.StatusCode)
+	}
+
+	tokenBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading upstream token")
+	}
+
+	token := string(tokenBytes)
+	p.upstreamToken.Set(token, now.Add(maxTokenTTLSeconds*time.Second))
+
+	return token, nil
+}
+
+// instanceID returns the host's EC2 instance ID from the upstream metadata service. It is cached
+// after the first successful request.
+func (p *Proxy) instanceID(ctx context.Context) (string, error) {
+	p.instanceIDLock.Lock()
+	defer p.instanceIDLock.Unlock()
+
+	if p.hostInstanceID != "" {
+		return p.hostInstanceID, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.metadataURL()+instanceIDPath, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating instance ID request")
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := p.roundTripUpstream(req)
+	if err != nil {
+		return "", errors.Wrap(err, "Error requesting instance ID")
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			p.log.Warn("instanceID: Error closing instance ID response body", logKeyError, closeErr)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Instance ID request returned code [%d]", resp.StatusCode)
+	}
+
+	idBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading instance ID")
+	}
+
+	p.hostInstanceID = strings.TrimSpace(string(idBytes))
+	return p.hostInstanceID, nil
 }
 
 // HandleCredentials responds to credentials requests identified in ServeHTTP.
 func (p *Proxy) HandleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvider, w http.ResponseWriter, r *http.Request) {
 	clientIP := remoteIP(r.RemoteAddr)
 	ctx := r.Context()
-	reqID := requestIDFromContext(ctx)
+	log := loggerFromContext(ctx, p.log)
 	awsURL := baseURL + "/" + apiVersion + "/meta-data/iam/security-credentials/"
 
-	if p.config.Verbose {
-		p.log.Printf("HandleCredentials (%s): UPSTREAM REQUEST ip [%s] path [%s]", reqID, clientIP, awsURL)
-	}
+	log.Debug("HandleCredentials: upstream request", "url", awsURL)
 
 	awsReq, err := http.NewRequest("GET", awsURL, nil)
 	if err != nil {
-		p.log.Printf("HandleCredentials (%s): Error creating request [%s]: %+v", reqID, awsURL, err)
+		log.Error("HandleCredentials: Error creating request", "url", awsURL, logKeyError, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	awsReq = awsReq.WithContext(ctx)
 
-	resp, err := p.httpClient.RoundTrip(awsReq)
+	resp, err := p.roundTripUpstream(awsReq)
 
 	if err != nil {
-		p.log.Printf("HandleCredentials (%s): Error requesting creds path for API version [%s]: %+v", reqID, apiVersion, err)
+		log.Error("HandleCredentials: Error requesting creds path", "api_version", apiVersion, logKeyError, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if p.config.Verbose {
-		p.log.Printf("HandleCredentials (%s): UPSTREAM RESPONSE ip [%s] path [%s] code [%d]", reqID, clientIP, awsURL, resp.StatusCode)
-	}
+	log.Debug("HandleCredentials: upstream response", "url", awsURL, "code", resp.StatusCode)
 
 	err = resp.Body.Close()
 	if err != nil {
-		p.log.Printf("HandleCredentials (%s): Error closing credentials response body: %+v", reqID, err)
+		log.Error("HandleCredentials: Error closing credentials response body", logKeyError, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -161,19 +449,25 @@ func (p *Proxy) HandleCredentials(baseURL, apiVersion, subpath string, c *creden
 
 	credentials, err := c.CredentialsForIP(ctx, clientIP)
 
+	if isAccessDenied(err) {
+		log.Warn("HandleCredentials: Denied credentials", logKeyError, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		p.log.Printf("HandleCredentials (%s): Error getting credentials for IP [%s]: %+v", reqID, clientIP, err)
+		log.Error("HandleCredentials: Error getting credentials", logKeyError, err)
 		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
 		return
 	}
 
 	roleName := credentials.RoleArn.RoleName()
 	statusCode := http.StatusOK
+	setCredentialsRole(w, credentials)
 
 	if len(subpath) == 0 {
 		_, writeErr := w.Write([]byte(roleName))
 		if writeErr != nil {
-			p.log.Printf("HandleCredentials (%s): Error writing role name to response: %+v", reqID, writeErr)
+			log.Warn("HandleCredentials: Error writing role name to response", logKeyError, writeErr)
 		}
 	} else if roleName == "" || (!strings.HasPrefix(subpath, roleName) || (len(subpath) > len(roleName) && subpath[len(roleName)-1] != '/')) {
 		// An idiosyncrasy of the standard EC2 metadata service:
@@ -193,29 +487,142 @@ func (p *Proxy) HandleCredentials(baseURL, apiVersion, subpath string, c *creden
 		})
 
 		if err != nil {
-			p.log.Printf("HandleCredentials (%s): Error marshaling credentials: %+v", reqID, err)
+			log.Error("HandleCredentials: Error marshaling credentials", logKeyError, err)
 			statusCode = http.StatusInternalServerError
 			w.WriteHeader(statusCode)
 		} else {
+			p.auditCredentials(log, requestIDFromContext(ctx), clientIP, credentials)
 			_, writeErr := w.Write(creds)
 			if writeErr != nil {
-				p.log.Printf("HandleCredentials (%s): Error writing credentials to response: %+v", reqID, writeErr)
+				log.Warn("HandleCredentials: Error writing credentials to response", logKeyError, writeErr)
 			}
 		}
 	}
 
-	if p.config.Verbose {
-		p.log.Printf("HandleCredentials (%s): PROXY RESPONSE ip [%s] path [%s] role [%s] subpath [%s] code [%d]", reqID, clientIP, awsURL, roleName, subpath, statusCode)
-	}
+	log.Debug("HandleCredentials: proxy response",
+		"subpath", subpath,
+		"code", statusCode,
+		logKeyContainerID, credentials.Container.ID,
+		logKeyRoleARN, credentials.RoleArn,
+	)
+}
+
+// AdminHandler serves operational endpoints which must not be reachable by containers.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	mux.HandleFunc("/healthz", p.HandleHealthz)
+	mux.HandleFunc("/readyz", p.HandleReadyz)
+	mux.HandleFunc("/containers", p.HandleAdminContainers)
+	mux.HandleFunc("/containers/resync", p.HandleAdminResync)
+	mux.HandleFunc("/credentials", p.HandleAdminCredentials)
+	mux.HandleFunc("/credentials/evict", p.HandleAdminEvict)
+	return mux
 }
 
-// Listen listens on the TCP address defined in the config file.
+// Listen listens on the TCP address defined in the config file until the process receives
+// SIGTERM or SIGINT. See ListenContext.
 func (p *Proxy) Listen() error {
-	err := http.ListenAndServe(p.config.ListenAddr, nil)
-	if err == nil {
-		p.log.Printf("Listen: [%s]", p.config.ListenAddr)
-	} else {
-		return errors.Wrapf(err, "Error listening on address [%s]", p.config.ListenAddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			p.log.Info("Listen: received signal", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return p.ListenContext(ctx)
+}
+
+// ListenContext listens on the TCP address defined in the config file until the context is
+// canceled. If the config file also defines an admin address, AdminHandler is served on it.
+//
+// After cancellation, in-flight requests are drained for up to the configured grace period.
+// It returns nil if all requests completed.
+//
+// Cached credentials are renewed in the background while it listens.
+func (p *Proxy) ListenContext(ctx context.Context) error {
+	refreshCtx, cancelRefresh := context.WithCancel(context.Background())
+	defer cancelRefresh()
+
+	go p.credsProvider.Refresh(refreshCtx)
+
+	config := p.currentConfig()
+	servers := []*http.Server{newServer(config.ListenAddr, RequestID(p))}
+	if config.AdminListenAddr != "" {
+		servers = append(servers, newServer(config.AdminListenAddr, p.AdminHandler()))
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			p.log.Info("Listen: listening", "addr", srv.Addr)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				errs <- errors.Wrapf(err, "Error listening on address [%s]", srv.Addr)
+			}
+		}(srv)
+	}
+
+	select {
+	case err := <-errs:
+		for _, srv := range servers {
+			_ = srv.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	grace := time.Duration(config.ShutdownGraceSeconds) * time.Second
+	p.log.Info("Listen: shutting down, draining requests", "grace", grace)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), grace)
+	defer cancelShutdown()
+
+	// The servers drain in parallel and share the grace period. Servers that do not drain in
+	// time are closed, which also closes their remaining connections.
+	shutdownErrs := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				_ = srv.Close()
+				shutdownErrs <- errors.Wrapf(err, "Error draining requests on address [%s]", srv.Addr)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	close(shutdownErrs)
+
+	var shutdownErr error
+	for err := range shutdownErrs {
+		if shutdownErr == nil {
+			shutdownErr = err
+		} else {
+			p.log.Error("Listen: Error draining requests", logKeyError, err)
+		}
+	}
+
+	return shutdownErr
+}
+
+// newServer creates a server whose timeouts bound slow clients. The write timeout exceeds
+// the time a credentials request may spend waiting on STS.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout:  serverIdleTimeout,
 	}
-	return nil
 }
@@ -28,6 +28,7 @@ const (
 	defaultCustomPolicy        = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["rds:DescribeDBInstances", "rds:DescribeDBClusters"],"Resource":["*"]}]}`
 	defaultPolicy              = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["ec2:DescribeInstances"],"Resource":["*"]}]}`
 	defaultProxiedBody         = "proxied body"
+	defaultAuthorizationToken  = "fakeAuthorizationToken"
 )
 
 type assumeRoleFn func(*sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error)
@@ -40,6 +41,9 @@ type assumeRoleStub struct {
 	input  *sts.AssumeRoleInput
 	output *sts.AssumeRoleOutput
 	err    error
+
+	callerIdentityCalls int
+	callerIdentityErr   error
 }
 
 // AssumeROle records input and returns configured output/error.
@@ -51,6 +55,12 @@ func (s *assumeRoleStub) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRole
 	return s.output, s.err
 }
 
+// GetCallerIdentity counts calls and returns the configured error.
+func (s *assumeRoleStub) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	s.callerIdentityCalls++
+	return &sts.GetCallerIdentityOutput{}, s.callerIdentityErr
+}
+
 func newAssumeRoleStubReturns(output *sts.AssumeRoleOutput, err error) *assumeRoleStub {
 	return &assumeRoleStub{
 		fn: func(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
@@ -74,7 +84,7 @@ func defaultConfig() proxy.Config {
 func defaultCreds() *sts.Credentials {
 	return &sts.Credentials{
 		AccessKeyId:     aws.String("fakeAccessKeyId"),
-		Expiration:      aws.Time(time.Now().Add(900 * time.Second)),
+		Expiration:      aws.Time(time.Now().Add(900 * time.Second).UTC().Round(0)), // Round(0) strips the monotonic reading lost in JSON
 		SecretAccessKey: aws.String("fakeSecretAccessKey"),
 		SessionToken:    aws.String("fakeSessionToken"),
 	}
@@ -101,19 +111,25 @@ func defaultIPContainerInfo() ipContainerInfo {
 
 	return ipContainerInfo{
 		defaultIP: proxy.ContainerInfo{
-			ID:      "container_0_a975a907324c3d17c92210df4379da3d5964535134a1c42cce580767f615d87d",
-			Name:    "container_0_name",
-			IamRole: noPermsARN,
+			ID:        "container_0_a975a907324c3d17c92210df4379da3d5964535134a1c42cce580767f615d87d",
+			Name:      "container_0_name",
+			RoleAlias: "noperms",
+			IamRole:   noPermsARN,
 		},
 		ipWithNoLabels: proxy.ContainerInfo{
 			ID:   "container_1_c8edc0715432097101f0e958b61f96412f91fa10e2a29814226cce097dc56b2f",
 			Name: "container_1_name",
 		},
 		ipWithAllLabels: proxy.ContainerInfo{
-			ID:        "container_2_30b00758601e903b4a3603bd59bfe15d4d165a33925afe52311f77a8ca02461a",
-			Name:      "container_2_name",
-			IamRole:   dbARN,
-			IamPolicy: defaultCustomPolicy,
+			ID:                 "container_2_30b00758601e903b4a3603bd59bfe15d4d165a33925afe52311f77a8ca02461a",
+			Name:               "container_2_name",
+			Image:              "example/db:1.0",
+			ImageDigests:       []string{"sha256:0e6a", "example/db@sha256:9f3b"},
+			Labels:             map[string]string{"com.example.team": "data,platform"},
+			RoleAlias:          "db",
+			IamRole:            dbARN,
+			IamPolicy:          defaultCustomPolicy,
+			AuthorizationToken: defaultAuthorizationToken,
 		},
 	}
 }
@@ -21,6 +21,22 @@ func TestResponse(t *testing.T) {
 		assumeRolePolicyIsNil(t, stsSvc)
 	})
 
+	t.Run("should resolve IPv6 and IPv4-mapped client addresses", func(t *testing.T) {
+		config := defaultConfig()
+		info := defaultIPContainerInfo()
+		info["fd00::2"] = info[defaultIP]
+		containerSvc := newDockerContainerServiceStub(info)
+
+		for _, remoteAddr := range []string{"[fd00:0::2]:4567", "[::ffff:" + defaultIP + "]:4567"} {
+			stsSvc := defaultStsSvcStub()
+			res, _, err := stubRequest(defaultPathSpec, defaultPathReq, config, stsSvc, containerSvc, remoteAddr)
+			fatalOnErr(t, err)
+
+			responseCodeIs(t, res, 200)
+			credsEqualDefaults(t, res.Body, stsSvc)
+		}
+	})
+
 	t.Run("should detect alias mismatch with request path", func(t *testing.T) {
 		config := defaultConfig()
 		stsSvc := defaultStsSvcStub()
@@ -114,6 +130,23 @@ func TestResponse(t *testing.T) {
 		assumeRolePolicyIsNil(t, stsSvc)
 	})
 
+	t.Run("should deny container without role if configured", func(t *testing.T) {
+		config := defaultConfig()
+		config.DenyUnlabeled = true
+
+		stsSvc := defaultStsSvcStub()
+		containerSvc := defaultContainerSvcStub()
+
+		res, _, err := stubRequest(defaultPathSpec, defaultPathReq, config, stsSvc, containerSvc, ipWithNoLabels)
+		fatalOnErr(t, err)
+
+		responseCodeIs(t, res, 403)
+		bodyIsEmpty(t, res.Body)
+		if stsSvc.input != nil {
+			t.Fatalf("expected no AssumeRole call, got input %+v", stsSvc.input)
+		}
+	})
+
 	t.Run("should proxy non credentials request", func(t *testing.T) {
 		config := defaultConfig()
 		stsSvc := defaultStsSvcStub()
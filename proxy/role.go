@@ -7,7 +7,8 @@ import (
 )
 
 var (
-	roleArnRegex = regexp.MustCompile(`^arn:aws:iam::(\d+):role/([^:]+/)?([^:]+?)$`)
+	// roleArnRegex accepts all partitions, ex. "aws", "aws-cn" and "aws-us-gov".
+	roleArnRegex = regexp.MustCompile(`^arn:(aws[a-z-]*):iam::(\d+):role/([^:]+/)?([^:]+?)$`)
 )
 
 // RoleARN holds parsed ARN sections.
@@ -16,6 +17,7 @@ type RoleARN struct {
 	path      string
 	name      string
 	accountID string
+	partition string
 }
 
 // NewRoleARN creates a new instance by parsing a full ARN string.
@@ -26,7 +28,7 @@ func NewRoleARN(value string) (RoleARN, error) {
 		return RoleARN{}, errors.Errorf("invalid role ARN [%s]", value)
 	}
 
-	return RoleARN{value, "/" + result[2], result[3], result[1]}, nil
+	return RoleARN{value, "/" + result[3], result[4], result[2], result[1]}, nil
 }
 
 // RoleName returns the "friendly" name, the ARN suffix.
@@ -44,6 +46,11 @@ func (r RoleARN) AccountID() string {
 	return r.accountID
 }
 
+// Partition returns the partition name, ex. "aws" or "aws-us-gov".
+func (r RoleARN) Partition() string {
+	return r.partition
+}
+
 // String returns the original, unparsed ARN.
 func (r RoleARN) String() string {
 	return r.value
@@ -31,3 +31,25 @@ func TestNewWithPath(t *testing.T) {
 		[2]string{"arn:aws:iam::123456789012:role/this/is/the/path/test-role-name", arn.String()},
 	})
 }
+
+func TestNewWithPartition(t *testing.T) {
+	for _, partition := range []string{"aws", "aws-cn", "aws-us-gov"} {
+		value := "arn:" + partition + ":iam::123456789012:role/test-role-name"
+		arn, err := proxy.NewRoleARN(value)
+		if err != nil {
+			t.Fatalf("unexpected err: %+v", err)
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"test-role-name", arn.RoleName()},
+			[2]string{"123456789012", arn.AccountID()},
+			[2]string{partition, arn.Partition()},
+			[2]string{value, arn.String()},
+		})
+	}
+}
+
+func TestNewWithInvalidPartition(t *testing.T) {
+	if _, err := proxy.NewRoleARN("arn:gcp:iam::123456789012:role/test-role-name"); err == nil {
+		t.Fatal("expected error")
+	}
+}
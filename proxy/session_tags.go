@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+// Sources of session tag values in SessionTagsConfig.Tags.
+const (
+	// TagSourceLabelPrefix precedes the name of a docker label, ex. "label:com.example.team".
+	TagSourceLabelPrefix = "label:"
+	// TagSourceImage selects the container's image name.
+	TagSourceImage = "image"
+	// TagSourceName selects the container's name.
+	TagSourceName = "name"
+	// TagSourceInstanceID selects the host's EC2 instance ID.
+	TagSourceInstanceID = "instanceId"
+)
+
+const (
+	maxSessionTags     = 50
+	maxSessionTagKey   = 128
+	maxSessionTagValue = 256
+)
+
+var (
+	// matches a valid STS session tag key
+	sessionTagKeyRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]+$`)
+	// matches char that is not valid in a STS session tag value
+	invalidSessionTagValueRegexp = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+)
+
+// SessionTagsConfig selects the STS session tags of each AssumeRole call, ex. for policies
+// that use the aws:PrincipalTag condition key.
+type SessionTagsConfig struct {
+	// Tags maps tag keys to the source of their values. See the TagSource constants.
+	Tags map[string]string `json:"tags"`
+	// TransitiveTagKeys selects Tags keys that persist in role chaining.
+	TransitiveTagKeys []string `json:"transitiveTagKeys"`
+}
+
+// validate checks the tag keys and sources.
+func (c SessionTagsConfig) validate() error {
+	if len(c.Tags) > maxSessionTags {
+		return errors.Errorf("Config file selected [%d] session tags, the maximum is [%d].", len(c.Tags), maxSessionTags)
+	}
+
+	for key, source := range c.Tags {
+		if len(key) > maxSessionTagKey || !sessionTagKeyRegexp.MatchString(key) {
+			return errors.Errorf("Config file selected an invalid session tag key [%s].", key)
+		}
+
+		switch {
+		case source == TagSourceImage, source == TagSourceName, source == TagSourceInstanceID:
+		case strings.HasPrefix(source, TagSourceLabelPrefix) && len(source) > len(TagSourceLabelPrefix):
+		default:
+			return errors.Errorf("Config file selected an invalid source [%s] of session tag [%s].", source, key)
+		}
+	}
+
+	for _, key := range c.TransitiveTagKeys {
+		if _, found := c.Tags[key]; !found {
+			return errors.Errorf("Config file selected a transitive session tag key [%s] not in 'tags'.", key)
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the container's tags. Tags whose label is missing are omitted.
+func (c SessionTagsConfig) resolve(ctx context.Context, container ContainerInfo, instanceID func(context.Context) (string, error)) (sessionTags, error) {
+	var tags sessionTags
+
+	keys := make([]string, 0, len(c.Tags))
+	for key := range c.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	resolved := make(map[string]bool)
+	for _, key := range keys {
+		source := c.Tags[key]
+
+		var value string
+		switch source {
+		case TagSourceImage:
+			value = container.Image
+		case TagSourceName:
+			value = container.Name
+		case TagSourceInstanceID:
+			id, err := instanceID(ctx)
+			if err != nil {
+				return sessionTags{}, errors.Wrapf(err, "Error resolving session tag [%s]", key)
+			}
+			value = id
+		default:
+			label, found := container.Labels[strings.TrimPrefix(source, TagSourceLabelPrefix)]
+			if !found {
+				continue
+			}
+			value = label
+		}
+
+		value = invalidSessionTagValueRegexp.ReplaceAllString(value, "_")
+		// STS limits values by characters, and a value cut within a character is invalid.
+		if utf8.RuneCountInString(value) > maxSessionTagValue {
+			value = string([]rune(value)[:maxSessionTagValue])
+		}
+
+		tags.tags = append(tags.tags, sessionTag{key: key, value: value})
+		resolved[key] = true
+	}
+
+	for _, key := range c.TransitiveTagKeys {
+		if resolved[key] {
+			tags.transitiveKeys = append(tags.transitiveKeys, key)
+		}
+	}
+
+	return tags, nil
+}
+
+type sessionTag struct {
+	key   string
+	value string
+}
+
+// sessionTags holds the resolved tags of one AssumeRole call.
+type sessionTags struct {
+	tags           []sessionTag
+	transitiveKeys []string
+}
+
+// Empty returns true if there are no tags to send.
+func (t sessionTags) Empty() bool {
+	return len(t.tags) == 0
+}
+
+// addToRequest is an AssumeRole build handler that adds the tags to the encoded query. The vendored
+// AWS SDK predates session tags, so sts.AssumeRoleInput has no fields for them.
+func (t sessionTags) addToRequest(r *request.Request) {
+	if r.Error != nil || r.Body == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		r.Error = errors.Wrap(err, "Error reading AssumeRole query")
+		return
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		r.Error = errors.Wrap(err, "Error parsing AssumeRole query")
+		return
+	}
+
+	for i, tag := range t.tags {
+		values.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), tag.key)
+		values.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), tag.value)
+	}
+	for i, key := range t.transitiveKeys {
+		values.Set(fmt.Sprintf("TransitiveTagKeys.member.%d", i+1), key)
+	}
+
+	r.SetBufferBody([]byte(values.Encode()))
+}
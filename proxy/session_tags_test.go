@@ -0,0 +1,99 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func TestSessionTags(t *testing.T) {
+	t.Run("should send tags from container metadata", func(t *testing.T) {
+		var recorder stsRecorder
+
+		config := defaultConfig()
+		config.SessionTags = proxy.SessionTagsConfig{
+			Tags: map[string]string{
+				"Team":     "label:com.example.team",
+				"Image":    "image",
+				"Name":     "name",
+				"Instance": "instanceId",
+				"Missing":  "label:com.example.missing",
+			},
+			TransitiveTagKeys: []string{"Team", "Missing"},
+		}
+		h := newTestHandler(t, config, sts.New(recorder.Session()))
+
+		res := serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil)
+		responseCodeIs(t, res, 200)
+
+		if len(recorder.queries) != 1 {
+			t.Fatalf("expected 1 request, got %d", len(recorder.queries))
+		}
+		query := recorder.queries[0]
+		stringsEqual(t, [][2]string{
+			[2]string{"AssumeRole", query.Get("Action")},
+			[2]string{config.AliasToARN["db"], query.Get("RoleArn")},
+			[2]string{"Image", query.Get("Tags.member.1.Key")},
+			[2]string{"example/db:1.0", query.Get("Tags.member.1.Value")},
+			[2]string{"Instance", query.Get("Tags.member.2.Key")},
+			[2]string{defaultProxiedBody, query.Get("Tags.member.2.Value")},
+			[2]string{"Name", query.Get("Tags.member.3.Key")},
+			[2]string{"container_2_name", query.Get("Tags.member.3.Value")},
+			[2]string{"Team", query.Get("Tags.member.4.Key")},
+			[2]string{"data_platform", query.Get("Tags.member.4.Value")},
+			[2]string{"", query.Get("Tags.member.5.Key")},
+			[2]string{"Team", query.Get("TransitiveTagKeys.member.1")},
+			[2]string{"", query.Get("TransitiveTagKeys.member.2")},
+		})
+	})
+
+	t.Run("should truncate values on character boundaries", func(t *testing.T) {
+		var recorder stsRecorder
+
+		config := defaultConfig()
+		config.SessionTags = proxy.SessionTagsConfig{
+			Tags: map[string]string{"Team": "label:com.example.team"},
+		}
+
+		// Each character takes 2 bytes, so a byte limit would cut the last one in half.
+		container := defaultIPContainerInfo()[ipWithAllLabels]
+		container.Labels = map[string]string{"com.example.team": "a" + strings.Repeat("é", 300)}
+		containerSvc := newDockerContainerServiceStub(ipContainerInfo{ipWithAllLabels: container})
+
+		httpClient := roundTripperStub{
+			res: &http.Response{Body: ioutil.NopCloser(strings.NewReader("")), StatusCode: 200},
+		}
+		p, err := proxy.New(config, httpClient, sts.New(recorder.Session()), containerSvc, newLogger().logger)
+		fatalOnErr(t, err)
+
+		res := serveRequest(p, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil)
+		responseCodeIs(t, res, 200)
+
+		if len(recorder.queries) != 1 {
+			t.Fatalf("expected 1 request, got %d", len(recorder.queries))
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"a" + strings.Repeat("é", 255), recorder.queries[0].Get("Tags.member.1.Value")},
+		})
+	})
+
+	t.Run("should not send tags by default", func(t *testing.T) {
+		var recorder stsRecorder
+
+		h := newTestHandler(t, defaultConfig(), sts.New(recorder.Session()))
+
+		res := serveRequest(h, "GET", defaultPathReqBase+"/"+dbRoleARNFriendlyName, ipWithAllLabels, nil)
+		responseCodeIs(t, res, 200)
+
+		if len(recorder.queries) != 1 {
+			t.Fatalf("expected 1 request, got %d", len(recorder.queries))
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"", recorder.queries[0].Get("Tags.member.1.Key")},
+		})
+	})
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StaticConfig selects the file of a StaticContainerService.
+type StaticConfig struct {
+	// File is a JSON file of workloads, ex. VMs, that have no container metadata. Its changes are
+	// applied without a restart.
+	File string `json:"file"`
+}
+
+func (s StaticConfig) validate() error {
+	if s.File == "" {
+		return errors.New("Config file must select a workloads file ('static.file') for the static runtime.")
+	}
+	return nil
+}
+
+// StaticWorkload is an entry of a StaticContainerService file.
+type StaticWorkload struct {
+	// Name identifies the workload, ex. a VM name, as its container ID and name.
+	Name string `json:"name"`
+	// IPs holds the workload's IPs and CIDRs, ex. "10.3.0.5" or "10.3.1.0/24".
+	IPs []string `json:"ips"`
+	// RoleAlias is an `aliasToARN` key. If empty, the default role applies.
+	RoleAlias string `json:"roleAlias"`
+	// Policy is a JSON IAM policy used in the AssumeRole operation.
+	Policy string `json:"policy"`
+	// Labels are used like container labels, ex. by authorization rules and session tags.
+	Labels map[string]string `json:"labels"`
+}
+
+// staticFile is the format of a StaticContainerService file.
+type staticFile struct {
+	Workloads []StaticWorkload `json:"workloads"`
+}
+
+// staticEntry maps an IP or CIDR of a workload to its ContainerInfo.
+type staticEntry struct {
+	ContainerInfo
+	ipOrCIDR string
+	network  *net.IPNet
+}
+
+// StaticContainerService maps IPs and CIDRs to workloads listed in a file, ex. Firecracker
+// microVMs or LXC guests whose traffic also reaches the proxy. Lookups select the workload
+// with the most specific matching CIDR.
+type StaticContainerService struct {
+	entries    []staticEntry
+	aliasToARN map[string]string
+	config     StaticConfig
+	log        *Logger
+	lock       sync.RWMutex
+}
+
+// NewStaticContainerService creates a ContainerService implementation backed by the workloads file.
+func NewStaticContainerService(config Config, logger *Logger) (*StaticContainerService, error) {
+	if err := config.Static.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &StaticContainerService{
+		aliasToARN: config.AliasToARN,
+		config:     config.Static,
+		log:        logger,
+	}
+	if err := s.load(config.AliasToARN); err != nil {
+		return nil, err
+	}
+
+	logger.Info("NewStaticContainerService: loaded workloads", "file", s.config.File, "entries", len(s.entries))
+
+	return s, nil
+}
+
+// TypeName implements a ContainerService method.
+func (s *StaticContainerService) TypeName() string {
+	return ContainerRuntimeStatic
+}
+
+// ApplyConfig replaces the alias-to-ARN mapping, ex. after the config file changes, and
+// reloads the workloads file so their roles reflect it.
+func (s *StaticContainerService) ApplyConfig(config Config) error {
+	if err := s.load(config.AliasToARN); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.aliasToARN = config.AliasToARN
+	s.lock.Unlock()
+
+	return nil
+}
+
+// ContainerForIP implements a ContainerService method.
+func (s *StaticContainerService) ContainerForIP(ctx context.Context, containerIP string) (ContainerInfo, error) {
+	ip := net.ParseIP(containerIP)
+	if ip == nil {
+		return ContainerInfo{}, errors.Errorf("No workload found for invalid IP [%s]", containerIP)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var match *staticEntry
+	matchOnes := -1
+	for i := range s.entries {
+		entry := &s.entries[i]
+		if !entry.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := entry.network.Mask.Size(); ones > matchOnes {
+			match, matchOnes = entry, ones
+		}
+	}
+
+	if match == nil {
+		return ContainerInfo{}, errors.Errorf("No workload found for IP [%s]", containerIP)
+	}
+
+	return match.ContainerInfo, nil
+}
+
+// Containers implements a ContainerInventory method. Entries of CIDRs have the CIDR as their IP.
+func (s *StaticContainerService) Containers() []ContainerEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	entries := make([]ContainerEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, ContainerEntry{ContainerInfo: entry.ContainerInfo, IP: entry.ipOrCIDR})
+	}
+	return entries
+}
+
+// Resync implements a ContainerInventory method. The whole workloads file is reloaded.
+func (s *StaticContainerService) Resync(ctx context.Context, containerID string) error {
+	s.lock.RLock()
+	aliasToARN := s.aliasToARN
+	s.lock.RUnlock()
+
+	return s.load(aliasToARN)
+}
+
+// Watch reloads the workloads file when its modification time or size changes, until the
+// context is canceled. A file which cannot be read or fails validation is logged and ignored,
+// and the current workloads stay in effect.
+func (s *StaticContainerService) Watch(ctx context.Context) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastInfo, _ := os.Stat(s.config.File)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(s.config.File)
+		if err != nil || (lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) && info.Size() == lastInfo.Size()) {
+			continue
+		}
+		lastInfo = info
+
+		s.log.Info("Watch: workloads file changed, reloading", "file", s.config.File)
+		if err := s.Resync(ctx, ""); err != nil {
+			s.log.Error("Watch: Rejected workloads file, keeping current workloads", "file", s.config.File, logKeyError, err)
+		}
+	}
+}
+
+// load replaces the entries with those of the workloads file, if it is valid.
+func (s *StaticContainerService) load(aliasToARN map[string]string) error {
+	content, err := ioutil.ReadFile(s.config.File)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading workloads file [%s]", s.config.File)
+	}
+
+	var file staticFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return errors.Wrapf(err, "Error parsing workloads file JSON [%s]", s.config.File)
+	}
+
+	entries, err := newStaticEntries(s.log, aliasToARN, file.Workloads)
+	if err != nil {
+		return errors.Wrapf(err, "Error validating workloads file [%s]", s.config.File)
+	}
+
+	s.lock.Lock()
+	s.entries = entries
+	s.lock.Unlock()
+
+	return nil
+}
+
+// newStaticEntries validates the workloads and returns an entry for each of their IPs and CIDRs.
+func newStaticEntries(log *Logger, aliasToARN map[string]string, workloads []StaticWorkload) ([]staticEntry, error) {
+	var entries []staticEntry
+	names := make(map[string]bool)
+	networks := make(map[string]string)
+
+	for _, workload := range workloads {
+		if workload.Name == "" {
+			return nil, errors.New("Workloads file must select a name for each workload.")
+		}
+		if names[workload.Name] {
+			return nil, errors.Errorf("Workloads file selected the name [%s] more than once.", workload.Name)
+		}
+		names[workload.Name] = true
+
+		if len(workload.IPs) == 0 {
+			return nil, errors.Errorf("Workloads file must select at least one IP or CIDR of workload [%s].", workload.Name)
+		}
+		if workload.RoleAlias != "" && aliasToARN[workload.RoleAlias] == "" {
+			return nil, errors.Errorf("Workloads file selected an alias [%s] of workload [%s] not mapped in 'aliasToARN'.", workload.RoleAlias, workload.Name)
+		}
+
+		selectors := map[string]string{PolicyLabelKey: workload.Policy}
+		if workload.RoleAlias != "" {
+			selectors[RoleLabelKey] = workload.RoleAlias
+		}
+		info, ok := newContainerInfo(log, aliasToARN, workload.Name, []string{workload.Name}, "", selectors)
+		if !ok {
+			return nil, errors.Errorf("Workloads file selected an invalid role for workload [%s].", workload.Name)
+		}
+		info.Labels = workload.Labels
+
+		for _, ipOrCIDR := range workload.IPs {
+			network, err := parseIPOrCIDR(ipOrCIDR)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Workloads file selected an invalid IP or CIDR of workload [%s]", workload.Name)
+			}
+			if other, found := networks[network.String()]; found {
+				return nil, errors.Errorf("Workloads file selected [%s] for both workloads [%s] and [%s].", ipOrCIDR, other, workload.Name)
+			}
+			networks[network.String()] = workload.Name
+
+			entries = append(entries, staticEntry{ContainerInfo: info, ipOrCIDR: ipOrCIDR, network: network})
+		}
+	}
+
+	return entries, nil
+}
+
+// parseIPOrCIDR returns the network of a CIDR, or of only the IP.
+func parseIPOrCIDR(ipOrCIDR string) (*net.IPNet, error) {
+	if strings.Contains(ipOrCIDR, "/") {
+		_, network, err := net.ParseCIDR(ipOrCIDR)
+		return network, errors.Wrapf(err, "Error parsing CIDR [%s]", ipOrCIDR)
+	}
+
+	ip := net.ParseIP(normalizeIP(ipOrCIDR))
+	if ip == nil {
+		return nil, errors.Errorf("Error parsing IP [%s]", ipOrCIDR)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
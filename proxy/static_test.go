@@ -0,0 +1,140 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func writeWorkloadsFile(t *testing.T, name string, workloads []proxy.StaticWorkload) {
+	content, err := json.Marshal(map[string]interface{}{"workloads": workloads})
+	fatalOnErr(t, err)
+	fatalOnErr(t, ioutil.WriteFile(name, content, 0600))
+}
+
+func newStaticContainerService(t *testing.T, workloads []proxy.StaticWorkload) (*proxy.StaticContainerService, string) {
+	f, err := ioutil.TempFile("", "ec2metaproxy-workloads")
+	fatalOnErr(t, err)
+	fatalOnErr(t, f.Close())
+	writeWorkloadsFile(t, f.Name(), workloads)
+
+	config := defaultConfig()
+	config.Static.File = f.Name()
+
+	svc, err := proxy.NewStaticContainerService(config, newLogger().logger)
+	fatalOnErr(t, err)
+	return svc, f.Name()
+}
+
+func defaultWorkloads() []proxy.StaticWorkload {
+	return []proxy.StaticWorkload{
+		{Name: "vm-db", IPs: []string{"10.3.0.5", "fd00:3::5"}, RoleAlias: "db", Policy: defaultPolicy, Labels: map[string]string{"team": "data"}},
+		{Name: "lxc-pool", IPs: []string{"10.3.0.0/24"}},
+	}
+}
+
+func TestStaticContainerService(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should select the most specific workload", func(t *testing.T) {
+		svc, name := newStaticContainerService(t, defaultWorkloads())
+		defer os.Remove(name)
+
+		for _, ip := range []string{"10.3.0.5", "fd00:3:0::5"} {
+			info, err := svc.ContainerForIP(ctx, ip)
+			fatalOnErr(t, err)
+			stringsEqual(t, [][2]string{
+				[2]string{"vm-db", info.ID},
+				[2]string{dbRoleARNFriendlyName, info.IamRole.RoleName()},
+				[2]string{defaultPolicy, info.IamPolicy},
+				[2]string{"data", info.Labels["team"]},
+			})
+		}
+
+		info, err := svc.ContainerForIP(ctx, "10.3.0.6")
+		fatalOnErr(t, err)
+		if info.ID != "lxc-pool" || !info.IamRole.Empty() {
+			t.Fatalf("expected lxc-pool without role, got [%+v]", info)
+		}
+
+		if _, err := svc.ContainerForIP(ctx, "10.4.0.1"); err == nil {
+			t.Fatal("expected no workload")
+		}
+	})
+
+	t.Run("should reload valid files only", func(t *testing.T) {
+		svc, name := newStaticContainerService(t, defaultWorkloads())
+		defer os.Remove(name)
+
+		writeWorkloadsFile(t, name, []proxy.StaticWorkload{{Name: "vm-new", IPs: []string{"10.3.0.5"}, RoleAlias: "noperms"}})
+		fatalOnErr(t, svc.Resync(ctx, ""))
+
+		info, err := svc.ContainerForIP(ctx, "10.3.0.5")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{[2]string{"vm-new", info.ID}})
+
+		for _, workloads := range [][]proxy.StaticWorkload{
+			{{Name: "vm-unmapped", IPs: []string{"10.3.0.5"}, RoleAlias: "unmapped"}},
+			{{Name: "vm-invalid", IPs: []string{"10.3.0.500"}}},
+			{{Name: "vm-1", IPs: []string{"10.3.0.5"}}, {Name: "vm-2", IPs: []string{"10.3.0.5/32"}}},
+		} {
+			writeWorkloadsFile(t, name, workloads)
+			if err := svc.Resync(ctx, ""); err == nil {
+				t.Fatalf("expected error for [%+v]", workloads)
+			}
+		}
+
+		if entries := svc.Containers(); len(entries) != 1 || entries[0].ID != "vm-new" {
+			t.Fatalf("expected the last valid workloads, got [%+v]", entries)
+		}
+	})
+}
+
+func TestCompositeContainerService(t *testing.T) {
+	static, name := newStaticContainerService(t, defaultWorkloads())
+	defer os.Remove(name)
+
+	composite := proxy.NewCompositeContainerService(defaultContainerSvcStub(), static)
+	if composite.TypeName() != "docker+static" {
+		t.Fatalf("expected type [docker+static], got [%s]", composite.TypeName())
+	}
+
+	t.Run("should consult services in order", func(t *testing.T) {
+		info, err := composite.ContainerForIP(context.Background(), defaultIP)
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{defaultIPContainerInfo()[defaultIP].ID, info.ID},
+			[2]string{"docker", info.Platform},
+		})
+
+		info, err = composite.ContainerForIP(context.Background(), "10.3.0.5")
+		fatalOnErr(t, err)
+		stringsEqual(t, [][2]string{
+			[2]string{"vm-db", info.ID},
+			[2]string{"static", info.Platform},
+		})
+
+		if _, err := composite.ContainerForIP(context.Background(), "10.4.0.1"); err == nil {
+			t.Fatal("expected no container")
+		}
+
+		if entries := composite.Containers(); len(entries) != len(defaultIPContainerInfo())+3 {
+			t.Fatalf("expected entries of both services, got [%+v]", entries)
+		}
+	})
+
+	t.Run("should name sessions by the platform of the container", func(t *testing.T) {
+		stsSvc := defaultStsSvcStub()
+
+		res, _, err := stubRequest(defaultPathSpec, defaultPathReqBase+"/"+dbRoleARNFriendlyName, defaultConfig(), stsSvc, composite, "10.3.0.5")
+		fatalOnErr(t, err)
+
+		responseCodeIs(t, res, 200)
+		stringsEqual(t, [][2]string{[2]string{"static-vm-db", aws.StringValue(stsSvc.input.RoleSessionName)}})
+	})
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/pkg/errors"
+)
+
+// defaultPartition is served by the session's STS client, i.e. the global endpoint, unless
+// Config.STSRegions selects a region.
+const defaultPartition = "aws"
+
+// defaultSTSRegions selects the STS region per partition, unless Config.STSRegions selects another.
+var defaultSTSRegions = map[string]string{
+	"aws-cn":     "cn-north-1",
+	"aws-us-gov": "us-gov-west-1",
+}
+
+// partitionDNSSuffixes selects the domain of regional STS endpoints per partition. The vendored SDK's
+// endpoint map does not cover all regions, ex. "us-gov-east-1", and resolves unknown ones to the
+// global endpoint of the "aws" partition.
+var partitionDNSSuffixes = map[string]string{
+	"aws":        "amazonaws.com",
+	"aws-cn":     "amazonaws.com.cn",
+	"aws-us-gov": "amazonaws.com",
+	"aws-iso":    "c2s.ic.gov",
+	"aws-iso-b":  "sc2s.sgov.gov",
+}
+
+// stsRegion returns the STS region of the partition, or false if none is known. The region is empty
+// for the default partition if the config does not select one.
+func stsRegion(config Config, partition string) (string, bool) {
+	if region := config.STSRegions[partition]; region != "" {
+		return region, true
+	}
+	if partition == defaultPartition {
+		return "", true
+	}
+	region, found := defaultSTSRegions[partition]
+	return region, found
+}
+
+// PartitionSTS routes AssumeRole calls to the STS endpoint of the role ARN's partition,
+// ex. a GovCloud role to an "aws-us-gov" regional endpoint. Other calls use the client
+// of the default partition.
+type PartitionSTS struct {
+	stsiface.STSAPI
+	clients map[string]stsiface.STSAPI
+	sess    *session.Session
+	config  Config
+}
+
+// CredentialsSTSAPI is implemented by STS clients that can create a client which signs requests
+// with other credentials. Role chaining requires it.
+type CredentialsSTSAPI interface {
+	stsiface.STSAPI
+	WithCredentials(accessKeyID, secretAccessKey, sessionToken string) stsiface.STSAPI
+}
+
+// NewPartitionSTS creates a client for each partition with a known STS region. Changes to
+// Config.STSRegions require a restart.
+func NewPartitionSTS(sess *session.Session, config Config) *PartitionSTS {
+	p := PartitionSTS{
+		clients: make(map[string]stsiface.STSAPI),
+		sess:    sess,
+		config:  config,
+	}
+
+	partitions := []string{defaultPartition}
+	for partition := range defaultSTSRegions {
+		partitions = append(partitions, partition)
+	}
+	for partition := range config.STSRegions {
+		partitions = append(partitions, partition)
+	}
+
+	for _, partition := range partitions {
+		region, _ := stsRegion(config, partition)
+		if region == "" {
+			p.clients[partition] = sts.New(sess)
+		} else {
+			p.clients[partition] = sts.New(sess, stsRegionConfig(partition, region))
+		}
+	}
+
+	p.STSAPI = p.clients[defaultPartition]
+
+	return &p
+}
+
+// stsRegionConfig selects the region and, if the partition's domain is known, the regional endpoint.
+func stsRegionConfig(partition, region string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if suffix, found := partitionDNSSuffixes[partition]; found {
+		config = config.WithEndpoint(fmt.Sprintf("https://sts.%s.%s", region, suffix))
+	}
+	return config
+}
+
+// WithCredentials creates a client with the same endpoints that signs requests with the
+// credentials, ex. of an intermediate role in a chain.
+func (p *PartitionSTS) WithCredentials(accessKeyID, secretAccessKey, sessionToken string) stsiface.STSAPI {
+	creds := awscredentials.NewStaticCredentials(accessKeyID, secretAccessKey, sessionToken)
+	return NewPartitionSTS(p.sess.Copy(aws.NewConfig().WithCredentials(creds)), p.config)
+}
+
+// AssumeRole calls AssumeRole on the client of the role ARN's partition.
+func (p *PartitionSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	client, err := p.client(input)
+	if err != nil {
+		return nil, err
+	}
+	return client.AssumeRole(input)
+}
+
+// AssumeRoleRequest creates a request with the client of the role ARN's partition. If there is
+// no such client, sending the request returns the error.
+func (p *PartitionSTS) AssumeRoleRequest(input *sts.AssumeRoleInput) (*request.Request, *sts.AssumeRoleOutput) {
+	client, err := p.client(input)
+	if err != nil {
+		req, output := p.STSAPI.AssumeRoleRequest(input)
+		req.Error = err
+		return req, output
+	}
+	return client.AssumeRoleRequest(input)
+}
+
+// GetCallerIdentity calls GetCallerIdentity on the client of the default alias' partition,
+// which is the instance's partition if the instance profile can assume the role.
+func (p *PartitionSTS) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	partition := defaultPartition
+	if role, err := NewRoleARN(p.config.AliasToARN[p.config.DefaultAlias]); err == nil {
+		partition = role.Partition()
+	}
+
+	if client, found := p.clients[partition]; found {
+		return client.GetCallerIdentity(input)
+	}
+	return p.STSAPI.GetCallerIdentity(input)
+}
+
+// client selects the client of the role ARN's partition.
+func (p *PartitionSTS) client(input *sts.AssumeRoleInput) (stsiface.STSAPI, error) {
+	role, err := NewRoleARN(aws.StringValue(input.RoleArn))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error selecting STS partition")
+	}
+
+	client, found := p.clients[role.Partition()]
+	if !found {
+		return nil, errors.Errorf("No STS region selected for partition [%s] of role [%s]", role.Partition(), role)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,115 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+// assumeRoleResponse is a minimal successful AssumeRole response body.
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>fakeAccessKeyId</AccessKeyId>
+      <SecretAccessKey>fakeSecretAccessKey</SecretAccessKey>
+      <SessionToken>fakeSessionToken</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+// stsRecorder records the host and query of requests from its session, which are answered
+// with assumeRoleResponse instead of being sent.
+type stsRecorder struct {
+	hosts   []string
+	queries []url.Values
+}
+
+func (s *stsRecorder) Session() *session.Session {
+	sess := session.New(aws.NewConfig().
+		WithRegion("us-west-2").
+		WithMaxRetries(0).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "token")))
+
+	sess.Handlers.Send.Clear()
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		body, err := ioutil.ReadAll(r.HTTPRequest.Body)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		query, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = err
+			return
+		}
+
+		s.hosts = append(s.hosts, r.HTTPRequest.URL.Host)
+		s.queries = append(s.queries, query)
+
+		r.HTTPResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(assumeRoleResponse)),
+		}
+	})
+
+	return sess
+}
+
+func TestPartitionSTS(t *testing.T) {
+	t.Run("should select endpoint by role partition", func(t *testing.T) {
+		var recorder stsRecorder
+
+		config := defaultConfig()
+		config.STSRegions = map[string]string{"aws-us-gov": "us-gov-east-1"}
+		stsSvc := proxy.NewPartitionSTS(recorder.Session(), config)
+
+		for _, arn := range []string{
+			"arn:aws:iam::123456789012:role/Commercial",
+			"arn:aws-cn:iam::123456789012:role/China",
+			"arn:aws-us-gov:iam::123456789012:role/GovCloud",
+		} {
+			_, err := stsSvc.AssumeRole(&sts.AssumeRoleInput{
+				RoleArn:         aws.String(arn),
+				RoleSessionName: aws.String("session"),
+			})
+			fatalOnErr(t, err)
+		}
+
+		if len(recorder.hosts) != 3 {
+			t.Fatalf("expected 3 requests, got %d", len(recorder.hosts))
+		}
+		stringsEqual(t, [][2]string{
+			[2]string{"sts.amazonaws.com", recorder.hosts[0]},
+			[2]string{"sts.cn-north-1.amazonaws.com.cn", recorder.hosts[1]},
+			[2]string{"sts.us-gov-east-1.amazonaws.com", recorder.hosts[2]},
+		})
+	})
+
+	t.Run("should reject role in partition without region", func(t *testing.T) {
+		var recorder stsRecorder
+
+		stsSvc := proxy.NewPartitionSTS(recorder.Session(), defaultConfig())
+
+		_, err := stsSvc.AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         aws.String("arn:aws-iso:iam::123456789012:role/Isolated"),
+			RoleSessionName: aws.String("session"),
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if len(recorder.hosts) != 0 {
+			t.Fatalf("expected no requests, got %v", recorder.hosts)
+		}
+	})
+}
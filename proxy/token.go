@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// tokenPath is the IMDSv2 endpoint which issues session tokens via PUT.
+	tokenPath = "/latest/api/token"
+	// tokenHeaderKey carries a session token in IMDSv2 requests.
+	tokenHeaderKey = "X-aws-ec2-metadata-token"
+	// tokenTTLHeaderKey carries the requested/granted session token lifetime in seconds.
+	tokenTTLHeaderKey = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	minTokenTTLSeconds = 1
+	maxTokenTTLSeconds = 21600
+
+	// upstreamTokenRenewal is how long before expiration the upstream token is replaced.
+	upstreamTokenRenewal = 5 * time.Minute
+
+	// maxClientTokens limits the live tokens of a client IP. Its oldest token is evicted to issue
+	// another, ex. to a container that requests one in a loop.
+	maxClientTokens = 16
+	// maxTokens limits the live tokens of all clients. The oldest token is evicted to issue another.
+	maxTokens = 4096
+)
+
+// sessionToken binds an issued IMDSv2 token to the client that requested it.
+type sessionToken struct {
+	ClientIP    string
+	ContainerID string
+	Expiration  time.Time
+	// Serial orders tokens by issue.
+	Serial uint64
+}
+
+// tokenStore issues and validates the proxy's own IMDSv2 session tokens. Tokens obtained
+// from the upstream metadata service are never handed to containers.
+type tokenStore struct {
+	tokens map[string]sessionToken
+	serial uint64
+	lock   sync.Mutex
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: make(map[string]sessionToken)}
+}
+
+// Issue creates a token usable only by the same client IP/container until it expires.
+//
+// Expired tokens are discarded. If the client, or all clients, already hold the maximum number
+// of live tokens, the oldest one is evicted.
+func (s *tokenStore) Issue(clientIP, containerID string, ttl time.Duration, now time.Time) (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, "Error generating session token")
+	}
+	token := base64.URLEncoding.EncodeToString(buf[:])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	clientTokens := 0
+	for k, v := range s.tokens {
+		if now.After(v.Expiration) {
+			delete(s.tokens, k)
+		} else if v.ClientIP == clientIP {
+			clientTokens++
+		}
+	}
+
+	if clientTokens >= maxClientTokens {
+		s.evictOldest(clientIP)
+	}
+	if len(s.tokens) >= maxTokens {
+		s.evictOldest("")
+	}
+
+	s.tokens[token] = sessionToken{
+		ClientIP:    clientIP,
+		ContainerID: containerID,
+		Expiration:  now.Add(ttl),
+		Serial:      s.serial,
+	}
+	s.serial++
+
+	return token, nil
+}
+
+// evictOldest discards the earliest issued token of the client IP, or of all clients if the IP
+// is empty. The caller must hold the lock.
+func (s *tokenStore) evictOldest(clientIP string) {
+	var oldest string
+	var oldestSerial uint64
+	for k, v := range s.tokens {
+		if clientIP != "" && v.ClientIP != clientIP {
+			continue
+		}
+		if oldest == "" || v.Serial < oldestSerial {
+			oldest, oldestSerial = k, v.Serial
+		}
+	}
+	delete(s.tokens, oldest)
+}
+
+// Valid returns true if the token was issued to the same client IP/container and has not expired.
+func (s *tokenStore) Valid(token, clientIP, containerID string, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, found := s.tokens[token]
+	if !found {
+		return false
+	}
+	if now.After(t.Expiration) {
+		delete(s.tokens, token)
+		return false
+	}
+	return t.ClientIP == clientIP && t.ContainerID == containerID
+}
+
+// upstreamToken caches the proxy's own IMDSv2 session token for the upstream metadata service.
+type upstreamToken struct {
+	value      string
+	expiration time.Time
+	lock       sync.Mutex
+}
+
+// Get returns the cached token, or an empty string if none is cached or it is about to expire.
+func (u *upstreamToken) Get(now time.Time) string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if now.Add(upstreamTokenRenewal).After(u.expiration) {
+		return ""
+	}
+	return u.value
+}
+
+// Set replaces the cached token.
+func (u *upstreamToken) Set(value string, expiration time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.value = value
+	u.expiration = expiration
+}
+
+// parseTokenTTL validates the TTL header value of a token request.
+func parseTokenTTL(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Error parsing token TTL [%s]", value)
+	}
+	if seconds < minTokenTTLSeconds || seconds > maxTokenTTLSeconds {
+		return 0, errors.Errorf("Token TTL [%d] is outside the range [%d, %d]", seconds, minTokenTTLSeconds, maxTokenTTLSeconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
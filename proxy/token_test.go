@@ -0,0 +1,139 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+)
+
+func issueToken(t *testing.T, h http.Handler, clientIP string) string {
+	res := serveRequest(h, "PUT", "/latest/api/token", clientIP, map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "60",
+	})
+	responseCodeIs(t, res, 200)
+	stringsEqual(t, [][2]string{
+		[2]string{"60", res.Header().Get("X-aws-ec2-metadata-token-ttl-seconds")},
+	})
+	return bodyIsNonEmpty(t, res.Body)
+}
+
+func TestToken(t *testing.T) {
+	t.Run("should accept issued token on credentials path", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+		token := issueToken(t, h, defaultIP)
+
+		res := serveRequest(h, "GET", defaultPathReq, defaultIP, map[string]string{
+			"X-aws-ec2-metadata-token": token,
+		})
+		responseCodeIs(t, res, 200)
+	})
+
+	t.Run("should reject invalid token", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		res := serveRequest(h, "GET", defaultPathReq, defaultIP, map[string]string{
+			"X-aws-ec2-metadata-token": "invalid",
+		})
+		responseCodeIs(t, res, 401)
+	})
+
+	t.Run("should reject token issued to another container", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+		token := issueToken(t, h, ipWithAllLabels)
+
+		res := serveRequest(h, "GET", defaultPathReq, defaultIP, map[string]string{
+			"X-aws-ec2-metadata-token": token,
+		})
+		responseCodeIs(t, res, 401)
+	})
+
+	t.Run("should evict the oldest token of a client over the limit", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		var tokens []string
+		for i := 0; i < 17; i++ {
+			tokens = append(tokens, issueToken(t, h, defaultIP))
+		}
+		otherToken := issueToken(t, h, ipWithAllLabels)
+
+		for _, c := range []struct {
+			token    string
+			clientIP string
+			code     int
+		}{
+			{tokens[0], defaultIP, 401},
+			{tokens[1], defaultIP, 200},
+			{tokens[16], defaultIP, 200},
+			{otherToken, ipWithAllLabels, 200},
+		} {
+			res := serveRequest(h, "GET", "/latest/meta-data/local-hostname", c.clientIP, map[string]string{
+				"X-aws-ec2-metadata-token": c.token,
+			})
+			responseCodeIs(t, res, c.code)
+		}
+	})
+
+	t.Run("should evict the oldest token of all clients over the limit", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		first := issueToken(t, h, defaultIP)
+		second := issueToken(t, h, defaultIP)
+		for i := 0; i < 4095; i++ {
+			issueToken(t, h, fmt.Sprintf("10.9.%d.%d", i/256, i%256))
+		}
+
+		for token, code := range map[string]int{first: 401, second: 200} {
+			res := serveRequest(h, "GET", "/latest/meta-data/local-hostname", defaultIP, map[string]string{
+				"X-aws-ec2-metadata-token": token,
+			})
+			responseCodeIs(t, res, code)
+		}
+	})
+
+	t.Run("should reject token request with invalid TTL", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		for _, ttl := range []string{"", "0", "21601", "abc"} {
+			res := serveRequest(h, "PUT", "/latest/api/token", defaultIP, map[string]string{
+				"X-aws-ec2-metadata-token-ttl-seconds": ttl,
+			})
+			responseCodeIs(t, res, 400)
+		}
+	})
+
+	t.Run("should reject token request with non-PUT method", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		res := serveRequest(h, "GET", "/latest/api/token", defaultIP, map[string]string{
+			"X-aws-ec2-metadata-token-ttl-seconds": "60",
+		})
+		responseCodeIs(t, res, 405)
+	})
+
+	t.Run("should accept IMDSv1 request by default", func(t *testing.T) {
+		h := newTestHandler(t, defaultConfig(), defaultStsSvcStub())
+
+		res := serveRequest(h, "GET", "/latest/meta-data/local-hostname", defaultIP, nil)
+		responseCodeIs(t, res, 200)
+	})
+
+	t.Run("should reject IMDSv1 request if tokens are required", func(t *testing.T) {
+		config := defaultConfig()
+		config.HTTPTokens = proxy.HTTPTokensRequired
+		h := newTestHandler(t, config, defaultStsSvcStub())
+
+		res := serveRequest(h, "GET", "/latest/meta-data/local-hostname", defaultIP, nil)
+		responseCodeIs(t, res, 401)
+
+		res = serveRequest(h, "GET", defaultPathReq, defaultIP, nil)
+		responseCodeIs(t, res, 401)
+
+		token := issueToken(t, h, defaultIP)
+		res = serveRequest(h, "GET", "/latest/meta-data/local-hostname", defaultIP, map[string]string{
+			"X-aws-ec2-metadata-token": token,
+		})
+		responseCodeIs(t, res, 200)
+	})
+}
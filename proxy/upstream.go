@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUpstreamDialTimeoutMillis     = 1000
+	defaultUpstreamResponseTimeoutMillis = 5000
+	defaultUpstreamMaxIdleConns          = 16
+	defaultUpstreamMaxAttempts           = 3
+	defaultUpstreamRetryBackoffMillis    = 100
+	upstreamIdleConnTimeout              = 90 * time.Second
+)
+
+// UpstreamConfig selects how requests are sent to the upstream metadata service.
+type UpstreamConfig struct {
+	// DialTimeoutMillis bounds connection attempts. Defaults to 1000.
+	DialTimeoutMillis int `json:"dialTimeoutMillis"`
+	// ResponseTimeoutMillis bounds the wait for response headers after a request is sent.
+	// Defaults to 5000.
+	ResponseTimeoutMillis int `json:"responseTimeoutMillis"`
+	// MaxIdleConns is the size of the keep-alive connection pool. Defaults to 16.
+	MaxIdleConns int `json:"maxIdleConns"`
+	// MaxAttempts is the number of attempts of requests without a body that fail with a
+	// connection error or a 502, 503 or 504 response. Defaults to 3. 1 disables retries.
+	MaxAttempts int `json:"maxAttempts"`
+	// RetryBackoffMillis is the delay before the first retry, which doubles for each later one.
+	// Defaults to 100.
+	RetryBackoffMillis int `json:"retryBackoffMillis"`
+}
+
+func (u *UpstreamConfig) validate() error {
+	fields := map[string]*int{
+		"dialTimeoutMillis":     &u.DialTimeoutMillis,
+		"responseTimeoutMillis": &u.ResponseTimeoutMillis,
+		"maxIdleConns":          &u.MaxIdleConns,
+		"maxAttempts":           &u.MaxAttempts,
+		"retryBackoffMillis":    &u.RetryBackoffMillis,
+	}
+	defaults := map[string]int{
+		"dialTimeoutMillis":     defaultUpstreamDialTimeoutMillis,
+		"responseTimeoutMillis": defaultUpstreamResponseTimeoutMillis,
+		"maxIdleConns":          defaultUpstreamMaxIdleConns,
+		"maxAttempts":           defaultUpstreamMaxAttempts,
+		"retryBackoffMillis":    defaultUpstreamRetryBackoffMillis,
+	}
+
+	for name, value := range fields {
+		if *value < 0 {
+			return errors.Errorf("Config file selected a negative 'upstream.%s' [%d].", name, *value)
+		}
+		if *value == 0 {
+			*value = defaults[name]
+		}
+	}
+
+	return nil
+}
+
+// maxAttempts returns MaxAttempts, or its default if the config was not validated.
+func (u UpstreamConfig) maxAttempts() int {
+	if u.MaxAttempts == 0 {
+		return defaultUpstreamMaxAttempts
+	}
+	return u.MaxAttempts
+}
+
+// retryBackoff returns the delay before the retry, ex. 1 for the first one.
+func (u UpstreamConfig) retryBackoff(retry int) time.Duration {
+	backoff := u.RetryBackoffMillis
+	if backoff == 0 {
+		backoff = defaultUpstreamRetryBackoffMillis
+	}
+	return time.Duration(backoff) * time.Millisecond << uint(retry-1)
+}
+
+// validateMetadataURL checks the upstream metadata base URL, ex. of a local IMDS emulator.
+func validateMetadataURL(metadataURL string) error {
+	u, err := url.Parse(metadataURL)
+	if err != nil {
+		return errors.Wrapf(err, "Config file selected an invalid 'metadataURL' [%s]", metadataURL)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return errors.Errorf("Config file selected an invalid 'metadataURL' [%s], expected a base URL, ex. [%s].", metadataURL, MetadataURL)
+	}
+	return nil
+}
+
+// NewUpstreamTransport creates a transport for requests to the upstream metadata service with
+// the timeouts and connection pool size selected by the config. It never uses an HTTP proxy
+// from the environment. Changes to these settings require a restart.
+func NewUpstreamTransport(config Config) *http.Transport {
+	upstream := config.Upstream
+	if err := upstream.validate(); err != nil {
+		upstream = UpstreamConfig{}
+		_ = upstream.validate()
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(upstream.DialTimeoutMillis) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ResponseHeaderTimeout: time.Duration(upstream.ResponseTimeoutMillis) * time.Millisecond,
+		MaxIdleConnsPerHost:   upstream.MaxIdleConns,
+		IdleConnTimeout:       upstreamIdleConnTimeout,
+	}
+}
+
+// metadataURL returns the upstream metadata base URL selected by the config, without a trailing slash.
+func (p *Proxy) metadataURL() string {
+	if u := p.currentConfig().MetadataURL; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return MetadataURL
+}
+
+// roundTripRetry sends the request, retrying requests without a body that fail with a
+// connection error or a 502, 503 or 504 response, until the attempts selected by the config
+// are exhausted or the request's context is canceled.
+func (p *Proxy) roundTripRetry(req *http.Request) (*http.Response, error) {
+	upstream := p.currentConfig().Upstream
+	attempts := upstream.maxAttempts()
+	if req.Body != nil {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := p.httpClient.RoundTrip(req)
+		if attempt >= attempts || !retryableUpstreamResult(resp, err) {
+			return resp, err
+		}
+
+		log := loggerFromContext(req.Context(), p.log)
+		if err != nil {
+			log.Warn("roundTripRetry: Error requesting upstream, retrying", "url", req.URL.String(), "attempt", attempt, logKeyError, err)
+		} else {
+			log.Warn("roundTripRetry: Upstream unavailable, retrying", "url", req.URL.String(), "attempt", attempt, "code", resp.StatusCode)
+			if closeErr := resp.Body.Close(); closeErr != nil {
+				log.Warn("roundTripRetry: Error closing response body", logKeyError, closeErr)
+			}
+		}
+
+		select {
+		case <-time.After(upstream.retryBackoff(attempt)):
+		case <-req.Context().Done():
+			return nil, errors.Wrapf(req.Context().Err(), "Error waiting to retry upstream request [%s]", req.URL)
+		}
+	}
+}
+
+// retryableUpstreamResult returns true if the request failed in a way that a retry may not.
+func retryableUpstreamResult(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package proxy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codeactual/ec2metaproxy/proxy"
+	"github.com/pkg/errors"
+)
+
+// upstreamStub returns its results in order, repeating the last one, and records request URLs.
+type upstreamStub struct {
+	codes []int
+	errs  []error
+	urls  []string
+	lock  sync.Mutex
+}
+
+func (u *upstreamStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	i := len(u.urls)
+	if i >= len(u.codes) {
+		i = len(u.codes) - 1
+	}
+	u.urls = append(u.urls, req.URL.String())
+
+	if u.errs[i] != nil {
+		return nil, u.errs[i]
+	}
+	return &http.Response{Body: ioutil.NopCloser(strings.NewReader(defaultProxiedBody)), StatusCode: u.codes[i]}, nil
+}
+
+func TestUpstream(t *testing.T) {
+	t.Run("should forward requests to configured metadata URL", func(t *testing.T) {
+		config := defaultConfig()
+		config.MetadataURL = "http://127.0.0.1:1338/"
+		upstream := &upstreamStub{codes: []int{200}, errs: []error{nil}}
+		p, err := proxy.New(config, upstream, defaultStsSvcStub(), defaultContainerSvcStub(), newLogger().logger)
+		fatalOnErr(t, err)
+
+		responseCodeIs(t, serveRequest(proxy.RequestID(p), "GET", "/latest/meta-data/local-hostname", defaultIP, nil), 200)
+		stringsEqual(t, [][2]string{[2]string{"http://127.0.0.1:1338/latest/meta-data/local-hostname", upstream.urls[0]}})
+	})
+
+	t.Run("should retry transient upstream failures", func(t *testing.T) {
+		config := defaultConfig()
+		config.Upstream = proxy.UpstreamConfig{MaxAttempts: 3, RetryBackoffMillis: 1}
+		upstream := &upstreamStub{codes: []int{0, 503, 200}, errs: []error{errors.New("connection refused"), nil, nil}}
+		p, err := proxy.New(config, upstream, defaultStsSvcStub(), defaultContainerSvcStub(), newLogger().logger)
+		fatalOnErr(t, err)
+
+		res := serveRequest(proxy.RequestID(p), "GET", "/latest/meta-data/local-hostname", defaultIP, nil)
+		responseCodeIs(t, res, 200)
+		if len(upstream.urls) != 3 {
+			t.Fatalf("expected 3 attempts, got [%d]", len(upstream.urls))
+		}
+	})
+
+	t.Run("should not retry beyond max attempts", func(t *testing.T) {
+		config := defaultConfig()
+		config.Upstream = proxy.UpstreamConfig{MaxAttempts: 1}
+		upstream := &upstreamStub{codes: []int{503, 200}, errs: []error{nil, nil}}
+		p, err := proxy.New(config, upstream, defaultStsSvcStub(), defaultContainerSvcStub(), newLogger().logger)
+		fatalOnErr(t, err)
+
+		responseCodeIs(t, serveRequest(proxy.RequestID(p), "GET", "/latest/meta-data/local-hostname", defaultIP, nil), 503)
+		if len(upstream.urls) != 1 {
+			t.Fatalf("expected 1 attempt, got [%d]", len(upstream.urls))
+		}
+	})
+
+	t.Run("should stop retrying once the client disconnects", func(t *testing.T) {
+		config := defaultConfig()
+		config.Upstream = proxy.UpstreamConfig{MaxAttempts: 3, RetryBackoffMillis: 60000}
+		upstream := &upstreamStub{codes: []int{503}, errs: []error{nil}}
+		p, err := proxy.New(config, upstream, defaultStsSvcStub(), defaultContainerSvcStub(), newLogger().logger)
+		fatalOnErr(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest("GET", "/latest/meta-data/local-hostname", nil).WithContext(ctx)
+		req.RemoteAddr = defaultIP + ":4567"
+
+		served := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			res := httptest.NewRecorder()
+			proxy.RequestID(p).ServeHTTP(res, req)
+			served <- res
+		}()
+
+		select {
+		case res := <-served:
+			responseCodeIs(t, res, 500)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the retry backoff to stop")
+		}
+		if len(upstream.urls) != 1 {
+			t.Fatalf("expected 1 attempt, got [%d]", len(upstream.urls))
+		}
+	})
+
+	t.Run("should create transport with configured settings", func(t *testing.T) {
+		config := defaultConfig()
+		config.Upstream = proxy.UpstreamConfig{ResponseTimeoutMillis: 250, MaxIdleConns: 4}
+		transport := proxy.NewUpstreamTransport(config)
+
+		if transport.ResponseHeaderTimeout.Seconds() != 0.25 || transport.MaxIdleConnsPerHost != 4 || transport.Proxy != nil {
+			t.Fatalf("expected configured transport, got [%+v]", transport)
+		}
+	})
+}
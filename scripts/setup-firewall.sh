@@ -48,6 +48,54 @@ function setup_firewall {
   fi
 }
 
+function setup_firewall6 {
+  local container_iface="${1}"
+  local proxy_port="${2}"
+  local metadata_ip="${3}"
+  local metadata_port="${4}"
+  local force="${5}"
+
+  local drop_args=(
+      -I INPUT
+      -p tcp
+      --dport "${proxy_port}"
+      ! -i "${container_iface}"
+      -j DROP
+  )
+
+  echo "Drop IPv6 traffic to ${proxy_port} not from container interface ${container_iface}"
+  if [ "$force" = "1" ]; then
+      ip6tables "${drop_args[@]}"
+  else
+      echo -e "ip6tables ${drop_args[@]}\n"
+  fi
+
+  echo "Redirect any IPv6 metadata requests from containers to the proxy service"
+  local proxy_ip=$(ip -6 -o addr show dev "${container_iface}" scope global | awk '{print $4}' | cut -d/ -f1 | head -n 1)
+
+  if [[ -z "${proxy_ip}" ]]; then
+    error "ERROR: container interface ${container_iface} has no global IPv6 address"
+    exit 1
+  fi
+
+  local forward_args=(
+      -t nat
+      -I PREROUTING
+      -p tcp
+      -d "${metadata_ip}" --dport "${metadata_port}"
+      -j DNAT
+      --to-destination "[${proxy_ip}]:${proxy_port}"
+      -i "${container_iface}"
+  )
+
+  if [ "$force" = "1" ]; then
+      ip6tables "${forward_args[@]}"
+  else
+      echo "ip6tables ${forward_args[@]}"
+      echo -e "\nUse --force to disable dry-run mode."
+  fi
+}
+
 function error {
   echo "${@:-}" 1>&2
 }
@@ -61,6 +109,8 @@ function print_help {
   error "                (default: 18000)"
   error "  --metadata-ip: IP of the EC2 metadata service (default: 169.254.169.254)"
   error "  --metadata-port: Port of the EC2 metadata service (default: 80)"
+  error "  --ipv6: Also redirect IPv6 metadata requests with ip6tables"
+  error "  --metadata-ipv6: IPv6 address of the EC2 metadata service (default: fd00:ec2::254)"
   error "  --force: Disable the default dry-run mode"
 }
 
@@ -69,6 +119,8 @@ function main {
   local proxy_port="18000"
   local metadata_ip="169.254.169.254"
   local metadata_port="80"
+  local metadata_ipv6="fd00:ec2::254"
+  local ipv6=""
   local force=""
 
   if [[ $EUID -ne 0 ]]; then
@@ -82,6 +134,8 @@ function main {
       --proxy-port) proxy_port="${2}"; shift;;
       --metadata-ip) metadata_ip="${2}"; shift;;
       --metadata-port) metadata_port="${2}"; shift;;
+      --metadata-ipv6) metadata_ipv6="${2}"; shift;;
+      --ipv6) ipv6="1";;
       --force) force="1";;
       -h|--help)
         print_help
@@ -114,6 +168,15 @@ function main {
     "${metadata_ip}"        \
     "${metadata_port}"      \
     "${force}"
+
+  if [[ "$ipv6" = "1" ]]; then
+    setup_firewall6         \
+      "${container_iface}"  \
+      "${proxy_port}"       \
+      "${metadata_ipv6}"    \
+      "${metadata_port}"    \
+      "${force}"
+  fi
 }
 
 main "${@:-}"